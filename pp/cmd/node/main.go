@@ -30,17 +30,75 @@ func main() {
 
 	//  创建 handlers，并将 eventManager 和其他依赖项传递给它们
 	pingHandler := handlers.NewPingHandler(node.EventManager, node.ServerAddr)
-	chatHandler := handlers.NewChatHandler()
+	chatHandler := handlers.NewChatHandler(node.Chat)
+	chatJoinHandler := handlers.NewChatJoinHandler(node.Chat)
+	chatLeaveHandler := handlers.NewChatLeaveHandler(node.Chat)
+	chatHistoryRequestHandler := handlers.NewChatHistoryRequestHandler(node.Chat)
+	chatHistoryHandler := handlers.NewChatHistoryHandler(node.Chat)
+	mailHandler := handlers.NewMailHandler(node.Mailbox)
+	mailReceiptHandler := handlers.NewMailReceiptHandler(node.Mailbox)
 	fileRequestHandler := handlers.NewFileRequestHandler(node.FileTransferManager, node.ServerAddr, node.EventManager) // 这里的 sendMessage 需要修改，通过事件触发
+	fileRequestErrorHandler := handlers.NewFileRequestErrorHandler()
 	fileChunkHandler := handlers.NewFileChunkHandler(node.FileTransferManager)
-	fileMetadataHandler := handlers.NewFileMetadataHandler(node.FileTransferManager)
+	fileMetadataHandler := handlers.NewFileMetadataHandler(node.FileTransferManager, node.PeerManager)
+	fileChunkRequestHandler := handlers.NewFileChunkRequestHandler(node.FileTransferManager, node.ServerAddr, node.EventManager)
+	fileChunkAckHandler := handlers.NewFileChunkAckHandler(node.FileTransferManager)
+	fileKeyHandler := handlers.NewFileKeyHandler(node.FileTransferManager, node.PeerManager)
+	fileHaveRequestHandler := handlers.NewFileHaveRequestHandler(node.FileTransferManager, node.ServerAddr, node.EventManager)
+	fileHaveHandler := handlers.NewFileHaveHandler(node.FileTransferManager, node.PeerManager)
+	fileSearchHandler := handlers.NewFileSearchHandler(node.Catalog, node.ServerAddr, node.EventManager)
+	fileSearchResultHandler := handlers.NewFileSearchResultHandler(node.Catalog)
+	fileAnnounceHandler := handlers.NewFileAnnounceHandler(node.Catalog)
+	relayReserveHandler := handlers.NewRelayReserveHandler(node.RelayService, node.PeerManager, node.ServerAddr, node.EventManager)
+	relayConnectHandler := handlers.NewRelayConnectHandler(node.RelayService, node.RelayClient, node.ID, node.ServerAddr, node.EventManager)
+	relayDataHandler := handlers.NewRelayDataHandler(node.RelayService, node.RelayClient)
+	relayCloseHandler := handlers.NewRelayCloseHandler(node.RelayService, node.RelayClient)
+	relayStatusHandler := handlers.NewRelayStatusHandler(node.RelayClient)
+	helloHandler := handlers.NewHelloHandler(node.PeerManager, node.Identity, cfg.Port, node.ServerAddr, node.EventManager)
+	helloProofHandler := handlers.NewHelloProofHandler(node.PeerManager, node.EventManager)
+	observeAddrHandler := handlers.NewObserveAddrHandler(node.NATService, node.ServerAddr, node.EventManager)
+	observedAddrHandler := handlers.NewObservedAddrHandler(node.NATService)
+	punchRequestHandler := handlers.NewPunchRequestHandler(node.NATService, node.PeerManager, node.ServerAddr, node.EventManager)
+	punchSyncHandler := handlers.NewPunchSyncHandler(node.NATService)
+	routedHandler := handlers.NewRoutedHandler(node.RoutingService)
+	routeLookupHandler := handlers.NewRouteLookupHandler(node.RoutingService)
+	routeFoundHandler := handlers.NewRouteFoundHandler(node.RoutingService)
 
 	//  注册 handlers 到 router
 	node.MessageRouter.RegisterHandler("ping", pingHandler)
 	node.MessageRouter.RegisterHandler("chat", chatHandler)
+	node.MessageRouter.RegisterHandler("chat_join", chatJoinHandler)
+	node.MessageRouter.RegisterHandler("chat_leave", chatLeaveHandler)
+	node.MessageRouter.RegisterHandler("chat_history_request", chatHistoryRequestHandler)
+	node.MessageRouter.RegisterHandler("chat_history", chatHistoryHandler)
+	node.MessageRouter.RegisterHandler("mail", mailHandler)
+	node.MessageRouter.RegisterHandler("mail_receipt", mailReceiptHandler)
 	node.MessageRouter.RegisterHandler("file_request", fileRequestHandler)
+	node.MessageRouter.RegisterHandler("file_request_error", fileRequestErrorHandler)
 	node.MessageRouter.RegisterHandler("file_chunk", fileChunkHandler)
 	node.MessageRouter.RegisterHandler("file_metadata", fileMetadataHandler)
+	node.MessageRouter.RegisterHandler("file_chunk_request", fileChunkRequestHandler)
+	node.MessageRouter.RegisterHandler("file_chunk_ack", fileChunkAckHandler)
+	node.MessageRouter.RegisterHandler("file_key", fileKeyHandler)
+	node.MessageRouter.RegisterHandler("file_have_request", fileHaveRequestHandler)
+	node.MessageRouter.RegisterHandler("file_have", fileHaveHandler)
+	node.MessageRouter.RegisterHandler("file_search", fileSearchHandler)
+	node.MessageRouter.RegisterHandler("file_search_result", fileSearchResultHandler)
+	node.MessageRouter.RegisterHandler("file_announce", fileAnnounceHandler)
+	node.MessageRouter.RegisterHandler("relay_reserve", relayReserveHandler)
+	node.MessageRouter.RegisterHandler("relay_connect", relayConnectHandler)
+	node.MessageRouter.RegisterHandler("relay_data", relayDataHandler)
+	node.MessageRouter.RegisterHandler("relay_close", relayCloseHandler)
+	node.MessageRouter.RegisterHandler("relay_status", relayStatusHandler)
+	node.MessageRouter.RegisterHandler("hello", helloHandler)
+	node.MessageRouter.RegisterHandler("hello_proof", helloProofHandler)
+	node.MessageRouter.RegisterHandler("observe_addr", observeAddrHandler)
+	node.MessageRouter.RegisterHandler("observed_addr", observedAddrHandler)
+	node.MessageRouter.RegisterHandler("punch_request", punchRequestHandler)
+	node.MessageRouter.RegisterHandler("punch_sync", punchSyncHandler)
+	node.MessageRouter.RegisterHandler("routed", routedHandler)
+	node.MessageRouter.RegisterHandler("route_lookup", routeLookupHandler)
+	node.MessageRouter.RegisterHandler("route_found", routeFoundHandler)
 
 	// Start the node
 	if err := node.Start(); err != nil {
@@ -0,0 +1,309 @@
+package catalog
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/filetransfer"
+	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/util"
+)
+
+// maxResults caps the entries returned for one query.
+const maxResults = 100
+
+// Entry describes a file in a node's catalog.
+type Entry struct {
+	FileID string   `json:"file_id"` // pass to file_request to fetch the file
+	Name   string   `json:"name"`
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// Query is the payload of a file_search message. Every word of Text must
+// appear in the name and every tag must be present; empty fields match
+// everything.
+type Query struct {
+	ID    string   `json:"id"`
+	Text  string   `json:"text,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Limit int      `json:"limit,omitempty"`
+}
+
+// Results is the payload of a file_search_result message.
+type Results struct {
+	ID      string  `json:"id"`
+	Entries []Entry `json:"entries"`
+}
+
+// Announce is the payload of a file_announce message, advertising files a
+// node has started to share.
+type Announce struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Result is an entry found by a search, with the address of the peer that
+// holds it.
+type Result struct {
+	Addr string
+	Entry
+}
+
+// Catalog indexes the files this node shares and searches the catalogs of
+// its peers.
+type Catalog struct {
+	fileTransferManager *filetransfer.Manager
+	peerManager         *peer.Manager
+	announce            bool
+	serverAddr          string
+	eventManager        *events.EventManager
+
+	mu      sync.Mutex
+	local   map[string]Entry            // file ID -> entry
+	remote  map[string]map[string]Entry // peer address -> entries it announced
+	pending map[string]chan Result      // query ID -> waiting Search
+}
+
+// NewCatalog creates a new Catalog instance. With announce set, files
+// added to the index are announced to all peers.
+func NewCatalog(fileTransferManager *filetransfer.Manager, peerManager *peer.Manager, announce bool, serverAddr string, eventManager *events.EventManager) *Catalog {
+	return &Catalog{
+		fileTransferManager: fileTransferManager,
+		peerManager:         peerManager,
+		announce:            announce,
+		serverAddr:          serverAddr,
+		eventManager:        eventManager,
+		local:               make(map[string]Entry),
+		remote:              make(map[string]map[string]Entry),
+		pending:             make(map[string]chan Result),
+	}
+}
+
+// Run rebuilds the index every interval until shutdownCh is closed.
+func (c *Catalog) Run(interval time.Duration, shutdownCh chan struct{}) {
+	c.Rebuild()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+			c.Rebuild()
+		}
+	}
+}
+
+// Rebuild indexes the shared files again and announces the new ones.
+func (c *Catalog) Rebuild() {
+	local := make(map[string]Entry)
+	for _, file := range c.fileTransferManager.SharedFiles() {
+		local[file.FileID] = Entry{
+			FileID: file.FileID,
+			Name:   file.Name,
+			Size:   file.Size,
+			SHA256: file.SHA256,
+			Tags:   tagsOf(file.Name),
+		}
+	}
+
+	c.mu.Lock()
+	added := []Entry{}
+	for fileID, entry := range local {
+		if _, ok := c.local[fileID]; !ok {
+			added = append(added, entry)
+		}
+	}
+	c.local = local
+	c.mu.Unlock()
+
+	if c.announce && len(added) > 0 {
+		for _, addr := range c.peerManager.GetPeers() {
+			c.send(addr, message.Message{Type: "file_announce", Data: Announce{Entries: added}, Sender: c.serverAddr})
+		}
+	}
+}
+
+// AnnounceTo sends the whole index to a newly connected peer, if
+// announcing is enabled.
+func (c *Catalog) AnnounceTo(addr string) {
+	if !c.announce {
+		return
+	}
+	c.mu.Lock()
+	entries := make([]Entry, 0, len(c.local))
+	for _, entry := range c.local {
+		entries = append(entries, entry)
+	}
+	c.mu.Unlock()
+
+	if len(entries) > 0 {
+		c.send(addr, message.Message{Type: "file_announce", Data: Announce{Entries: entries}, Sender: c.serverAddr})
+	}
+}
+
+// Match returns the entries of the local index that match query.
+func (c *Catalog) Match(query Query) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return match(c.local, query)
+}
+
+// Search asks every peer for files matching query and collects the answers
+// until timeout. Matching files that peers announced are included too.
+func (c *Catalog) Search(query Query, timeout time.Duration) []Result {
+	query.ID = util.GenerateUUID()
+	resultCh := make(chan Result, maxResults)
+
+	c.mu.Lock()
+	c.pending[query.ID] = resultCh
+	seen := make(map[string]bool)
+	results := []Result{}
+	for addr, entries := range c.remote {
+		for _, entry := range match(entries, query) {
+			seen[addr+"|"+entry.FileID] = true
+			results = append(results, Result{Addr: addr, Entry: entry})
+		}
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, query.ID)
+		c.mu.Unlock()
+	}()
+
+	for _, addr := range c.peerManager.GetPeers() {
+		c.send(addr, message.Message{Type: "file_search", Data: query, Sender: c.serverAddr})
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-resultCh:
+			if key := result.Addr + "|" + result.FileID; !seen[key] {
+				seen[key] = true
+				results = append(results, result)
+			}
+		case <-timer.C:
+			return results
+		}
+	}
+}
+
+// HandleResults passes the answer of a peer to the Search waiting for it.
+func (c *Catalog) HandleResults(addr string, results Results) {
+	c.mu.Lock()
+	resultCh, ok := c.pending[results.ID]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, entry := range results.Entries {
+		select {
+		case resultCh <- Result{Addr: addr, Entry: entry}:
+		default:
+			// 结果过多，丢弃
+		}
+	}
+}
+
+// HandleAnnounce records the files a peer announced.
+func (c *Catalog) HandleAnnounce(addr string, announce Announce) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, ok := c.remote[addr]
+	if !ok {
+		entries = make(map[string]Entry)
+		c.remote[addr] = entries
+	}
+	for _, entry := range announce.Entries {
+		if filetransfer.ValidFileID(entry.FileID) {
+			entries[entry.FileID] = entry
+		}
+	}
+}
+
+// PeerDisconnected forgets the files announced by a peer.
+func (c *Catalog) PeerDisconnected(addr string) {
+	c.mu.Lock()
+	delete(c.remote, addr)
+	c.mu.Unlock()
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (c *Catalog) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	c.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// match returns the entries matching query, at most query.Limit of them.
+func match(entries map[string]Entry, query Query) []Entry {
+	limit := query.Limit
+	if limit <= 0 || limit > maxResults {
+		limit = maxResults
+	}
+	words := strings.Fields(strings.ToLower(query.Text))
+
+	matched := []Entry{}
+	for _, entry := range entries {
+		if len(matched) == limit {
+			break
+		}
+		name := strings.ToLower(entry.Name)
+		if containsAll(name, words) && hasTags(entry.Tags, query.Tags) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+func containsAll(s string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(s, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTags(tags []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if strings.EqualFold(tag, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tagsOf derives tags from a file name: the directories it is in and its
+// extension, so "music/jazz/take5.mp3" is tagged music, jazz and mp3.
+func tagsOf(name string) []string {
+	tags := []string{}
+	dir, file := path.Split(name)
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part != "" {
+			tags = append(tags, strings.ToLower(part))
+		}
+	}
+	if ext := strings.TrimPrefix(path.Ext(file), "."); ext != "" {
+		tags = append(tags, strings.ToLower(ext))
+	}
+	return tags
+}
@@ -0,0 +1,494 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/mailbox"
+	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/routing"
+	"pp/internal/util"
+)
+
+const (
+	// maxRoomLength and maxTextLength bound the room name and text of a
+	// chat message, in bytes.
+	maxRoomLength = 64
+	maxTextLength = 16 * 1024
+	// deliveryTimeout bounds how long SendDirect waits for the recipient to
+	// acknowledge a direct message.
+	deliveryTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidRoom = errors.New("invalid room name")
+	ErrInvalidText = errors.New("invalid chat text")
+	ErrNotJoined   = errors.New("room not joined")
+	ErrSignature   = errors.New("chat message not signed by its author")
+)
+
+// Message is the payload of a chat message: a message to a room, or a
+// direct message to one node when Room is empty.
+type Message struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room,omitempty"`
+	To        string    `json:"to,omitempty"` // node ID of the recipient of a direct message
+	Author    string    `json:"author"`       // node ID of the sender
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	Key       []byte    `json:"key"` // signing key of the author
+	Signature []byte    `json:"signature"`
+}
+
+// signedData returns what the author of a message signs.
+func (m Message) signedData() []byte {
+	data := []byte("pp chat\x00")
+	for _, field := range []string{m.ID, m.Room, m.To, m.Author, m.Text, strconv.FormatInt(m.Timestamp.UnixNano(), 10)} {
+		data = append(append(data, field...), 0)
+	}
+	return data
+}
+
+// Membership is the payload of chat_join and chat_leave messages, telling
+// peers which rooms a node joined or left.
+type Membership struct {
+	Rooms []string `json:"rooms"`
+}
+
+// Service sends and receives chat messages. Room messages go to the
+// connected peers that joined the room; direct messages are routed to the
+// recipient by node ID, so they reach nodes that are not connected too.
+// Received messages are published as ChatMessageEvents.
+//
+// Messages are signed by their authors, so they can be passed on in room
+// histories. Messages sent and received are kept in the data directory.
+// When two peers find they are in the same room, each asks the other for
+// the messages after the last one it has, page by page, so rooms catch up
+// after restarts and disconnects.
+type Service struct {
+	identity       *identity.Identity
+	nodeID         string
+	serverAddr     string
+	eventManager   *events.EventManager
+	peerManager    *peer.Manager
+	routingService *routing.Service
+	history        *history
+	mailbox        *mailbox.Mailbox // 对方不可达时暂存私信
+	mailboxTTL     time.Duration
+
+	mu       sync.Mutex
+	rooms    map[string]bool            // rooms this node joined
+	members  map[string]map[string]bool // room -> addresses of peers that joined it
+	requests map[historyPeer]int        // 已发出、尚未收到回复的历史请求
+}
+
+// historyPeer identifies the history of a room requested from a peer.
+type historyPeer struct {
+	addr string
+	room string
+}
+
+// NewService creates a new Service instance.
+func NewService(dataDir string, id *identity.Identity, serverAddr string, eventManager *events.EventManager, peerManager *peer.Manager, routingService *routing.Service) *Service {
+	return &Service{
+		identity:       id,
+		nodeID:         id.NodeID(),
+		serverAddr:     serverAddr,
+		eventManager:   eventManager,
+		peerManager:    peerManager,
+		routingService: routingService,
+		history:        newHistory(dataDir),
+		rooms:          make(map[string]bool),
+		members:        make(map[string]map[string]bool),
+		requests:       make(map[historyPeer]int),
+	}
+}
+
+// SetMailbox sets the mailbox direct messages are queued in, for ttl, when
+// the recipient cannot be reached.
+func (s *Service) SetMailbox(mb *mailbox.Mailbox, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailbox = mb
+	s.mailboxTTL = ttl
+}
+
+// Join joins a room, tells all peers and asks those already in the room
+// for its history.
+func (s *Service) Join(room string) error {
+	if !validRoom(room) {
+		return fmt.Errorf("%w: %q", ErrInvalidRoom, room)
+	}
+	s.mu.Lock()
+	joined := s.rooms[room]
+	s.rooms[room] = true
+	s.mu.Unlock()
+
+	if !joined {
+		s.broadcast("chat_join", Membership{Rooms: []string{room}})
+		for _, addr := range s.Members(room) {
+			s.requestHistory(addr, room)
+		}
+	}
+	return nil
+}
+
+// Leave leaves a room and tells all peers.
+func (s *Service) Leave(room string) error {
+	s.mu.Lock()
+	joined := s.rooms[room]
+	delete(s.rooms, room)
+	s.mu.Unlock()
+
+	if !joined {
+		return ErrNotJoined
+	}
+	s.broadcast("chat_leave", Membership{Rooms: []string{room}})
+	return nil
+}
+
+// Rooms returns the rooms this node joined, sorted by name.
+func (s *Service) Rooms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Members returns the addresses of the peers that joined a room.
+func (s *Service) Members(room string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]string, 0, len(s.members[room]))
+	for addr := range s.members[room] {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// SendRoom sends text to the peers in a joined room and returns the message
+// sent.
+func (s *Service) SendRoom(room string, text string) (Message, error) {
+	if !s.joined(room) {
+		return Message{}, ErrNotJoined
+	}
+	msg, err := s.newMessage(room, "", text)
+	if err != nil {
+		return Message{}, err
+	}
+	if _, err := s.history.add(roomLog(room), msg); err != nil {
+		return Message{}, err
+	}
+
+	for _, addr := range s.Members(room) {
+		s.send(addr, message.Message{Type: "chat", Data: msg, Sender: s.serverAddr})
+	}
+	return msg, nil
+}
+
+// SendDirect sends text to the node nodeID and waits until it acknowledges
+// delivery. With a mailbox set, a message the node cannot get now is
+// queued instead and delivered when it can be reached.
+func (s *Service) SendDirect(nodeID string, text string) (Message, error) {
+	msg, err := s.newMessage("", nodeID, text)
+	if err != nil {
+		return Message{}, err
+	}
+
+	payload, err := message.Serialize(message.Message{Type: "chat", Data: msg, Sender: s.serverAddr})
+	if err != nil {
+		return Message{}, err
+	}
+	if err := s.routingService.Send(nodeID, payload, deliveryTimeout); err != nil {
+		s.mu.Lock()
+		mb, ttl := s.mailbox, s.mailboxTTL
+		s.mu.Unlock()
+		if mb == nil {
+			return Message{}, fmt.Errorf("failed to deliver message to %s: %w", nodeID, err)
+		}
+		if _, err := mb.Send(nodeID, message.Message{Type: "chat", Data: msg, Sender: s.serverAddr}, ttl); err != nil {
+			return Message{}, fmt.Errorf("failed to queue message to %s: %w", nodeID, err)
+		}
+	}
+	if _, err := s.history.add(directLog(nodeID), msg); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// HandleMessage checks a chat message received from addr, stores it and
+// publishes it. Room messages are dropped unless this node joined the room.
+func (s *Service) HandleMessage(addr string, msg Message) error {
+	author := s.nodeAt(addr)
+	if author == "" || msg.Author != author {
+		return fmt.Errorf("message %s claims author %s but came from %s", msg.ID, msg.Author, addr)
+	}
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	name := roomLog(msg.Room)
+	if msg.Room == "" {
+		if msg.To != s.nodeID {
+			return fmt.Errorf("direct message %s is for %s", msg.ID, msg.To)
+		}
+		name = directLog(msg.Author)
+	} else if !s.joined(msg.Room) {
+		return nil
+	}
+	return s.deliver(name, msg)
+}
+
+// HandleHistoryRequest answers a peer in a room asking for its history.
+func (s *Service) HandleHistoryRequest(addr string, request HistoryRequest) {
+	if !s.joined(request.Room) || !s.isMember(request.Room, addr) {
+		return
+	}
+	messages, more := s.history.since(roomLog(request.Room), request.Since)
+	response := HistoryResponse{Room: request.Room, Messages: messages, More: more}
+	s.send(addr, message.Message{Type: "chat_history", Data: response, Sender: s.serverAddr})
+}
+
+// HandleHistory stores and publishes the messages of a room a peer sent
+// in answer to a history request, skipping those already known, and asks
+// for the next page while the peer has more.
+func (s *Service) HandleHistory(addr string, response HistoryResponse) error {
+	if !s.answered(addr, response.Room) {
+		return fmt.Errorf("unrequested history of room %s from %s", response.Room, addr)
+	}
+	if !s.joined(response.Room) {
+		return nil
+	}
+	for _, msg := range response.Messages {
+		if msg.Room != response.Room {
+			return fmt.Errorf("history of room %s from %s holds a message of room %s", response.Room, addr, msg.Room)
+		}
+		if err := checkMessage(msg); err != nil {
+			return err
+		}
+		if err := s.deliver(roomLog(msg.Room), msg); err != nil {
+			return err
+		}
+	}
+	if response.More && len(response.Messages) > 0 {
+		s.requestHistorySince(addr, response.Room, response.Messages[len(response.Messages)-1].ID)
+	}
+	return nil
+}
+
+// History returns at most limit of the latest messages of a room, oldest
+// first, or all that are kept when limit is 0.
+func (s *Service) History(room string, limit int) []Message {
+	return s.history.latest(roomLog(room), limit)
+}
+
+// DirectHistory returns at most limit of the latest direct messages
+// exchanged with a node, oldest first, or all that are kept when limit is 0.
+func (s *Service) DirectHistory(nodeID string, limit int) []Message {
+	return s.history.latest(directLog(nodeID), limit)
+}
+
+// HandleJoin records the rooms a peer joined and asks it for the history
+// of those this node is in too.
+func (s *Service) HandleJoin(addr string, membership Membership) {
+	s.mu.Lock()
+	shared := []string{}
+	for _, room := range membership.Rooms {
+		if !validRoom(room) {
+			continue
+		}
+		members, ok := s.members[room]
+		if !ok {
+			members = make(map[string]bool)
+			s.members[room] = members
+		}
+		members[addr] = true
+		if s.rooms[room] {
+			shared = append(shared, room)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, room := range shared {
+		s.requestHistory(addr, room)
+	}
+}
+
+// HandleLeave records the rooms a peer left.
+func (s *Service) HandleLeave(addr string, membership Membership) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, room := range membership.Rooms {
+		s.removeMember(room, addr)
+	}
+}
+
+// AnnounceTo tells a newly connected peer which rooms this node joined.
+func (s *Service) AnnounceTo(addr string) {
+	if rooms := s.Rooms(); len(rooms) > 0 {
+		s.send(addr, message.Message{Type: "chat_join", Data: Membership{Rooms: rooms}, Sender: s.serverAddr})
+	}
+}
+
+// PeerDisconnected removes a peer from all rooms.
+func (s *Service) PeerDisconnected(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for room := range s.members {
+		s.removeMember(room, addr)
+	}
+	for request := range s.requests {
+		if request.addr == addr {
+			delete(s.requests, request)
+		}
+	}
+}
+
+// requestHistory asks the peer at addr for the messages of a room after
+// the last one this node has.
+func (s *Service) requestHistory(addr string, room string) {
+	s.requestHistorySince(addr, room, s.history.lastID(roomLog(room)))
+}
+
+// requestHistorySince asks the peer at addr for the messages of a room
+// after the one with ID since.
+func (s *Service) requestHistorySince(addr string, room string, since string) {
+	s.mu.Lock()
+	s.requests[historyPeer{addr: addr, room: room}]++
+	s.mu.Unlock()
+
+	request := HistoryRequest{Room: room, Since: since}
+	s.send(addr, message.Message{Type: "chat_history_request", Data: request, Sender: s.serverAddr})
+}
+
+// answered records the answer of the peer at addr to a history request
+// for a room. It reports false when no request is outstanding.
+func (s *Service) answered(addr string, room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := historyPeer{addr: addr, room: room}
+	if s.requests[request] == 0 {
+		return false
+	}
+	s.requests[request]--
+	if s.requests[request] == 0 {
+		delete(s.requests, request)
+	}
+	return true
+}
+
+// deliver stores a received message and publishes it, unless it was
+// received before.
+func (s *Service) deliver(name string, msg Message) error {
+	added, err := s.history.add(name, msg)
+	if err != nil {
+		return err
+	}
+	if added {
+		s.eventManager.Publish(events.ChatMessageEvent{EventData: events.ChatMessageEventData{Message: msg}})
+	}
+	return nil
+}
+
+// joined reports whether this node joined a room.
+func (s *Service) joined(room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rooms[room]
+}
+
+// isMember reports whether the peer at addr joined a room.
+func (s *Service) isMember(room string, addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.members[room][addr]
+}
+
+// removeMember removes addr from a room. The caller must hold s.mu.
+func (s *Service) removeMember(room string, addr string) {
+	members, ok := s.members[room]
+	if !ok {
+		return
+	}
+	delete(members, addr)
+	if len(members) == 0 {
+		delete(s.members, room)
+	}
+}
+
+// newMessage returns a new signed message from this node to a room, or to
+// the node to when room is empty.
+func (s *Service) newMessage(room string, to string, text string) (Message, error) {
+	if text == "" || len(text) > maxTextLength || !utf8.ValidString(text) {
+		return Message{}, ErrInvalidText
+	}
+	msg := Message{
+		ID:        util.GenerateUUID(),
+		Room:      room,
+		To:        to,
+		Author:    s.nodeID,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+		Key:       s.identity.SigningKey(),
+	}
+	msg.Signature = s.identity.Sign(msg.signedData())
+	return msg, nil
+}
+
+// nodeAt returns the node ID of the peer at addr, or "" when unknown.
+func (s *Service) nodeAt(addr string) string {
+	if nodeID, ok := routing.ParseNodeAddr(addr); ok {
+		return nodeID
+	}
+	p, _ := s.peerManager.GetPeer(addr)
+	return p.NodeID
+}
+
+// broadcast sends a message to all peers.
+func (s *Service) broadcast(msgType string, data interface{}) {
+	for _, addr := range s.peerManager.GetPeers() {
+		s.send(addr, message.Message{Type: msgType, Data: data, Sender: s.serverAddr})
+	}
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (s *Service) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	s.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// checkMessage checks the fields of a received message and that its
+// author signed it.
+func checkMessage(msg Message) error {
+	if msg.ID == "" || len(msg.Text) > maxTextLength || !utf8.ValidString(msg.Text) {
+		return fmt.Errorf("%w: message %s", ErrInvalidText, msg.ID)
+	}
+	if identity.NodeIDOf(msg.Key) != msg.Author || !identity.Verify(msg.Key, msg.signedData(), msg.Signature) {
+		return fmt.Errorf("%w: message %s", ErrSignature, msg.ID)
+	}
+	return nil
+}
+
+func validRoom(room string) bool {
+	return room != "" && len(room) <= maxRoomLength && utf8.ValidString(room)
+}
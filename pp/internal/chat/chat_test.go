@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pp/internal/identity"
+)
+
+func testIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+	id, err := identity.Load(filepath.Join(t.TempDir(), "identity.key"))
+	if err != nil {
+		t.Fatalf("identity.Load: %v", err)
+	}
+	return id
+}
+
+func TestCheckMessage(t *testing.T) {
+	author, other := testIdentity(t), testIdentity(t)
+	s := &Service{identity: author, nodeID: author.NodeID()}
+	msg, err := s.newMessage("general", "", "hello")
+	if err != nil {
+		t.Fatalf("newMessage: %v", err)
+	}
+	if err := checkMessage(msg); err != nil {
+		t.Fatalf("checkMessage: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(m *Message)
+		wantErr error
+	}{
+		{"text", func(m *Message) { m.Text = "goodbye" }, ErrSignature},
+		{"room", func(m *Message) { m.Room = "other" }, ErrSignature},
+		{"recipient", func(m *Message) { m.To = other.NodeID() }, ErrSignature},
+		{"timestamp", func(m *Message) { m.Timestamp = m.Timestamp.Add(time.Second) }, ErrSignature},
+		{"ID", func(m *Message) { m.ID = "other" }, ErrSignature},
+		{"signature", func(m *Message) { m.Signature = append([]byte{m.Signature[0] ^ 1}, m.Signature[1:]...) }, ErrSignature},
+		{"no signature", func(m *Message) { m.Signature = nil }, ErrSignature},
+		{"no key", func(m *Message) { m.Key = nil }, ErrSignature},
+		// 用自己的密钥签名，却冒充别人
+		{"forged author", func(m *Message) {
+			m.Author = author.NodeID()
+			m.Key = other.SigningKey()
+			m.Signature = other.Sign(m.signedData())
+		}, ErrSignature},
+		{"other key", func(m *Message) { m.Key = other.SigningKey() }, ErrSignature},
+		{"no ID", func(m *Message) { m.ID = "" }, ErrInvalidText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forged := msg
+			tt.tamper(&forged)
+			if err := checkMessage(forged); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkMessage = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
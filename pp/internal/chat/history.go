@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// historyDir is the directory in the data directory holding the logs.
+	historyDir = "chat"
+	// maxHistory is how many of the latest messages of a conversation are
+	// kept in memory, answered to history requests and deduplicated.
+	// The logs themselves keep every message.
+	maxHistory = 1000
+	// maxSync bounds the messages sent in one chat_history message. Longer
+	// histories are sent in pages.
+	maxSync = 200
+)
+
+// HistoryRequest is the payload of a chat_history_request message, asking
+// for the messages of a room after the one with ID Since, or for all those
+// kept when Since is empty or unknown.
+type HistoryRequest struct {
+	Room  string `json:"room"`
+	Since string `json:"since,omitempty"`
+}
+
+// HistoryResponse is the payload of a chat_history message. More is set
+// when further messages follow the last one; the requester asks for them
+// with another request.
+type HistoryResponse struct {
+	Room     string    `json:"room"`
+	Messages []Message `json:"messages"`
+	More     bool      `json:"more,omitempty"`
+}
+
+// history stores the messages of each room and of the direct messages
+// with each node in an append-only log of JSON lines.
+type history struct {
+	dir string
+
+	mu            sync.Mutex
+	conversations map[string]*conversation // log file name -> messages
+}
+
+// conversation holds the latest messages of a log.
+type conversation struct {
+	messages []Message
+	ids      map[string]bool
+	partial  bool // the log ends in a line cut short
+}
+
+func newHistory(dataDir string) *history {
+	return &history{
+		dir:           filepath.Join(dataDir, historyDir),
+		conversations: make(map[string]*conversation),
+	}
+}
+
+// roomLog and directLog return the log file names of a room and of the
+// direct messages with a node. Names are hex encoded, since rooms and node
+// IDs may contain any character.
+func roomLog(room string) string {
+	return "room-" + hex.EncodeToString([]byte(room)) + ".log"
+}
+
+func directLog(nodeID string) string {
+	return "direct-" + hex.EncodeToString([]byte(nodeID)) + ".log"
+}
+
+// add appends a message to a log. It reports false, storing nothing, when
+// the message is already there.
+func (h *history) add(name string, msg Message) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := h.load(name)
+	if c.ids[msg.ID] {
+		return false, nil
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	line = append(line, '\n')
+	if c.partial {
+		// 上次写入被中断，先结束那一行
+		line = append([]byte{'\n'}, line...)
+	}
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(filepath.Join(h.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(line)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	c.partial = false
+	c.append(msg)
+	return true, nil
+}
+
+// latest returns at most limit of the latest messages of a log, oldest
+// first. A limit of 0 or less returns all messages kept in memory.
+func (h *history) latest(name string, limit int) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages := h.load(name).messages
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return append([]Message(nil), messages...)
+}
+
+// since returns the first maxSync messages of a log after the one with ID
+// since, or from the oldest kept when it is not kept, and whether more
+// messages follow them.
+func (h *history) since(name string, since string) ([]Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages := h.load(name).messages
+	for i := len(messages) - 1; i >= 0 && since != ""; i-- {
+		if messages[i].ID == since {
+			messages = messages[i+1:]
+			break
+		}
+	}
+	more := len(messages) > maxSync
+	if more {
+		messages = messages[:maxSync]
+	}
+	return append([]Message(nil), messages...), more
+}
+
+// lastID returns the ID of the latest message of a log, or "".
+func (h *history) lastID(name string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages := h.load(name).messages
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[len(messages)-1].ID
+}
+
+// load returns a conversation, reading its log on first use. Lines that do
+// not parse, such as one cut short by a crash, are skipped. The caller must
+// hold h.mu.
+func (h *history) load(name string) *conversation {
+	if c, ok := h.conversations[name]; ok {
+		return c
+	}
+	c := &conversation{ids: make(map[string]bool)}
+	h.conversations[name] = c
+
+	file, err := os.Open(filepath.Join(h.dir, name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading chat history %s: %v", name, err)
+		}
+		return c
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 8*maxTextLength)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.ID == "" || c.ids[msg.ID] {
+			continue
+		}
+		c.append(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading chat history %s: %v", name, err)
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			c.partial = true
+		}
+	}
+	return c
+}
+
+// append adds a message, forgetting the oldest beyond maxHistory.
+func (c *conversation) append(msg Message) {
+	c.messages = append(c.messages, msg)
+	c.ids[msg.ID] = true
+	if len(c.messages) > maxHistory {
+		delete(c.ids, c.messages[0].ID)
+		c.messages = c.messages[1:]
+	}
+}
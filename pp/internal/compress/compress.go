@@ -0,0 +1,115 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Deflate is the name of the DEFLATE codec, the only one supported.
+const Deflate = "deflate"
+
+// Supported lists the codecs this node can decode, in order of preference.
+// It is offered to peers in the hello message.
+var Supported = []string{Deflate}
+
+const (
+	// frameDeflate marks a frame holding a DEFLATE compressed message. Plain
+	// frames hold the JSON of a message, which starts with '{'.
+	frameDeflate byte = 0x01
+
+	// minSize is the smallest payload worth compressing.
+	minSize = 512
+	// sampleSize is how much of a payload is compressed to estimate its ratio.
+	sampleSize = 64 * 1024
+	// maxRatio is the largest compressed to original size ratio for which
+	// compression is kept.
+	maxRatio = 0.9
+	// MaxFrameSize bounds the size a compressed frame may inflate to.
+	MaxFrameSize = 64 * 1024 * 1024
+)
+
+var ErrTooLarge = errors.New("inflated data too large")
+
+// Negotiate picks the first codec of Supported the peer also offered, or ""
+// when there is none.
+func Negotiate(offered []string) string {
+	for _, codec := range Supported {
+		for _, o := range offered {
+			if o == codec {
+				return codec
+			}
+		}
+	}
+	return ""
+}
+
+// Worthwhile reports whether data compresses well enough to send it
+// compressed. Only a sample of large payloads is compressed, so already
+// compressed or encrypted data is skipped cheaply.
+func Worthwhile(data []byte) bool {
+	if len(data) < minSize {
+		return false
+	}
+	sample := data[:min(len(data), sampleSize)]
+	compressed, err := Compress(sample)
+	if err != nil {
+		return false
+	}
+	return float64(len(compressed)) <= maxRatio*float64(len(sample))
+}
+
+// Compress compresses data with DEFLATE.
+func Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress inflates DEFLATE data, failing with ErrTooLarge when the
+// result would exceed limit bytes.
+func Decompress(data []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	// 限制解压后的大小，防止压缩炸弹
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+// EncodeFrame returns the frame to send for a serialized message: flagged
+// and compressed when that makes it smaller, the message itself otherwise.
+func EncodeFrame(msg []byte) []byte {
+	if !Worthwhile(msg) {
+		return msg
+	}
+	compressed, err := Compress(msg)
+	if err != nil || len(compressed)+1 >= len(msg) {
+		return msg
+	}
+	return append([]byte{frameDeflate}, compressed...)
+}
+
+// DecodeFrame returns the serialized message carried by a frame.
+func DecodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) == 0 || frame[0] != frameDeflate {
+		return frame, nil
+	}
+	return Decompress(frame[1:], MaxFrameSize)
+}
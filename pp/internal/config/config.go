@@ -11,7 +11,32 @@ type Config struct {
 	SeedNodes    []string `json:"seed_nodes"`
 	MaxPeers     int      `json:"max_peers"`
 	PingInterval int      `json:"ping_interval"`
-	DataDir      string   `json:"data_dir"` // Directory for storing file transfer data
+	DataDir      string   `json:"data_dir"` // Directory for storing file transfer data and the identity key
+
+	SharedDirs  []string `json:"shared_dirs"`  // Directories whose files peers may request
+	SharedFiles []string `json:"shared_files"` // IDs of stored files peers may request
+
+	UploadLimit       int64 `json:"upload_limit"`        // File upload bandwidth in bytes per second, 0 for unlimited
+	DownloadLimit     int64 `json:"download_limit"`      // File download bandwidth in bytes per second, 0 for unlimited
+	PeerUploadLimit   int64 `json:"peer_upload_limit"`   // Per-peer file upload bandwidth, 0 for unlimited
+	PeerDownloadLimit int64 `json:"peer_download_limit"` // Per-peer file download bandwidth, 0 for unlimited
+
+	StorageQuota int64    `json:"storage_quota"` // Bytes the blob store may use, 0 for unlimited
+	PinnedFiles  []string `json:"pinned_files"`  // IDs of stored files that are never evicted
+	GCInterval   int      `json:"gc_interval"`   // Seconds between garbage collections of the data directory
+
+	ChatRooms []string `json:"chat_rooms"` // Chat rooms to join at startup
+
+	MailboxTTL     int  `json:"mailbox_ttl"`     // Seconds messages for offline nodes are kept, 0 for the default
+	MailboxForward bool `json:"mailbox_forward"` // Hand undeliverable messages to peers and hold theirs
+
+	CatalogAnnounce bool `json:"catalog_announce"` // Announce newly shared files to peers
+	CatalogRescan   int  `json:"catalog_rescan"`   // Seconds between rescans of the shared files
+
+	RelayEnabled     bool     `json:"relay_enabled"`      // Forward traffic for peers that cannot accept inbound connections
+	RelayMaxCircuits int      `json:"relay_max_circuits"` // Maximum number of concurrent relay circuits
+	RelayBandwidth   int64    `json:"relay_bandwidth"`    // Relay bandwidth in bytes per second, 0 for unlimited
+	RelayNodes       []string `json:"relay_nodes"`        // Relays to reserve a slot on at startup
 }
 
 // LoadConfig loads the configuration from a JSON file.
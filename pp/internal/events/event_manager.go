@@ -1,32 +1,40 @@
 package events
 
 import (
-	"github.com/asaskevich/EventBus"
+	"sync"
 )
 
 // EventManager manages events.
+// Handlers run synchronously on the publishing goroutine and may publish
+// further events themselves.
 type EventManager struct {
-	bus EventBus.Bus
+	mu       sync.RWMutex
+	handlers map[EventType][]func(Event)
 }
 
 // NewEventManager creates a new EventManager instance.
 func NewEventManager() *EventManager {
 	return &EventManager{
-		bus: EventBus.New(),
+		handlers: make(map[EventType][]func(Event)),
 	}
 }
 
 // Subscribe subscribes a handler to an event type.
 func (em *EventManager) Subscribe(eventType EventType, handler func(Event)) {
-	em.bus.Subscribe(string(eventType), handler)
-}
+	em.mu.Lock()
+	defer em.mu.Unlock()
 
-// Unsubscribe unsubscribes a handler from an event type.
-func (em *EventManager) Unsubscribe(eventType EventType, handler func(Event)) {
-	em.bus.Unsubscribe(string(eventType), handler)
+	em.handlers[eventType] = append(em.handlers[eventType], handler)
 }
 
 // Publish publishes an event.
 func (em *EventManager) Publish(event Event) {
-	em.bus.Publish(string(event.Type()), event)
+	// 不持锁调用处理函数，处理函数中可以再次发布事件
+	em.mu.RLock()
+	handlers := em.handlers[event.Type()]
+	em.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
 }
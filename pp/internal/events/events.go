@@ -27,6 +27,27 @@ func (e SendMessageEvent) Data() interface{} {
 	return e.EventData
 }
 
+// SendFrameEventData is the data for SendFrameEvent.
+type SendFrameEventData struct {
+	DestinationAddr string
+	Frame           []byte
+	Release         func() // called once Frame is no longer needed
+}
+
+// SendFrameEvent is an event that is triggered when an already encoded
+// frame, such as a binary file chunk, needs to be sent.
+type SendFrameEvent struct {
+	EventData SendFrameEventData
+}
+
+func (e SendFrameEvent) Type() EventType {
+	return "send_frame"
+}
+
+func (e SendFrameEvent) Data() interface{} {
+	return e.EventData
+}
+
 // FileRequestEventData is the data for FileRequestEvent.
 type FileRequestEventData struct {
 	Filename        string
@@ -45,3 +66,142 @@ func (e FileRequestEvent) Type() EventType {
 func (e FileRequestEvent) Data() interface{} {
 	return e.EventData
 }
+
+// PeerIdentifiedEventData is the data for PeerIdentifiedEvent.
+type PeerIdentifiedEventData struct {
+	Addr   string // address of the connection
+	NodeID string // node ID the peer proved to hold
+}
+
+// PeerIdentifiedEvent is an event that is triggered when a peer has proven
+// its node ID in the hello exchange.
+type PeerIdentifiedEvent struct {
+	EventData PeerIdentifiedEventData
+}
+
+func (e PeerIdentifiedEvent) Type() EventType {
+	return "peer_identified"
+}
+
+func (e PeerIdentifiedEvent) Data() interface{} {
+	return e.EventData
+}
+
+// RelayedMessageEventData is the data for RelayedMessageEvent.
+type RelayedMessageEventData struct {
+	SourceAddr string // circuit address the message arrived on
+	Payload    []byte // serialized message
+}
+
+// RelayedMessageEvent is an event that is triggered when a message arrives through a relay circuit.
+type RelayedMessageEvent struct {
+	EventData RelayedMessageEventData
+}
+
+func (e RelayedMessageEvent) Type() EventType {
+	return "relayed_message"
+}
+
+func (e RelayedMessageEvent) Data() interface{} {
+	return e.EventData
+}
+
+// RoutedMessageEventData is the data for RoutedMessageEvent.
+type RoutedMessageEventData struct {
+	SourceID string // node ID of the original sender
+	Payload  []byte // serialized message
+}
+
+// RoutedMessageEvent is an event that is triggered when a message routed by node ID reaches this node.
+type RoutedMessageEvent struct {
+	EventData RoutedMessageEventData
+}
+
+func (e RoutedMessageEvent) Type() EventType {
+	return "routed_message"
+}
+
+func (e RoutedMessageEvent) Data() interface{} {
+	return e.EventData
+}
+
+// TransferProgressEventData is the data for TransferProgressEvent.
+type TransferProgressEventData struct {
+	Transfer interface{} // filetransfer.Transfer
+}
+
+// TransferProgressEvent is an event that is triggered when a file transfer
+// changes state or makes progress.
+type TransferProgressEvent struct {
+	EventData TransferProgressEventData
+}
+
+func (e TransferProgressEvent) Type() EventType {
+	return "transfer_progress"
+}
+
+func (e TransferProgressEvent) Data() interface{} {
+	return e.EventData
+}
+
+// FileCompletedEventData is the data for FileCompletedEvent.
+type FileCompletedEventData struct {
+	FileID   string
+	Filename string
+	Size     int64
+	Path     string // where the file is stored
+}
+
+// FileCompletedEvent is an event that is triggered when a received file has
+// been verified and stored.
+type FileCompletedEvent struct {
+	EventData FileCompletedEventData
+}
+
+func (e FileCompletedEvent) Type() EventType {
+	return "file_completed"
+}
+
+func (e FileCompletedEvent) Data() interface{} {
+	return e.EventData
+}
+
+// ChatMessageEventData is the data for ChatMessageEvent.
+type ChatMessageEventData struct {
+	Message interface{} // chat.Message
+}
+
+// ChatMessageEvent is an event that is triggered when a chat message for
+// this node or one of its rooms is received.
+type ChatMessageEvent struct {
+	EventData ChatMessageEventData
+}
+
+func (e ChatMessageEvent) Type() EventType {
+	return "chat_message"
+}
+
+func (e ChatMessageEvent) Data() interface{} {
+	return e.EventData
+}
+
+// MailStatusEventData is the data for MailStatusEvent.
+type MailStatusEventData struct {
+	MailID string
+	To     string // node ID of the recipient
+	Status string // "delivered" or "expired"
+}
+
+// MailStatusEvent is an event that is triggered when mail sent by this node
+// has been delivered or has expired undelivered.
+type MailStatusEvent struct {
+	EventData MailStatusEventData
+}
+
+func (e MailStatusEvent) Type() EventType {
+	return "mail_status"
+}
+
+func (e MailStatusEvent) Data() interface{} {
+	return e.EventData
+}
@@ -0,0 +1,235 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore holds complete files and their metadata. Keys are file IDs,
+// optionally followed by an extension such as metadataExt, so they are safe
+// to use as file and object names. Missing blobs are reported with errors
+// wrapping fs.ErrNotExist.
+//
+// LocalStore keeps blobs in the data directory and MemoryStore in memory.
+// The methods map directly onto an S3-compatible object store: PutObject,
+// GetObject with a Range header, HeadObject, DeleteObject and ListObjectsV2.
+type BlobStore interface {
+	// Put stores the data read from r under key, replacing any previous
+	// blob. Readers never see a partly written blob.
+	Put(key string, r io.Reader) error
+	// Get reads length bytes of a blob starting at offset, or all of the
+	// rest when length is negative. Offsets past the end read nothing;
+	// negative offsets are rejected with ErrInvalidOffset.
+	Get(key string, offset int64, length int64) (io.ReadCloser, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	// List returns all blobs in the store.
+	List() ([]BlobInfo, error)
+}
+
+// BlobInfo describes a blob of a BlobStore.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time // when the blob was stored or last used
+}
+
+var (
+	ErrInvalidKey    = errors.New("invalid blob key")
+	ErrInvalidOffset = errors.New("invalid blob offset")
+)
+
+// Stores that can do better than the BlobStore methods implement these.
+type (
+	// blobMover takes over a local file without copying it.
+	blobMover interface {
+		moveIn(key string, path string) error
+	}
+	// blobOpener opens a blob for random access.
+	blobOpener interface {
+		open(key string) (*os.File, error)
+	}
+	// blobToucher records that a blob was used, for LRU eviction.
+	blobToucher interface {
+		touch(key string)
+	}
+)
+
+// checkKey returns ErrInvalidKey for keys that do not start with a file ID
+// or contain path separators.
+func checkKey(key string) error {
+	if len(key) < 64 || !ValidFileID(key[:64]) || strings.ContainsAny(key, "/\\\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// LocalStore is a BlobStore in a local directory, sharded by the first two
+// characters of the key.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore creates a LocalStore in dir.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+// path returns where the blob key is stored.
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+// Put writes the blob through a flushed temporary file that is renamed into
+// place.
+func (s *LocalStore) Put(key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), key+".*"+tmpExt)
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (s *LocalStore) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidOffset, offset)
+	}
+	file, err := s.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (s *LocalStore) Stat(key string) (BlobInfo, error) {
+	if err := checkKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return os.Remove(s.path(key))
+}
+
+func (s *LocalStore) List() ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || checkKey(d.Name()) != nil || filepath.Ext(d.Name()) == tmpExt {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		blobs = append(blobs, BlobInfo{Key: d.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
+
+// moveIn renames a flushed local file into the store.
+func (s *LocalStore) moveIn(key string, path string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	blobPath := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	if err := syncFile(path); err != nil {
+		return err
+	}
+	if err := os.Rename(path, blobPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(blobPath))
+}
+
+func (s *LocalStore) open(key string) (*os.File, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(key))
+}
+
+func (s *LocalStore) touch(key string) {
+	if checkKey(key) == nil {
+		now := time.Now()
+		os.Chtimes(s.path(key), now, now)
+	}
+}
+
+// removeStale removes the temporary files of writes interrupted at least
+// maxAge ago, returning how many files and bytes were removed.
+func (s *LocalStore) removeStale(maxAge time.Duration) (int, int64) {
+	removed, freed := 0, int64(0)
+	filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != tmpExt {
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil && time.Since(info.ModTime()) >= maxAge && os.Remove(path) == nil {
+			removed++
+			freed += info.Size()
+		}
+		return nil
+	})
+	return removed, freed
+}
@@ -0,0 +1,220 @@
+package filetransfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// blobKey returns a valid key for the test blob named by c.
+func blobKey(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+// TestBlobStores runs the BlobStore conformance tests against every
+// implementation.
+func TestBlobStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) BlobStore{
+		"LocalStore":  func(t *testing.T) BlobStore { return NewLocalStore(t.TempDir()) },
+		"MemoryStore": func(t *testing.T) BlobStore { return NewMemoryStore() },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("PutGet", func(t *testing.T) { testPutGet(t, newStore(t)) })
+			t.Run("Range", func(t *testing.T) { testRange(t, newStore(t)) })
+			t.Run("Replace", func(t *testing.T) { testReplace(t, newStore(t)) })
+			t.Run("Missing", func(t *testing.T) { testMissing(t, newStore(t)) })
+			t.Run("InvalidKey", func(t *testing.T) { testInvalidKey(t, newStore(t)) })
+			t.Run("StatListDelete", func(t *testing.T) { testStatListDelete(t, newStore(t)) })
+		})
+	}
+}
+
+// put stores data under key or fails the test.
+func put(t *testing.T, store BlobStore, key string, data string) {
+	t.Helper()
+	if err := store.Put(key, strings.NewReader(data)); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+// get reads a range of a blob or fails the test.
+func get(t *testing.T, store BlobStore, key string, offset int64, length int64) string {
+	t.Helper()
+	body, err := store.Get(key, offset, length)
+	if err != nil {
+		t.Fatalf("Get(%s, %d, %d): %v", key, offset, length, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return string(data)
+}
+
+func testPutGet(t *testing.T, store BlobStore) {
+	key := blobKey('a')
+	put(t, store, key, "hello blob")
+	if got := get(t, store, key, 0, -1); got != "hello blob" {
+		t.Fatalf("Get = %q, want %q", got, "hello blob")
+	}
+
+	// 带扩展名的键与文件 ID 互不影响
+	put(t, store, key+metadataExt, "{}")
+	if got := get(t, store, key+metadataExt, 0, -1); got != "{}" {
+		t.Fatalf("Get metadata = %q, want %q", got, "{}")
+	}
+	if got := get(t, store, key, 0, -1); got != "hello blob" {
+		t.Fatalf("Get after storing metadata = %q, want %q", got, "hello blob")
+	}
+
+	large := bytes.Repeat([]byte("0123456789"), 100000)
+	if err := store.Put(blobKey('b'), bytes.NewReader(large)); err != nil {
+		t.Fatalf("Put large: %v", err)
+	}
+	if got := get(t, store, blobKey('b'), 0, -1); got != string(large) {
+		t.Fatalf("Get large returned %d bytes, want %d", len(got), len(large))
+	}
+}
+
+func testRange(t *testing.T, store BlobStore) {
+	key := blobKey('c')
+	put(t, store, key, "0123456789")
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{0, 0, ""},
+		{0, 4, "0123"},
+		{3, 4, "3456"},
+		{3, -1, "3456789"},
+		{8, 10, "89"},
+		{10, -1, ""},
+		{20, 5, ""},
+	}
+	for _, tt := range tests {
+		if got := get(t, store, key, tt.offset, tt.length); got != tt.want {
+			t.Errorf("Get(%d, %d) = %q, want %q", tt.offset, tt.length, got, tt.want)
+		}
+	}
+
+	for _, offset := range []int64{-1, -100} {
+		if body, err := store.Get(key, offset, 4); !errors.Is(err, ErrInvalidOffset) {
+			if body != nil {
+				body.Close()
+			}
+			t.Errorf("Get(%d, 4) = %v, want %v", offset, err, ErrInvalidOffset)
+		}
+	}
+}
+
+func testReplace(t *testing.T, store BlobStore) {
+	key := blobKey('d')
+	put(t, store, key, "first version")
+	put(t, store, key, "second")
+	if got := get(t, store, key, 0, -1); got != "second" {
+		t.Fatalf("Get = %q, want %q", got, "second")
+	}
+	info, err := store.Stat(key)
+	if err != nil || info.Size != int64(len("second")) {
+		t.Fatalf("Stat = %+v, %v; want size %d", info, err, len("second"))
+	}
+}
+
+func testMissing(t *testing.T, store BlobStore) {
+	key := blobKey('e')
+	if _, err := store.Get(key, 0, -1); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get = %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := store.Stat(key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat = %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := store.Delete(key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete = %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func testInvalidKey(t *testing.T, store BlobStore) {
+	keys := []string{
+		"",
+		"short",
+		strings.Repeat("A", 64),
+		strings.Repeat("g", 64),
+		blobKey('a') + "/x",
+		"../" + blobKey('a'),
+		blobKey('a') + "\\x",
+		blobKey('a') + "\x00",
+	}
+	for _, key := range keys {
+		if err := store.Put(key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := store.Get(key, 0, -1); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q) = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := store.Stat(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Stat(%q) = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if err := store.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}
+
+func testStatListDelete(t *testing.T, store BlobStore) {
+	blobs, err := store.List()
+	if err != nil || len(blobs) != 0 {
+		t.Fatalf("List of empty store = %v, %v", blobs, err)
+	}
+
+	want := map[string]string{
+		blobKey('1'):               "one",
+		blobKey('2'):               "two!",
+		blobKey('2') + metadataExt: "{}",
+	}
+	for key, data := range want {
+		put(t, store, key, data)
+	}
+	for key, data := range want {
+		info, err := store.Stat(key)
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", key, err)
+		}
+		if info.Key != key || info.Size != int64(len(data)) || info.ModTime.IsZero() {
+			t.Errorf("Stat(%s) = %+v, want size %d", key, info, len(data))
+		}
+	}
+
+	blobs, err = store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(blobs) != len(want) {
+		t.Fatalf("List returned %d blobs, want %d: %v", len(blobs), len(want), blobs)
+	}
+	for _, blob := range blobs {
+		data, ok := want[blob.Key]
+		if !ok || blob.Size != int64(len(data)) {
+			t.Errorf("List returned %+v", blob)
+		}
+	}
+
+	if err := store.Delete(blobKey('2')); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(blobKey('2')); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Delete = %v, want %v", err, fs.ErrNotExist)
+	}
+	if got := get(t, store, blobKey('2')+metadataExt, 0, -1); got != "{}" {
+		t.Errorf("Delete removed %s too", blobKey('2')+metadataExt)
+	}
+	if blobs, err := store.List(); err != nil || len(blobs) != len(want)-1 {
+		t.Errorf("List after Delete = %v, %v", blobs, err)
+	}
+}
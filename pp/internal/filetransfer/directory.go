@@ -0,0 +1,568 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A directory is transferred as a manifest, a JSON file listing the tree,
+// which is stored and sent like any other file with Metadata.Manifest set.
+// Once the receiver has the manifest it fetches the files it does not
+// already have one at a time from the sender, tracking them all as one
+// download under the ID of the manifest. When the last file has arrived the
+// tree is assembled from the blob store under <data_dir>/files.
+//
+// The directory download is recorded in <data_dir>/incoming/<id>.directory
+// so it can be resumed after a restart.
+const (
+	filesDir           = "files"
+	directoryStateExt  = ".directory"
+	manifestExt        = ".manifest"
+	maxManifestEntries = 100000
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Manifest describes a directory tree.
+type Manifest struct {
+	Name    string          `json:"name"` // name of the directory itself
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a file or directory of a Manifest.
+type ManifestEntry struct {
+	Path   string `json:"path"` // slash separated, relative to the directory
+	Dir    bool   `json:"dir,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Mode   uint32 `json:"mode"`              // permission bits
+	FileID string `json:"file_id,omitempty"` // content address of a file
+}
+
+// directory is a directory being received.
+type directory struct {
+	manifestID string
+	manifest   Manifest
+	addr       string // peer the files are fetched from
+	current    string // file being fetched, "" when none
+}
+
+// directoryState is what is persisted about a directory being received.
+type directoryState struct {
+	ManifestID string   `json:"manifest_id"`
+	Sources    []Source `json:"sources"`
+}
+
+// SendDirectory offers the directory at dirPath to the peer at addr and
+// returns the ID of its manifest. The peer fetches the files afterwards;
+// each stays available until the peer has it or for offerTTL. Symlinks and
+// other special files are left out.
+func (m *Manager) SendDirectory(addr string, dirPath string) (string, error) {
+	manifest, err := m.offerDirectory(addr, dirPath)
+	if err != nil {
+		return "", err
+	}
+	manifestID, err := m.storeManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Offering directory %s to %s, %d entries", manifest.Name, addr, len(manifest.Entries))
+	return manifestID, m.SendStoredFile(addr, manifestID)
+}
+
+// offerDirectory builds the manifest of a directory and offers its files
+// to the peer at addr.
+func (m *Manager) offerDirectory(addr string, dirPath string) (Manifest, error) {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if !info.IsDir() {
+		return Manifest{}, fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	manifest := Manifest{Name: filepath.Base(dirPath), Entries: []ManifestEntry{}}
+	offered := make(map[string]outgoingFile)
+	err = filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == dirPath {
+			return nil
+		}
+		// 不跟随符号链接，也不发送设备等特殊文件
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{
+			Path: filepath.ToSlash(rel),
+			Dir:  d.IsDir(),
+			Mode: uint32(info.Mode().Perm()),
+		}
+		if !d.IsDir() {
+			sum, chunkHashes, err := hashFile(filePath, DefaultChunkSize)
+			if err != nil {
+				return err
+			}
+			fileID := contentID(info.Size(), sum, chunkHashes)
+			entry.Size = info.Size()
+			entry.FileID = fileID
+			offered[fileID] = outgoingFile{
+				path: filePath,
+				metadata: Metadata{
+					FileID:      fileID,
+					Filename:    d.Name(),
+					FileSize:    info.Size(),
+					ChunkSize:   DefaultChunkSize,
+					SHA256:      sum,
+					ChunkHashes: chunkHashes,
+				},
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := validateManifest(manifest); err != nil {
+		return Manifest{}, err
+	}
+
+	files := make([]outgoingFile, 0, len(offered))
+	for _, out := range offered {
+		files = append(files, out)
+	}
+	m.offer(addr, time.Now().Add(offerTTL), files...)
+	return manifest, nil
+}
+
+// storeManifest stores a manifest in the blob store and returns its ID.
+func (m *Manager) storeManifest(manifest Manifest) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	manifestID, err := m.SaveFile(manifest.Name+manifestExt, strings.NewReader(string(data)))
+	if err != nil {
+		return "", err
+	}
+	metadata, err := m.GetMetadata(manifestID)
+	if err != nil {
+		return "", err
+	}
+	if !metadata.Manifest {
+		metadata.Manifest = true
+		if err := m.StoreMetadata(metadata); err != nil {
+			return "", err
+		}
+	}
+	return manifestID, nil
+}
+
+// loadManifest reads and validates a manifest of the blob store.
+func (m *Manager) loadManifest(manifestID string) (Manifest, error) {
+	file, err := m.OpenFile(manifestID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer file.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		return Manifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if err := validateManifest(manifest); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// validateManifest checks that a manifest only describes paths inside its
+// directory, each once, so it can be assembled safely.
+func validateManifest(manifest Manifest) error {
+	if !validPathElement(manifest.Name) {
+		return fmt.Errorf("%w: bad name %q", ErrInvalidManifest, manifest.Name)
+	}
+	if len(manifest.Entries) > maxManifestEntries {
+		return fmt.Errorf("%w: %d entries", ErrInvalidManifest, len(manifest.Entries))
+	}
+	kinds := make(map[string]bool) // path -> is a directory
+	for _, entry := range manifest.Entries {
+		if entry.Path == "" || path.Clean(entry.Path) != entry.Path || path.IsAbs(entry.Path) {
+			return fmt.Errorf("%w: bad path %q", ErrInvalidManifest, entry.Path)
+		}
+		for _, part := range strings.Split(entry.Path, "/") {
+			if !validPathElement(part) {
+				return fmt.Errorf("%w: bad path %q", ErrInvalidManifest, entry.Path)
+			}
+		}
+		if _, ok := kinds[entry.Path]; ok {
+			return fmt.Errorf("%w: duplicate path %q", ErrInvalidManifest, entry.Path)
+		}
+		kinds[entry.Path] = entry.Dir
+		if !entry.Dir && (!ValidFileID(entry.FileID) || entry.Size < 0) {
+			return fmt.Errorf("%w: bad file %q", ErrInvalidManifest, entry.Path)
+		}
+	}
+	// 文件不能同时作为其他条目的父目录
+	for p := range kinds {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if isDir, ok := kinds[dir]; ok && !isDir {
+				return fmt.Errorf("%w: %q is inside file %q", ErrInvalidManifest, p, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// validPathElement reports whether name can be used as one element of a
+// path on any operating system without escaping its parent.
+func validPathElement(name string) bool {
+	if name == "" || name == "." || name == ".." || filepath.VolumeName(name) != "" {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00")
+}
+
+// startDirectory begins fetching the files of a received manifest from the
+// peer at addr.
+func (m *Manager) startDirectory(manifestID string, addr string, sources []Source) {
+	manifest, err := m.loadManifest(manifestID)
+	if err != nil {
+		log.Printf("Ignoring manifest %s: %v", manifestID, err)
+		return
+	}
+	state := directoryState{ManifestID: manifestID, Sources: sources}
+	if err := writeJSONFile(m.directoryStatePath(manifestID), state); err != nil {
+		log.Printf("Error saving directory state for %s: %v", manifestID, err)
+	}
+	m.trackDirectory(manifestID, manifest, addr, Active)
+	m.nextDirectoryFile(manifestID)
+}
+
+// trackDirectory registers a directory being received and starts its
+// transfer, counting the files already held as done.
+func (m *Manager) trackDirectory(manifestID string, manifest Manifest, addr string, state State) {
+	var size, done int64
+	for _, entry := range manifest.Entries {
+		size += entry.Size
+		if !entry.Dir && m.HasFile(entry.FileID) {
+			done += entry.Size
+		}
+	}
+
+	m.mu.Lock()
+	m.directories[manifestID] = &directory{manifestID: manifestID, manifest: manifest, addr: addr}
+	m.mu.Unlock()
+
+	metadata := Metadata{FileID: manifestID, Filename: manifest.Name}
+	m.startTransfer(Download, metadata, addr, size, done, state)
+}
+
+// ResumeDirectory continues a directory download reloaded by
+// ResumeTransfers, fetching the remaining files from the peer at addr.
+func (m *Manager) ResumeDirectory(manifestID string, addr string) error {
+	m.mu.Lock()
+	dir, ok := m.directories[manifestID]
+	if ok {
+		dir.addr = addr
+	}
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no directory download %s", manifestID)
+	}
+	m.nextDirectoryFile(manifestID)
+	return nil
+}
+
+// nextDirectoryFile fetches the next missing file of a directory, or
+// assembles the directory when none is missing. Nothing is fetched while
+// the directory download is paused.
+func (m *Manager) nextDirectoryFile(manifestID string) {
+	dirID := transferID(Download, manifestID, "")
+	if m.transferPaused(dirID) {
+		return
+	}
+
+	m.mu.Lock()
+	dir, ok := m.directories[manifestID]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	if dir.current != "" {
+		// 上一个文件仍在接收中（例如重启后续传）
+		_, receiving := m.incoming[dir.current]
+		_, swarming := m.swarms[dir.current]
+		if receiving || swarming {
+			m.mu.Unlock()
+			return
+		}
+	}
+	next := ""
+	for _, entry := range dir.manifest.Entries {
+		if !entry.Dir && !m.HasFile(entry.FileID) {
+			next = entry.FileID
+			break
+		}
+	}
+	dir.current = next
+	addr := dir.addr
+	m.mu.Unlock()
+
+	if next == "" {
+		go m.assembleDirectory(manifestID)
+		return
+	}
+	// 重启后要等 ResumeDirectory 告知从哪个节点获取
+	if addr == "" {
+		return
+	}
+	if err := m.Download(next, []string{addr}, Sequential); err != nil {
+		m.failDirectory(manifestID, err)
+	}
+}
+
+// directoryFileDone moves the directories waiting for a file on once its
+// download has ended.
+func (m *Manager) directoryFileDone(fileID string, err error) {
+	m.mu.Lock()
+	waiting := []string{}
+	for manifestID, dir := range m.directories {
+		if dir.current == fileID {
+			waiting = append(waiting, manifestID)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, manifestID := range waiting {
+		if err != nil {
+			m.failDirectory(manifestID, err)
+			continue
+		}
+		m.nextDirectoryFile(manifestID)
+	}
+}
+
+// addDirectoryProgress counts n bytes of a file toward the directories
+// fetching it.
+func (m *Manager) addDirectoryProgress(fileID string, addr string, n int) {
+	m.mu.Lock()
+	ids := []string{}
+	for manifestID, dir := range m.directories {
+		if dir.current == fileID {
+			ids = append(ids, transferID(Download, manifestID, ""))
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.addProgress(id, addr, n)
+	}
+}
+
+// directoryFile returns the file a directory download is fetching.
+func (m *Manager) directoryFile(manifestID string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, ok := m.directories[manifestID]
+	if !ok {
+		return "", false
+	}
+	return dir.current, true
+}
+
+// failDirectory ends a directory download with an error. A cancelled
+// download is forgotten; any other is resumed after a restart.
+func (m *Manager) failDirectory(manifestID string, err error) {
+	m.mu.Lock()
+	_, ok := m.directories[manifestID]
+	delete(m.directories, manifestID)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	if errors.Is(err, ErrCancelled) {
+		os.Remove(m.directoryStatePath(manifestID))
+	}
+	log.Printf("Directory download %s failed: %v", manifestID, err)
+	m.finishTransfer(transferID(Download, manifestID, ""), err)
+}
+
+// assembleDirectory copies the files of a complete directory out of the
+// blob store into a new directory under <data_dir>/files. The tree is built
+// under the incoming directory first and moved into place at the end.
+func (m *Manager) assembleDirectory(manifestID string) {
+	m.mu.Lock()
+	dir, ok := m.directories[manifestID]
+	delete(m.directories, manifestID)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	dirID := transferID(Download, manifestID, "")
+
+	target, err := m.buildDirectory(dir.manifest, manifestID)
+	if err != nil {
+		log.Printf("Error assembling directory %s: %v", manifestID, err)
+		m.finishTransfer(dirID, err)
+		return
+	}
+	os.Remove(m.directoryStatePath(manifestID))
+	m.finishTransfer(dirID, nil)
+	log.Printf("Received directory %s into %s", dir.manifest.Name, target)
+}
+
+// buildDirectory writes the tree of a manifest and returns where it was put.
+func (m *Manager) buildDirectory(manifest Manifest, manifestID string) (string, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Join(m.dataDir, incomingDir), "assemble-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, entry := range manifest.Entries {
+		dst := filepath.Join(tmpDir, filepath.FromSlash(entry.Path))
+		// 父目录先用默认权限创建，条目自身的权限最后设置
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		if entry.Dir {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := m.copyBlob(entry.FileID, dst); err != nil {
+			return "", fmt.Errorf("%s: %w", entry.Path, err)
+		}
+	}
+	// 权限位只保留 rwx，不复制 setuid 等特殊位；目录权限从深到浅设置
+	for i := len(manifest.Entries) - 1; i >= 0; i-- {
+		entry := manifest.Entries[i]
+		dst := filepath.Join(tmpDir, filepath.FromSlash(entry.Path))
+		if err := os.Chmod(dst, fs.FileMode(entry.Mode).Perm()|ownerAccess(entry.Dir)); err != nil {
+			return "", err
+		}
+	}
+
+	root := filepath.Join(m.dataDir, filesDir)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, manifest.Name)
+	if _, err := os.Lstat(target); err == nil {
+		target += "-" + manifestID[:8]
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// ownerAccess is the access the owner always keeps, so the tree can be
+// read and removed again.
+func ownerAccess(isDir bool) fs.FileMode {
+	if isDir {
+		return 0700
+	}
+	return 0600
+}
+
+// copyBlob copies a file of the blob store to dst. The blob is copied
+// rather than linked so changes to dst cannot corrupt the store.
+func (m *Manager) copyBlob(fileID string, dst string) error {
+	src, err := m.OpenFile(fileID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resumeDirectories reloads the directory downloads recorded in the data
+// directory.
+func (m *Manager) resumeDirectories() []Resumable {
+	entries, err := os.ReadDir(filepath.Join(m.dataDir, incomingDir))
+	if err != nil {
+		return nil
+	}
+
+	resumable := []Resumable{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), directoryStateExt) {
+			continue
+		}
+		manifestID := strings.TrimSuffix(entry.Name(), directoryStateExt)
+		if !ValidFileID(manifestID) {
+			continue
+		}
+		var state directoryState
+		data, err := os.ReadFile(m.directoryStatePath(manifestID))
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		var manifest Manifest
+		if err == nil {
+			manifest, err = m.loadManifest(manifestID)
+		}
+		if err != nil {
+			log.Printf("Skipping directory state %s: %v", entry.Name(), err)
+			os.Remove(m.directoryStatePath(manifestID))
+			continue
+		}
+
+		m.trackDirectory(manifestID, manifest, "", Queued)
+		m.mu.Lock()
+		dir := m.directories[manifestID]
+		// 正在续传的文件完成后再继续下一个
+		for _, e := range manifest.Entries {
+			if _, receiving := m.incoming[e.FileID]; !e.Dir && receiving {
+				dir.current = e.FileID
+				break
+			}
+		}
+		m.mu.Unlock()
+
+		resumable = append(resumable, Resumable{
+			FileID:    manifestID,
+			Sources:   state.Sources,
+			Directory: true,
+		})
+	}
+	return resumable
+}
+
+// directoryStatePath returns the path of the state file of a directory download.
+func (m *Manager) directoryStatePath(manifestID string) string {
+	return filepath.Join(m.dataDir, incomingDir, manifestID+directoryStateExt)
+}
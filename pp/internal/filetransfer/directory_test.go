@@ -0,0 +1,49 @@
+package filetransfer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateManifest(t *testing.T) {
+	file := func(path string) ManifestEntry {
+		return ManifestEntry{Path: path, Size: 1, FileID: blobKey('a')}
+	}
+	dir := func(path string) ManifestEntry {
+		return ManifestEntry{Path: path, Dir: true}
+	}
+	tests := []struct {
+		name     string
+		manifest Manifest
+		valid    bool
+	}{
+		{"files and directories", Manifest{Name: "docs", Entries: []ManifestEntry{dir("a"), file("a/b.txt"), dir("a/c"), file("a/c/d.txt"), file("e.txt")}}, true},
+		{"empty directory", Manifest{Name: "docs", Entries: []ManifestEntry{}}, true},
+
+		{"parent name", Manifest{Name: "..", Entries: []ManifestEntry{file("a.txt")}}, false},
+		{"name with separator", Manifest{Name: "a/b", Entries: []ManifestEntry{file("a.txt")}}, false},
+		{"parent path", Manifest{Name: "docs", Entries: []ManifestEntry{file("../a.txt")}}, false},
+		{"parent inside path", Manifest{Name: "docs", Entries: []ManifestEntry{dir("a"), file("a/../../b.txt")}}, false},
+		{"parent directory", Manifest{Name: "docs", Entries: []ManifestEntry{dir("..")}}, false},
+		{"backslash parent", Manifest{Name: "docs", Entries: []ManifestEntry{file(`..\a.txt`)}}, false},
+		{"absolute path", Manifest{Name: "docs", Entries: []ManifestEntry{file("/etc/passwd")}}, false},
+		{"unclean path", Manifest{Name: "docs", Entries: []ManifestEntry{file("a//b.txt")}}, false},
+		{"empty path", Manifest{Name: "docs", Entries: []ManifestEntry{file("")}}, false},
+		{"duplicate path", Manifest{Name: "docs", Entries: []ManifestEntry{file("a.txt"), dir("a.txt")}}, false},
+		{"file as parent", Manifest{Name: "docs", Entries: []ManifestEntry{file("a"), file("a/b.txt")}}, false},
+		{"file as grandparent", Manifest{Name: "docs", Entries: []ManifestEntry{file("a"), dir("a/b"), file("a/b/c.txt")}}, false},
+		{"bad file ID", Manifest{Name: "docs", Entries: []ManifestEntry{{Path: "a.txt", FileID: "../a"}}}, false},
+		{"negative size", Manifest{Name: "docs", Entries: []ManifestEntry{{Path: "a.txt", Size: -1, FileID: blobKey('a')}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateManifest(tt.manifest)
+			if tt.valid && err != nil {
+				t.Fatalf("validateManifest = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidManifest) {
+				t.Fatalf("validateManifest = %v, want %v", err, ErrInvalidManifest)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package filetransfer
+
+import (
+	"fmt"
+
+	"pp/internal/compress"
+)
+
+// SetCodecLookup sets the function that tells which compression codec was
+// negotiated with a peer. Chunks sent to peers without one go uncompressed.
+func (m *Manager) SetCodecLookup(lookup func(addr string) string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codecOf = lookup
+}
+
+// encodeChunkData compresses the data of a chunk for the peer at addr when
+// the peer supports it and the data compresses well. It returns the data to
+// send and its encoding.
+func (m *Manager) encodeChunkData(addr string, data []byte) ([]byte, string) {
+	m.mu.Lock()
+	codecOf := m.codecOf
+	m.mu.Unlock()
+
+	if codecOf(addr) != compress.Deflate || !compress.Worthwhile(data) {
+		return data, ""
+	}
+	compressed, err := compress.Compress(data)
+	if err != nil || len(compressed) >= len(data) {
+		return data, ""
+	}
+	return compressed, compress.Deflate
+}
+
+// DecodeChunk returns a received chunk with its data decompressed. The data
+// may not inflate beyond the length of the chunk.
+func (m *Manager) DecodeChunk(chunk Chunk) (Chunk, error) {
+	if chunk.Encoding == "" {
+		return chunk, nil
+	}
+	if chunk.Encoding != compress.Deflate {
+		return chunk, fmt.Errorf("unsupported encoding %q for chunk %d of file %s", chunk.Encoding, chunk.ChunkIndex, chunk.FileID)
+	}
+	m.mu.Lock()
+	in, ok := m.incoming[chunk.FileID]
+	m.mu.Unlock()
+	if !ok {
+		return chunk, fmt.Errorf("unexpected chunk for file %s", chunk.FileID)
+	}
+
+	if chunk.ChunkIndex < 0 || chunk.ChunkIndex >= in.metadata.ChunkCount() {
+		return chunk, fmt.Errorf("chunk index %d out of range for file %s", chunk.ChunkIndex, chunk.FileID)
+	}
+
+	data, err := compress.Decompress(chunk.ChunkData, int(in.metadata.ChunkLength(chunk.ChunkIndex)))
+	if err != nil {
+		return chunk, fmt.Errorf("failed to decompress chunk %d of file %s: %w", chunk.ChunkIndex, chunk.FileID, err)
+	}
+	chunk.ChunkData = data
+	chunk.Encoding = ""
+	return chunk, nil
+}
@@ -0,0 +1,100 @@
+package filetransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"pp/internal/compress"
+	"pp/internal/events"
+)
+
+// newTestManager returns a Manager with its data directory in a temporary
+// directory.
+func newTestManager(t testing.TB) *Manager {
+	t.Helper()
+	m := NewManager(t.TempDir(), nil, Limits{}, "127.0.0.1:9000", events.NewEventManager())
+	t.Cleanup(m.Close)
+	return m
+}
+
+// testMetadata returns the metadata of random content of size bytes, as a
+// sender computes it.
+func testMetadata(t testing.TB, size int) ([]byte, Metadata) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestManager(t)
+	fileID, err := sender.SaveFile("test.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	metadata, err := sender.GetMetadata(fileID)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	return data, metadata
+}
+
+func TestReceiveMetadataRejectsChunkSize(t *testing.T) {
+	_, metadata := testMetadata(t, 100)
+	for _, size := range []int{0, -1, DefaultChunkSize / 2, DefaultChunkSize + 1, 1 << 40} {
+		bad := metadata
+		bad.ChunkSize = size
+		if err := newTestManager(t).ReceiveMetadata("peer", bad, Source{}); err == nil {
+			t.Errorf("ReceiveMetadata accepted chunk size %d", size)
+		}
+	}
+	if err := newTestManager(t).ReceiveMetadata("peer", metadata, Source{}); err != nil {
+		t.Fatalf("ReceiveMetadata: %v", err)
+	}
+}
+
+func TestDecodeChunkLimitsInflation(t *testing.T) {
+	// 第二块只有 10 字节
+	_, metadata := testMetadata(t, DefaultChunkSize+10)
+	m := newTestManager(t)
+	if err := m.ReceiveMetadata("peer", metadata, Source{}); err != nil {
+		t.Fatalf("ReceiveMetadata: %v", err)
+	}
+
+	deflated := func(size int) []byte {
+		data, err := compress.Compress(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		index   int
+		size    int
+		wantErr error
+	}{
+		{"full chunk", 0, DefaultChunkSize, nil},
+		{"beyond chunk size", 0, DefaultChunkSize + 1, compress.ErrTooLarge},
+		{"last chunk", 1, 10, nil},
+		{"beyond last chunk", 1, 11, compress.ErrTooLarge},
+		{"bomb in last chunk", 1, DefaultChunkSize, compress.ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := Chunk{FileID: metadata.FileID, ChunkIndex: tt.index, ChunkData: deflated(tt.size), Encoding: compress.Deflate}
+			decoded, err := m.DecodeChunk(chunk)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeChunk = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(decoded.ChunkData) != tt.size {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded.ChunkData), tt.size)
+			}
+		})
+	}
+
+	chunk := Chunk{FileID: metadata.FileID, ChunkIndex: 2, ChunkData: deflated(1), Encoding: compress.Deflate}
+	if _, err := m.DecodeChunk(chunk); err == nil {
+		t.Fatal("DecodeChunk accepted a chunk index beyond the file")
+	}
+}
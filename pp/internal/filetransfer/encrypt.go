@@ -0,0 +1,410 @@
+package filetransfer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"pp/internal/identity"
+)
+
+// Encrypted files are stored and distributed as ordinary blobs of
+// ciphertext, so relays and nodes that only pass them on never see their
+// contents. Every encryptedBlockSize bytes of plaintext are sealed with
+// AES-256-GCM under a random per-file key, with the block index as nonce;
+// with its tag, each block fills exactly one DefaultChunkSize chunk.
+//
+// The key travels in file_key messages, sealed to the identity key of each
+// recipient and signed by the sender, and is kept sealed to this node's
+// identity key:
+//
+//	<data_dir>/keys/ab12...ef  key of the encrypted file ab12...ef
+const (
+	keysDir            = "keys"
+	gcmTagSize         = 16
+	encryptedBlockSize = DefaultChunkSize - gcmTagSize
+)
+
+var (
+	ErrNoIdentity   = errors.New("no identity key")
+	ErrNoKey        = errors.New("no key for file")
+	ErrKeySignature = errors.New("file key not signed by the sending peer")
+	ErrKeyExists    = errors.New("key for file already known")
+)
+
+// FileKey is what it takes to decrypt an encrypted file. It only leaves the
+// node sealed.
+type FileKey struct {
+	FileID   string `json:"file_id"` // ID of the encrypted file
+	Key      []byte `json:"key"`
+	Filename string `json:"filename"`
+	FileSize int64  `json:"file_size"`
+	SHA256   string `json:"sha256"` // ID of the decrypted file
+}
+
+// KeyEnvelope is the payload of a file_key message, a FileKey sealed to the
+// identity key of the recipient and signed by the sender.
+type KeyEnvelope struct {
+	FileID    string `json:"file_id"`
+	Sealed    []byte `json:"sealed"`
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns what the sender of a key envelope signs.
+func (e KeyEnvelope) signedData() []byte {
+	data := append([]byte("pp file key\x00"), e.FileID...)
+	return append(append(data, 0), e.Sealed...)
+}
+
+// SetIdentity sets the identity key that file keys are sealed to.
+func (m *Manager) SetIdentity(id *identity.Identity) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identity = id
+}
+
+// EncryptFile encrypts a file under a new key into the blob store and
+// returns the ID of the encrypted file. Send it like any other file; only
+// peers given the key with SealKey can decrypt it.
+func (m *Manager) EncryptFile(filePath string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	aead, err := fileCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Join(m.dataDir, incomingDir), "encrypt-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := dst.Name()
+
+	plain := sha256.New()
+	var size int64
+	buf := make([]byte, encryptedBlockSize)
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			plain.Write(buf[:n])
+			size += int64(n)
+			if _, err := dst.Write(aead.Seal(nil, blockNonce(index), buf[:n], nil)); err != nil {
+				dst.Close()
+				os.Remove(tmpPath)
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	sum, chunkHashes, err := hashFile(tmpPath, DefaultChunkSize)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	encryptedSize := getFileSize(tmpPath)
+	fileID := contentID(encryptedSize, sum, chunkHashes)
+	fileKey := FileKey{
+		FileID:   fileID,
+		Key:      key,
+		Filename: filepath.Base(filePath),
+		FileSize: size,
+		SHA256:   hex.EncodeToString(plain.Sum(nil)),
+	}
+	if err := m.storeKey(fileKey); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := m.storeBlob(tmpPath, fileID); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	// 密文的元数据不暴露原文件名
+	metadata := Metadata{
+		FileID:      fileID,
+		Filename:    fileID[:16] + ".enc",
+		FileSize:    encryptedSize,
+		ChunkSize:   DefaultChunkSize,
+		SHA256:      sum,
+		ChunkHashes: chunkHashes,
+		Encrypted:   true,
+	}
+	if err := m.StoreMetadata(metadata); err != nil {
+		return "", err
+	}
+	return fileID, nil
+}
+
+// SealKey seals the key of an encrypted file to the identity key of a
+// recipient and signs it.
+func (m *Manager) SealKey(fileID string, publicKey []byte) (KeyEnvelope, error) {
+	m.mu.Lock()
+	id := m.identity
+	m.mu.Unlock()
+	if id == nil {
+		return KeyEnvelope{}, ErrNoIdentity
+	}
+	fileKey, err := m.loadKey(fileID)
+	if err != nil {
+		return KeyEnvelope{}, err
+	}
+	data, err := json.Marshal(fileKey)
+	if err != nil {
+		return KeyEnvelope{}, err
+	}
+	sealed, err := identity.Seal(publicKey, data)
+	if err != nil {
+		return KeyEnvelope{}, err
+	}
+	envelope := KeyEnvelope{FileID: fileID, Sealed: sealed}
+	envelope.Signature = id.Sign(envelope.signedData())
+	return envelope, nil
+}
+
+// ReceiveKey stores the key of an encrypted file sent by a peer whose
+// signatures are checked with signingKey. Keys that peer did not sign, and
+// keys of files whose key is already known, are rejected. The file is
+// decrypted right away if it has already been received, or as soon as it
+// is.
+func (m *Manager) ReceiveKey(envelope KeyEnvelope, signingKey []byte) error {
+	if err := checkFileID(envelope.FileID); err != nil {
+		return err
+	}
+	if !identity.Verify(signingKey, envelope.signedData(), envelope.Signature) {
+		return ErrKeySignature
+	}
+	if m.hasKey(envelope.FileID) {
+		return fmt.Errorf("%w %s", ErrKeyExists, envelope.FileID)
+	}
+	fileKey, err := m.openKey(envelope.Sealed)
+	if err != nil {
+		return err
+	}
+	if fileKey.FileID != envelope.FileID {
+		return fmt.Errorf("key for %s sent as key for %s", fileKey.FileID, envelope.FileID)
+	}
+	// 信封已经用本节点的身份密钥加密，原样保存
+	keyPath := m.keyPath(envelope.FileID)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, envelope.Sealed, 0600); err != nil {
+		return err
+	}
+
+	if m.HasFile(envelope.FileID) {
+		go m.decryptReceived(envelope.FileID)
+	}
+	return nil
+}
+
+// DecryptFile decrypts an encrypted file of the blob store with its key and
+// stores the result, returning the ID of the decrypted file.
+func (m *Manager) DecryptFile(fileID string) (string, error) {
+	fileKey, err := m.loadKey(fileID)
+	if err != nil {
+		return "", err
+	}
+	aead, err := fileCipher(fileKey.Key)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := m.OpenFile(fileID)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Join(m.dataDir, incomingDir), "decrypt-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := dst.Name()
+
+	buf := make([]byte, DefaultChunkSize)
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			block, err := aead.Open(buf[:0], blockNonce(index), buf[:n], nil)
+			if err == nil {
+				_, err = dst.Write(block)
+			}
+			if err != nil {
+				dst.Close()
+				os.Remove(tmpPath)
+				return "", fmt.Errorf("failed to decrypt block %d of file %s: %w", index, fileID, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	sum, chunkHashes, err := hashFile(tmpPath, DefaultChunkSize)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if sum != fileKey.SHA256 {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("decrypted file %s: %w", fileID, ErrHashMismatch)
+	}
+	size := getFileSize(tmpPath)
+	decrypted := contentID(size, sum, chunkHashes)
+	if err := m.storeBlob(tmpPath, decrypted); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if _, err := m.GetMetadata(decrypted); err != nil {
+		metadata := Metadata{
+			FileID:      decrypted,
+			Filename:    fileKey.Filename,
+			FileSize:    size,
+			ChunkSize:   DefaultChunkSize,
+			SHA256:      sum,
+			ChunkHashes: chunkHashes,
+		}
+		if err := m.StoreMetadata(metadata); err != nil {
+			return "", err
+		}
+	}
+	return decrypted, nil
+}
+
+// decryptReceived decrypts a received encrypted file whose key is known.
+func (m *Manager) decryptReceived(fileID string) {
+	decrypted, err := m.DecryptFile(fileID)
+	if err != nil {
+		log.Printf("Error decrypting file %s: %v", fileID, err)
+		return
+	}
+	log.Printf("Decrypted file %s into %s", fileID, decrypted)
+	if metadata, err := m.GetMetadata(decrypted); err == nil {
+		m.publishCompleted(metadata)
+	}
+}
+
+// hasKey reports whether the key of an encrypted file is known.
+func (m *Manager) hasKey(fileID string) bool {
+	_, err := os.Stat(m.keyPath(fileID))
+	return err == nil
+}
+
+// keyPath returns where the key of an encrypted file is stored.
+func (m *Manager) keyPath(fileID string) string {
+	return filepath.Join(m.dataDir, keysDir, fileID)
+}
+
+// storeKey stores a file key sealed to this node's identity key.
+func (m *Manager) storeKey(fileKey FileKey) error {
+	m.mu.Lock()
+	id := m.identity
+	m.mu.Unlock()
+	if id == nil {
+		return ErrNoIdentity
+	}
+	data, err := json.Marshal(fileKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := identity.Seal(id.PublicKey(), data)
+	if err != nil {
+		return err
+	}
+	keyPath := m.keyPath(fileKey.FileID)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, sealed, 0600)
+}
+
+// loadKey reads the key of an encrypted file.
+func (m *Manager) loadKey(fileID string) (FileKey, error) {
+	if err := checkFileID(fileID); err != nil {
+		return FileKey{}, err
+	}
+	sealed, err := os.ReadFile(m.keyPath(fileID))
+	if errors.Is(err, os.ErrNotExist) {
+		return FileKey{}, fmt.Errorf("%w %s", ErrNoKey, fileID)
+	}
+	if err != nil {
+		return FileKey{}, err
+	}
+	return m.openKey(sealed)
+}
+
+// openKey opens a file key sealed to this node's identity key.
+func (m *Manager) openKey(sealed []byte) (FileKey, error) {
+	m.mu.Lock()
+	id := m.identity
+	m.mu.Unlock()
+	if id == nil {
+		return FileKey{}, ErrNoIdentity
+	}
+	data, err := id.Open(sealed)
+	if err != nil {
+		return FileKey{}, err
+	}
+	var fileKey FileKey
+	if err := json.Unmarshal(data, &fileKey); err != nil {
+		return FileKey{}, err
+	}
+	if len(fileKey.Key) != 32 || !ValidFileID(fileKey.SHA256) {
+		return FileKey{}, fmt.Errorf("invalid key for file %s", fileKey.FileID)
+	}
+	return fileKey, nil
+}
+
+// fileCipher returns the AES-256-GCM cipher of a file key.
+func fileCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blockNonce returns the nonce of block index of an encrypted file. Keys
+// are never reused across files, so the index alone makes it unique.
+func blockNonce(index int) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
@@ -1,37 +1,110 @@
 ﻿package filetransfer
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/message"
 )
 
 const (
 	DefaultChunkSize = 1024 * 1024 // 1MB
+
+	// maxChunkRetries is how many times a corrupted chunk is requested again
+	// before the transfer is abandoned.
+	maxChunkRetries = 3
+	// stateSaveInterval limits how often the state of an incoming transfer
+	// is saved while chunks arrive.
+	stateSaveInterval = time.Second
 )
 
 // Manager manages file transfers.
 type Manager struct {
-	dataDir string
-	mu      sync.Mutex
+	dataDir      string
+	shares       *Shares
+	serverAddr   string
+	eventManager *events.EventManager
+	mu           sync.Mutex
+	incoming     map[string]*incomingFile // 正在接收的文件
+	outgoing     map[string]*outgoingFile // 提供给其他节点的外部文件
+	offersDirty  bool                     // outgoing 有未保存的变化
+	offersSaved  time.Time                // outgoing 上次保存的时间
+	swarms       map[string]*swarm        // 多源下载
+	transfers    map[string]*transfer     // 上传和下载的进度
+	windows      map[string]*sendWindow   // 上传的发送窗口
+	throttle     *throttle                // 文件流量限速
+	codecOf      func(addr string) string // 与节点协商的压缩算法
+	binaryTo     func(addr string) bool   // 节点是否接受二进制块帧
+	nodeOf       func(addr string) string // 节点的 ID，未知时为空
+	identity     *identity.Identity       // 用于解密文件密钥
+	store        BlobStore                // 完整文件的存储
+	directories  map[string]*directory    // 正在接收的目录
+	quota        int64                    // 存储配额，0 表示不限
+	pinned       map[string]bool          // 不会被淘汰的文件
+	handles      *handlePool              // 正在接收的文件的句柄
+	finalizers   sync.WaitGroup           // 正在校验的文件
+}
+
+// incomingFile tracks the chunks of a file being received.
+type incomingFile struct {
+	metadata Metadata
+	received Bitmap
+	count    int       // number of chunks received
+	savedAt  time.Time // when the state was last saved
+	retries  map[int]int
+	sources  []Source
+	// finalizing is set once every chunk has arrived, while the file is
+	// verified and stored.
+	finalizing bool
 }
 
 // NewManager creates a new Manager instance.
-func NewManager(dataDir string) *Manager {
-	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-		os.MkdirAll(dataDir, 0755)
+func NewManager(dataDir string, shares *Shares, limits Limits, serverAddr string, eventManager *events.EventManager) *Manager {
+	for _, dir := range []string{blobsDir, incomingDir} {
+		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0755); err != nil {
+			log.Printf("Error creating %s: %v", filepath.Join(dataDir, dir), err)
+		}
+	}
+	if shares == nil {
+		shares = NewShares(nil, nil)
+	}
+	return &Manager{
+		dataDir:      dataDir,
+		shares:       shares,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+		incoming:     make(map[string]*incomingFile),
+		outgoing:     loadOffers(dataDir),
+		swarms:       make(map[string]*swarm),
+		transfers:    make(map[string]*transfer),
+		windows:      make(map[string]*sendWindow),
+		directories:  make(map[string]*directory),
+		pinned:       loadPins(dataDir),
+		store:        NewLocalStore(filepath.Join(dataDir, blobsDir)),
+		handles:      newHandlePool(maxOpenFiles),
+		throttle:     newThrottle(limits),
+		codecOf:      func(string) string { return "" },
+		binaryTo:     func(string) bool { return false },
+		nodeOf:       func(string) string { return "" },
 	}
-	return &Manager{dataDir: dataDir}
 }
 
 // GetMetadata retrieves file metadata.
 func (m *Manager) GetMetadata(fileID string) (Metadata, error) {
-	metadataPath := filepath.Join(m.dataDir, fileID+".metadata")
-	file, err := os.Open(metadataPath)
+	if err := checkFileID(fileID); err != nil {
+		return Metadata{}, err
+	}
+	file, err := m.store.Get(metadataKey(fileID), 0, -1)
 	if err != nil {
 		return Metadata{}, err
 	}
@@ -45,86 +118,370 @@ func (m *Manager) GetMetadata(fileID string) (Metadata, error) {
 
 // StoreMetadata stores file metadata.
 func (m *Manager) StoreMetadata(metadata Metadata) error {
-	metadataPath := filepath.Join(m.dataDir, metadata.FileID+".metadata")
-	file, err := os.Create(metadataPath)
+	if err := checkFileID(metadata.FileID); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(metadata)
-	return err
+	// 存储保证读取方不会看到写了一半的元数据
+	return m.store.Put(metadataKey(metadata.FileID), bytes.NewReader(append(data, '\n')))
 }
 
-// OpenFile opens a file for reading.
-func (m *Manager) OpenFile(fileID string) (*os.File, error) {
-	filePath := filepath.Join(m.dataDir, fileID)
-	return os.Open(filePath)
+// OpenFile opens a file of the blob store for reading.
+func (m *Manager) OpenFile(fileID string) (io.ReadCloser, error) {
+	if err := checkFileID(fileID); err != nil {
+		return nil, err
+	}
+	file, err := m.store.Get(fileID, 0, -1)
+	if err == nil {
+		m.touch(fileID)
+	}
+	return file, err
 }
 
-// CreateFile creates a file for writing.
-func (m *Manager) CreateFile(fileID string) (*os.File, error) {
-	filePath := filepath.Join(m.dataDir, fileID)
-	return os.Create(filePath)
+// WriteChunk writes data at offset into the partial file of an incoming
+// transfer. The data must lie within the size of the file. Chunks of
+// different files are written concurrently.
+func (m *Manager) WriteChunk(fileID string, data []byte, offset int64) error {
+	m.mu.Lock()
+	in, ok := m.incoming[fileID]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unexpected chunk for file %s", fileID)
+	}
+	if offset < 0 || offset+int64(len(data)) > in.metadata.FileSize {
+		return fmt.Errorf("%d bytes at offset %d are outside file %s of %d bytes", len(data), offset, fileID, in.metadata.FileSize)
+	}
+	return m.handles.writeAt(m.partialPath(fileID), data, offset)
 }
 
-// WriteChunk writes a chunk of data to a file.
-func (m *Manager) WriteChunk(fileID string, chunk []byte, chunkIndex int) error {
+// ReceiveMetadata stores the metadata of a file announced by the peer at
+// addr and prepares to receive its chunks. The source is persisted so an
+// interrupted transfer can be resumed from it. A file that is already being
+// received keeps what arrived so far and gains the source.
+func (m *Manager) ReceiveMetadata(addr string, metadata Metadata, source Source) error {
+	if err := checkMetadata(metadata); err != nil {
+		return err
+	}
+	if m.HasFile(metadata.FileID) {
+		log.Printf("Already have file %s (%s), skipping transfer", metadata.FileID, metadata.Filename)
+		return nil
+	}
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	if current, receiving := m.incoming[metadata.FileID]; receiving {
+		if current.finalizing {
+			m.mu.Unlock()
+			log.Printf("Already verifying file %s (%s), skipping transfer", metadata.FileID, metadata.Filename)
+			return nil
+		}
+		// 重复的元数据（例如对方重启后重新发送）不能清空已收到的块
+		current.addSource(source)
+		err := m.saveState(current)
+		m.mu.Unlock()
+		log.Printf("Already receiving file %s (%s), continuing transfer", metadata.FileID, metadata.Filename)
+		return err
+	}
+	m.mu.Unlock()
+	if err := m.reserveSpace(metadata.FileSize); err != nil {
+		return err
+	}
+	if err := m.StoreMetadata(metadata); err != nil {
+		return err
+	}
+	// 数据先写入 .part 文件，校验通过后才改名为最终文件；
+	// 预先设置为完整大小（稀疏文件），各块按偏移写入
+	m.handles.close(m.partialPath(metadata.FileID))
+	file, err := os.Create(m.partialPath(metadata.FileID))
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(metadata.FileSize)
+	file.Close()
+	if err != nil {
+		return err
+	}
 
-	filePath := filepath.Join(m.dataDir, fileID)
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	in := &incomingFile{
+		metadata: metadata,
+		received: NewBitmap(metadata.ChunkCount()),
+		retries:  make(map[int]int),
+		sources:  []Source{source},
+	}
+	m.mu.Lock()
+	m.incoming[metadata.FileID] = in
+	err = m.saveState(in)
+	m.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	m.startTransfer(Download, metadata, addr, metadata.FileSize, 0, Queued)
 
-	offset := int64(chunkIndex) * int64(len(chunk))
-	_, err = file.WriteAt(chunk, offset)
-	return err
+	if metadata.ChunkCount() == 0 {
+		m.finalize(metadata.FileID)
+	}
+	return nil
 }
 
-// SaveFile saves a file to the data directory.
-func (m *Manager) SaveFile(filename string, reader io.Reader) (string, error) {
+// VerifyChunk checks a chunk of an incoming file against its hash in the metadata.
+func (m *Manager) VerifyChunk(chunk Chunk) error {
+	m.mu.Lock()
+	in, ok := m.incoming[chunk.FileID]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unexpected chunk for file %s", chunk.FileID)
+	}
+	return verifyChunk(in.metadata, chunk)
+}
+
+// RetryChunk asks for a chunk again, giving up on the whole transfer after
+// maxChunkRetries attempts. Swarm downloads reschedule the chunk, possibly
+// on another peer; other transfers wait for the sender to retransmit it,
+// since a chunk that fails verification is not acknowledged.
+func (m *Manager) RetryChunk(addr string, fileID string, chunkIndex int) error {
+	m.mu.Lock()
+	in, ok := m.incoming[fileID]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("unexpected chunk for file %s", fileID)
+	}
+	in.retries[chunkIndex]++
+	exhausted := in.retries[chunkIndex] > maxChunkRetries
+	m.mu.Unlock()
+
+	if exhausted {
+		err := fmt.Errorf("chunk %d of file %s failed verification %d times, transfer abandoned", chunkIndex, fileID, maxChunkRetries)
+		m.abort(fileID, err)
+		return err
+	}
+	if sw, ok := m.swarm(fileID); ok {
+		sw.chunkFailed(addr, chunkIndex)
+	}
+	return nil
+}
+
+// RequestChunks asks the peer at addr to send the given chunks of a file.
+func (m *Manager) RequestChunks(addr string, fileID string, chunkIndices []int) {
+	request := ChunkRequest{FileID: fileID, ChunkIndices: chunkIndices}
+	m.send(addr, message.Message{Type: "file_chunk_request", Data: request, Sender: m.serverAddr})
+}
+
+// ReceiveChunk writes a verified chunk of a file announced with
+// ReceiveMetadata and finalizes the file once every chunk has arrived.
+func (m *Manager) ReceiveChunk(addr string, chunk Chunk) error {
+	m.mu.Lock()
+	in, ok := m.incoming[chunk.FileID]
+	finalizing := ok && in.finalizing
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unexpected chunk for file %s", chunk.FileID)
+	}
+	// 文件已收齐，重复的块不再写入正在校验的文件
+	if finalizing {
+		m.AckChunk(addr, chunk.FileID, chunk.ChunkIndex)
+		return nil
+	}
+	if err := checkChunkPosition(in.metadata, chunk); err != nil {
+		return err
+	}
+	// 暂停期间到达的块直接丢弃，恢复后重新请求；仍然确认，避免对方重传
+	downloadID := transferID(Download, chunk.FileID, "")
+	if m.transferPaused(downloadID) {
+		m.AckChunk(addr, chunk.FileID, chunk.ChunkIndex)
+		return nil
+	}
+
+	if err := m.WriteChunk(chunk.FileID, chunk.ChunkData, chunk.Offset); err != nil {
+		return err
+	}
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	added := !in.received.Has(chunk.ChunkIndex)
+	if added {
+		in.received.Set(chunk.ChunkIndex)
+		in.count++
+	}
+	complete := in.count == in.metadata.ChunkCount()
+	// 状态文件落后于实际进度是安全的，续传时只会多请求几个块
+	var err error
+	if !complete && time.Since(in.savedAt) >= stateSaveInterval {
+		err = m.saveState(in)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving transfer state for %s: %v", chunk.FileID, err)
+	}
+	// 下载限速：块到达时扣除令牌，超出时让对方暂缓发送
+	received := 0
+	if added {
+		received = len(chunk.ChunkData)
+	}
+	m.ackChunk(addr, chunk.FileID, chunk.ChunkIndex, m.throttle.reserveDownload(addr, received))
+	if added {
+		m.addProgress(downloadID, addr, len(chunk.ChunkData))
+		m.addDirectoryProgress(chunk.FileID, addr, len(chunk.ChunkData))
+	}
+	if sw, ok := m.swarm(chunk.FileID); ok {
+		sw.chunkReceived(addr, chunk.ChunkIndex, len(chunk.ChunkData))
+	}
 
-	fileID := generateFileID(filename)
-	filePath := filepath.Join(m.dataDir, fileID)
+	if complete {
+		m.finalize(chunk.FileID)
+	}
+	return nil
+}
+
+// finalize completes a fully received file in the background: hashing and
+// moving a large file would otherwise stall the network loop that delivered
+// its last chunk. The file is tracked as incoming until it is stored.
+func (m *Manager) finalize(fileID string) {
+	m.mu.Lock()
+	in, ok := m.incoming[fileID]
+	if !ok || in.finalizing {
+		m.mu.Unlock()
+		return
+	}
+	in.finalizing = true
+	m.finalizers.Add(1)
+	m.mu.Unlock()
 
-	file, err := os.Create(filePath)
+	go func() {
+		defer m.finalizers.Done()
+		m.complete(in)
+	}()
+}
+
+// complete stops tracking a fully received file and, once the whole-file
+// hash matches, moves it from its partial path to the blob store.
+func (m *Manager) complete(in *incomingFile) {
+	fileID := in.metadata.FileID
+	os.Remove(m.statePath(fileID))
+	m.stopSwarm(fileID)
+
+	downloadID := transferID(Download, fileID, "")
+	err := m.storePartial(in.metadata)
+	m.mu.Lock()
+	delete(m.incoming, fileID)
+	m.mu.Unlock()
+	if err != nil {
+		m.finishTransfer(downloadID, err)
+		return
+	}
+	peer := m.transferPeer(downloadID)
+	m.finishTransfer(downloadID, nil)
+	log.Printf("Received file %s (%s, %d bytes)", fileID, in.metadata.Filename, in.metadata.FileSize)
+	m.publishCompleted(in.metadata)
+
+	// 已收到密钥的加密文件在接收完成后解密
+	if in.metadata.Encrypted {
+		if m.hasKey(fileID) {
+			go m.decryptReceived(fileID)
+		} else {
+			log.Printf("File %s is encrypted, waiting for its key", fileID)
+		}
+	}
+	if in.metadata.Manifest {
+		m.startDirectory(fileID, peer, in.sources)
+	}
+}
+
+// storePartial verifies a fully received file and moves it from its
+// partial path to the blob store.
+func (m *Manager) storePartial(metadata Metadata) error {
+	partialPath := m.partialPath(metadata.FileID)
+	m.handles.close(partialPath)
+	if err := os.Truncate(partialPath, metadata.FileSize); err != nil {
+		log.Printf("Error finalizing file %s: %v", metadata.FileID, err)
+		return err
+	}
+	if err := verifyFile(metadata, partialPath); err != nil {
+		log.Printf("Discarding file %s: %v", metadata.FileID, err)
+		os.Remove(partialPath)
+		return err
+	}
+	if err := m.storeBlob(partialPath, metadata.FileID); err != nil {
+		log.Printf("Error finalizing file %s: %v", metadata.FileID, err)
+		return err
+	}
+	return nil
+}
+
+// abort stops tracking an incoming file and removes what was received of it.
+// A file that is already being finalized is left to finish.
+func (m *Manager) abort(fileID string, reason error) {
+	m.mu.Lock()
+	if in, ok := m.incoming[fileID]; ok && in.finalizing {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.incoming, fileID)
+	m.mu.Unlock()
+
+	// 取消目录下载时一并取消正在接收的文件
+	if current, ok := m.directoryFile(fileID); ok {
+		m.failDirectory(fileID, reason)
+		if current != "" {
+			m.abort(current, reason)
+		}
+	}
+
+	m.stopSwarm(fileID)
+	m.handles.close(m.partialPath(fileID))
+	os.Remove(m.partialPath(fileID))
+	os.Remove(m.statePath(fileID))
+	m.finishTransfer(transferID(Download, fileID, ""), reason)
+}
+
+// partialPath returns where an incoming file is staged until it is verified.
+func (m *Manager) partialPath(fileID string) string {
+	return filepath.Join(m.dataDir, incomingDir, fileID+".part")
+}
+
+// SaveFile saves a file to the blob store and returns its content
+// address. Saving content that is already stored keeps the stored copy.
+func (m *Manager) SaveFile(filename string, reader io.Reader) (string, error) {
+	file, err := os.CreateTemp(filepath.Join(m.dataDir, incomingDir), "save-*")
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
+	filePath := file.Name()
 
 	_, err = io.Copy(file, reader)
+	file.Close()
 	if err != nil {
 		os.Remove(filePath) // Clean up on error
 		return "", err
 	}
 
+	sum, chunkHashes, err := hashFile(filePath, DefaultChunkSize)
+	if err != nil {
+		os.Remove(filePath)
+		return "", err
+	}
+
 	// Create metadata
+	size := getFileSize(filePath)
 	metadata := Metadata{
-		FileID:    fileID,
-		Filename:  filename,
-		FileSize:  getFileSize(filePath),
-		ChunkSize: DefaultChunkSize,
+		FileID:      contentID(size, sum, chunkHashes),
+		Filename:    filename,
+		FileSize:    size,
+		ChunkSize:   DefaultChunkSize,
+		SHA256:      sum,
+		ChunkHashes: chunkHashes,
 	}
-	if err := m.StoreMetadata(metadata); err != nil {
+	if err := m.storeBlob(filePath, metadata.FileID); err != nil {
 		os.Remove(filePath)
 		return "", err
 	}
+	// 内容已存在时保留原有的元数据
+	if _, err := m.GetMetadata(metadata.FileID); err != nil {
+		if err := m.StoreMetadata(metadata); err != nil {
+			return "", err
+		}
+	}
 
-	return fileID, nil
-}
-
-// generateFileID generates a unique file ID.
-func generateFileID(filename string) string {
-	// Implement a more robust ID generation strategy (e.g., UUID)
-	return fmt.Sprintf("%s_%d", filename, os.Getpid())
+	return metadata.FileID, nil
 }
 
 // getFileSize returns the size of a file.
@@ -135,35 +492,179 @@ func getFileSize(filePath string) int64 {
 	}
 	return fileInfo.Size()
 }
+
+// SendFile sends a file to a peer over the existing connection: a
+// file_metadata message followed by one file_chunk message per chunk. It
+// returns once the peer has acknowledged every chunk.
 func (m *Manager) SendFile(addr string, filePath string) error {
-	// 打开文件
-	file, err := os.Open(filePath)
+	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
+	sum, chunkHashes, err := hashFile(filePath, DefaultChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+	metadata := Metadata{
+		FileID:      contentID(fileInfo.Size(), sum, chunkHashes),
+		Filename:    filepath.Base(filePath),
+		FileSize:    fileInfo.Size(),
+		ChunkSize:   DefaultChunkSize,
+		SHA256:      sum,
+		ChunkHashes: chunkHashes,
+	}
 
-	// 获取文件名
-	fileName := filepath.Base(filePath)
+	return m.sendWhole(addr, filePath, metadata)
+}
 
-	// 创建连接
-	conn, err := net.Dial("tcp", addr) // 使用 TCP 连接
+// SendStoredFile sends a file of the blob store to a peer, like SendFile,
+// under the filename recorded in its metadata.
+func (m *Manager) SendStoredFile(addr string, fileID string) error {
+	if err := checkFileID(fileID); err != nil {
+		return err
+	}
+	if !m.HasFile(fileID) {
+		return fmt.Errorf("file %s not found", fileID)
+	}
+	metadata, err := m.GetMetadata(fileID)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return err
 	}
-	defer conn.Close()
+	return m.sendWhole(addr, "", metadata)
+}
 
-	// 发送文件名
-	_, err = fmt.Fprintln(conn, fileName)
-	if err != nil {
-		return fmt.Errorf("failed to send filename: %w", err)
+// sendWhole offers a file to the peer at addr and sends its metadata and
+// then all of its chunks. The path is "" for files of the blob store. The
+// offer, which lets the peer request chunks again, ends with the upload
+// unless the peer stopped acknowledging chunks and may resume later.
+func (m *Manager) sendWhole(addr string, filePath string, metadata Metadata) (err error) {
+	m.offer(addr, time.Time{}, outgoingFile{path: filePath, metadata: metadata})
+	defer func() {
+		if !errors.Is(err, ErrNotAcknowledged) {
+			m.withdraw(addr, metadata.FileID)
+		}
+	}()
+
+	m.send(addr, message.Message{Type: "file_metadata", Data: metadata, Sender: m.serverAddr})
+
+	chunkIndices := make([]int, metadata.ChunkCount())
+	for i := range chunkIndices {
+		chunkIndices[i] = i
+	}
+	if err := m.SendChunks(addr, metadata.FileID, chunkIndices); err != nil {
+		return err
 	}
 
-	// 发送文件内容
-	_, err = io.Copy(conn, file)
+	log.Printf("Sent file %s to %s in %d chunks", metadata.Filename, addr, metadata.ChunkCount())
+	return nil
+}
+
+// SendChunks sends the given chunks of a file that is being sent, being
+// received or has been received completely, through the upload's sliding
+// window. Chunks this node does not have yet are skipped. The peer must be
+// permitted to fetch the file, see permitted; ErrNotPermitted is returned
+// otherwise.
+func (m *Manager) SendChunks(addr string, fileID string, chunkIndices []int) error {
+	if !m.permitted(addr, fileID) {
+		return fmt.Errorf("%w: file %s", ErrNotPermitted, fileID)
+	}
+	filePath, metadata, have, ok := m.localFile(fileID)
+	if !ok {
+		return fmt.Errorf("file %s %w", fileID, ErrFileNotFound)
+	}
+
+	var file chunkReader
+	var err error
+	if filePath != "" {
+		file, err = os.Open(filePath)
+	} else {
+		file, err = m.openBlob(fileID)
+		m.touch(fileID)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to send file content: %w", err)
+		return fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
-	return nil
+	// 每批请求作为一次上传跟踪
+	indices := []int{}
+	var size int64
+	for _, chunkIndex := range chunkIndices {
+		if chunkIndex < 0 || chunkIndex >= metadata.ChunkCount() {
+			return fmt.Errorf("chunk index %d out of range for file %s", chunkIndex, fileID)
+		}
+		if have != nil && !have.Has(chunkIndex) {
+			continue
+		}
+		indices = append(indices, chunkIndex)
+		size += metadata.ChunkLength(chunkIndex)
+	}
+	uploadID := transferID(Upload, fileID, addr)
+	m.startTransfer(Upload, metadata, addr, size, 0, Active)
+
+	w := m.acquireWindow(uploadID)
+	defer m.releaseWindow(uploadID)
+	err = m.streamChunks(addr, file, metadata, indices, w, uploadID)
+	m.endUpload(uploadID, err)
+	if errors.Is(err, ErrNotAcknowledged) {
+		// 对方可能断开或重启，之后会请求剩余的块
+		m.keepOffer(addr, fileID)
+	} else if err != nil {
+		m.withdraw(addr, fileID)
+	}
+	return err
+}
+
+// Have describes which chunks of a file this node can serve to the peer at
+// addr. It fails with ErrNotPermitted when the peer may not fetch the file
+// and with ErrFileNotFound when this node has none of it.
+func (m *Manager) Have(addr string, fileID string) (Have, error) {
+	if !m.permitted(addr, fileID) {
+		return Have{}, ErrNotPermitted
+	}
+	_, metadata, have, ok := m.localFile(fileID)
+	if !ok {
+		return Have{}, ErrFileNotFound
+	}
+	if have == nil {
+		return Have{FileID: fileID, Metadata: metadata, Complete: true}, nil
+	}
+	return Have{FileID: fileID, Metadata: metadata, Bitmap: have}, nil
+}
+
+// localFile finds a file this node can serve chunks from, without checking
+// who asks. The path is "" for files of the blob store and the bitmap is
+// nil when the file is complete.
+func (m *Manager) localFile(fileID string) (string, Metadata, Bitmap, bool) {
+	m.mu.Lock()
+	m.pruneOffers()
+	if out, ok := m.outgoing[fileID]; ok {
+		m.mu.Unlock()
+		return out.path, out.metadata, nil, true
+	}
+	// 正在校验的文件随时会被移走，校验完成后从存储中提供
+	if in, ok := m.incoming[fileID]; ok && !in.finalizing {
+		have := append(Bitmap(nil), in.received...)
+		m.mu.Unlock()
+		return m.partialPath(fileID), in.metadata, have, true
+	}
+	m.mu.Unlock()
+
+	if !m.HasFile(fileID) {
+		return "", Metadata{}, nil, false
+	}
+	metadata, err := m.GetMetadata(fileID)
+	if err != nil || metadata.ChunkSize <= 0 {
+		return "", Metadata{}, nil, false
+	}
+	return "", metadata, nil, true
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (m *Manager) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	m.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
 }
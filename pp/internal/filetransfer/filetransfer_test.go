@@ -0,0 +1,93 @@
+package filetransfer
+
+import (
+	"testing"
+	"time"
+)
+
+// testChunk returns chunk index of data as its sender sends it.
+func testChunk(metadata Metadata, data []byte, index int) Chunk {
+	offset := metadata.ChunkOffset(index)
+	return Chunk{
+		FileID:     metadata.FileID,
+		ChunkIndex: index,
+		Offset:     offset,
+		ChunkData:  data[offset : offset+metadata.ChunkLength(index)],
+	}
+}
+
+// waitForFile waits until m has stored a received file.
+func waitForFile(t *testing.T, m *Manager, fileID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.HasFile(fileID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("file %s was not stored", fileID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiveMetadataAgainKeepsProgress(t *testing.T) {
+	data, metadata := testMetadata(t, 2*DefaultChunkSize+10)
+	m := newTestManager(t)
+	first := Source{ListenAddr: "10.0.0.1:9000"}
+	if err := m.ReceiveMetadata("10.0.0.1:9000", metadata, first); err != nil {
+		t.Fatalf("ReceiveMetadata: %v", err)
+	}
+	if err := m.ReceiveChunk("10.0.0.1:9000", testChunk(metadata, data, 0)); err != nil {
+		t.Fatalf("ReceiveChunk: %v", err)
+	}
+
+	// 对方重启后重新发送元数据
+	second := Source{ListenAddr: "10.0.0.2:9000"}
+	if err := m.ReceiveMetadata("10.0.0.2:9000", metadata, second); err != nil {
+		t.Fatalf("ReceiveMetadata again: %v", err)
+	}
+	m.mu.Lock()
+	in := m.incoming[metadata.FileID]
+	count, sources := in.count, len(in.sources)
+	m.mu.Unlock()
+	if count != 1 || sources != 2 {
+		t.Fatalf("after metadata again: %d chunks received, %d sources; want 1 and 2", count, sources)
+	}
+
+	// 只需要剩下的块，第一块的数据仍在 .part 文件中
+	for _, index := range []int{1, 2} {
+		if err := m.ReceiveChunk("10.0.0.2:9000", testChunk(metadata, data, index)); err != nil {
+			t.Fatalf("ReceiveChunk(%d): %v", index, err)
+		}
+	}
+	waitForFile(t, m, metadata.FileID)
+}
+
+func TestReceiveMetadataChecksHashes(t *testing.T) {
+	_, metadata := testMetadata(t, 2*DefaultChunkSize+10)
+	_, other := testMetadata(t, 2*DefaultChunkSize+10)
+	tests := []struct {
+		name   string
+		tamper func(m *Metadata)
+	}{
+		{"forged chunk hash", func(m *Metadata) {
+			m.ChunkHashes = append([]string(nil), m.ChunkHashes...)
+			m.ChunkHashes[1] = other.ChunkHashes[1]
+		}},
+		{"chunk hashes of another file", func(m *Metadata) { m.ChunkHashes = other.ChunkHashes }},
+		{"missing chunk hash", func(m *Metadata) { m.ChunkHashes = m.ChunkHashes[:2] }},
+		{"whole-file hash", func(m *Metadata) { m.SHA256 = other.SHA256 }},
+		{"file size", func(m *Metadata) { m.FileSize-- }},
+		{"ID of another file", func(m *Metadata) { m.FileID = other.FileID }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := metadata
+			tt.tamper(&bad)
+			if err := newTestManager(t).ReceiveMetadata("peer", bad, Source{}); err == nil {
+				t.Fatal("ReceiveMetadata accepted tampered metadata")
+			}
+		})
+	}
+	if err := newTestManager(t).ReceiveMetadata("peer", metadata, Source{}); err != nil {
+		t.Fatalf("ReceiveMetadata: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package filetransfer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"pp/internal/compress"
+	"pp/internal/events"
+)
+
+// Chunks sent to peers that announced support for it travel in binary
+// frames instead of file_chunk messages, which saves the base64 and JSON
+// encoding on both sides:
+//
+//	[0]      frameChunk
+//	[1]      flags, chunkDeflate when the data is compressed
+//	[2:34]   file ID
+//	[34:38]  chunk index, big-endian
+//	[38:46]  chunk offset, big-endian
+//	[46:]    chunk data
+//
+// The data is read from the file straight into a pooled frame buffer that
+// is handed to the connection and recycled once it has been written out.
+// sendfile and splice would need the socket, which the gnet connections do
+// not expose, and every frame is copied once by the length-prefix codec.
+const (
+	// frameChunk marks a chunk frame. It must not clash with the deflate
+	// frames of package compress or with '{', which starts JSON messages.
+	frameChunk byte = 0x02
+
+	chunkDeflate byte = 0x01
+
+	chunkFrameHeaderLen = 46
+)
+
+var ErrInvalidFrame = errors.New("invalid chunk frame")
+
+// frameBuffers recycles frame buffers with room for a header and
+// DefaultChunkSize bytes of data.
+var frameBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, chunkFrameHeaderLen+DefaultChunkSize)
+		return &buf
+	},
+}
+
+// SetBinaryChunkLookup sets the function that tells whether a peer accepts
+// chunks in binary frames. Other peers get file_chunk messages.
+func (m *Manager) SetBinaryChunkLookup(lookup func(addr string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.binaryTo = lookup
+}
+
+// binaryChunks reports whether chunks for addr are sent in binary frames.
+func (m *Manager) binaryChunks(addr string) bool {
+	m.mu.Lock()
+	binaryTo := m.binaryTo
+	m.mu.Unlock()
+	return binaryTo(addr)
+}
+
+// IsChunkFrame reports whether a frame received from the network is a
+// chunk frame.
+func IsChunkFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0] == frameChunk
+}
+
+// DecodeChunkFrame parses a chunk frame. The data of the chunk shares
+// memory with frame.
+func DecodeChunkFrame(frame []byte) (Chunk, error) {
+	if len(frame) < chunkFrameHeaderLen || frame[0] != frameChunk || frame[1]&^chunkDeflate != 0 {
+		return Chunk{}, ErrInvalidFrame
+	}
+	chunk := Chunk{
+		FileID:     hex.EncodeToString(frame[2:34]),
+		ChunkIndex: int(binary.BigEndian.Uint32(frame[34:38])),
+		Offset:     int64(binary.BigEndian.Uint64(frame[38:46])),
+		ChunkData:  frame[chunkFrameHeaderLen:],
+	}
+	if chunk.Offset < 0 {
+		return Chunk{}, fmt.Errorf("%w: negative offset", ErrInvalidFrame)
+	}
+	if frame[1]&chunkDeflate != 0 {
+		chunk.Encoding = compress.Deflate
+	}
+	return chunk, nil
+}
+
+// sendChunkFrame reads a chunk into a frame buffer and sends it to addr.
+func (m *Manager) sendChunkFrame(addr string, file io.ReaderAt, metadata Metadata, index int, w *sendWindow) error {
+	rawID, err := hex.DecodeString(metadata.FileID)
+	if err != nil || len(rawID) != 32 {
+		return fmt.Errorf("invalid file ID %s", metadata.FileID)
+	}
+	offset := metadata.ChunkOffset(index)
+	length := metadata.ChunkLength(index)
+	frame := getFrameBuffer(chunkFrameHeaderLen + int(length))
+	data := frame[chunkFrameHeaderLen:]
+	if _, err := file.ReadAt(data, offset); err != nil {
+		putFrameBuffer(frame)
+		return fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+
+	frame[0], frame[1] = frameChunk, 0
+	copy(frame[2:34], rawID)
+	binary.BigEndian.PutUint32(frame[34:38], uint32(index))
+	binary.BigEndian.PutUint64(frame[38:46], uint64(offset))
+	// 压缩后的数据更短，直接覆盖原数据
+	if encoded, encoding := m.encodeChunkData(addr, data); encoding != "" {
+		frame = frame[:chunkFrameHeaderLen+copy(data, encoded)]
+		frame[1] = chunkDeflate
+	}
+
+	m.throttle.waitUpload(addr, len(frame)-chunkFrameHeaderLen)
+	w.sent(index)
+	eventData := events.SendFrameEventData{
+		DestinationAddr: addr,
+		Frame:           frame,
+		Release:         func() { putFrameBuffer(frame) },
+	}
+	m.eventManager.Publish(events.SendFrameEvent{EventData: eventData})
+	return nil
+}
+
+// getFrameBuffer returns a frame buffer of size bytes.
+func getFrameBuffer(size int) []byte {
+	if size > chunkFrameHeaderLen+DefaultChunkSize {
+		return make([]byte, size)
+	}
+	return (*frameBuffers.Get().(*[]byte))[:size]
+}
+
+// putFrameBuffer returns a buffer from getFrameBuffer for reuse.
+func putFrameBuffer(buf []byte) {
+	if cap(buf) != chunkFrameHeaderLen+DefaultChunkSize {
+		return
+	}
+	buf = buf[:cap(buf)]
+	frameBuffers.Put(&buf)
+}
@@ -0,0 +1,91 @@
+package filetransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"pp/internal/events"
+	"pp/internal/message"
+)
+
+// benchmarkChunk returns a manager and a file of one incompressible chunk
+// of DefaultChunkSize bytes.
+func benchmarkChunk(b *testing.B) (*Manager, *events.EventManager, *bytes.Reader, Metadata) {
+	b.Helper()
+
+	data := make([]byte, DefaultChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	sum := hashBytes(data)
+	metadata := Metadata{
+		FileID:      contentID(int64(len(data)), sum, []string{sum}),
+		FileSize:    int64(len(data)),
+		ChunkSize:   DefaultChunkSize,
+		SHA256:      sum,
+		ChunkHashes: []string{sum},
+	}
+	eventManager := events.NewEventManager()
+	m := NewManager(b.TempDir(), nil, Limits{}, "127.0.0.1:9000", eventManager)
+	b.Cleanup(m.Close)
+	return m, eventManager, bytes.NewReader(data), metadata
+}
+
+// BenchmarkChunkJSON sends and receives a chunk as a file_chunk message:
+// base64 in JSON, decoded twice by DecodeData on the receiving side.
+func BenchmarkChunkJSON(b *testing.B) {
+	m, eventManager, file, metadata := benchmarkChunk(b)
+	eventManager.Subscribe("send_message", func(event events.Event) {
+		msg := event.Data().(events.SendMessageEventData).Message.(message.Message)
+		raw, err := message.Serialize(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		received, err := message.Deserialize(raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var chunk Chunk
+		if err := received.DecodeData(&chunk); err != nil || len(chunk.ChunkData) != DefaultChunkSize {
+			b.Fatalf("decoded %d bytes (%v)", len(chunk.ChunkData), err)
+		}
+	})
+
+	buf := make([]byte, DefaultChunkSize)
+	b.SetBytes(DefaultChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 与 streamChunks 中未使用二进制帧的路径相同
+		if _, err := file.ReadAt(buf, 0); err != nil {
+			b.Fatal(err)
+		}
+		data, encoding := m.encodeChunkData("peer", buf)
+		chunk := Chunk{FileID: metadata.FileID, ChunkData: data, Encoding: encoding}
+		m.send("peer", message.Message{Type: "file_chunk", Data: chunk, Sender: m.serverAddr})
+	}
+}
+
+// BenchmarkChunkFrame sends and receives a chunk as a binary frame.
+func BenchmarkChunkFrame(b *testing.B) {
+	m, eventManager, file, metadata := benchmarkChunk(b)
+	eventManager.Subscribe("send_frame", func(event events.Event) {
+		data := event.Data().(events.SendFrameEventData)
+		// 长度前缀编码会复制一次帧
+		frame := append([]byte(nil), data.Frame...)
+		data.Release()
+		chunk, err := DecodeChunkFrame(frame)
+		if err != nil || len(chunk.ChunkData) != DefaultChunkSize {
+			b.Fatalf("decoded %d bytes (%v)", len(chunk.ChunkData), err)
+		}
+	})
+
+	w := newSendWindow()
+	b.SetBytes(DefaultChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.sendChunkFrame("peer", file, metadata, 0, w); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
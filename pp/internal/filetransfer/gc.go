@@ -0,0 +1,362 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The blob store doubles as a cache of everything this node has received.
+// When a quota is set, files nobody pinned are evicted least recently used
+// first to keep the store under it; BlobInfo.ModTime records when a blob was
+// last stored, opened or served, as far as the BlobStore supports it. Pins are kept in
+// <data_dir>/pinned.
+//
+// Garbage collection also removes what failed transfers leave behind: partial
+// files and transfer states without each other, temporary files, and
+// metadata of files that are neither stored nor being received.
+const (
+	pinnedFile = "pinned"
+	// minOrphanAge is how old a leftover must be before it is removed, so
+	// files that are just being created are never mistaken for leftovers.
+	minOrphanAge = 10 * time.Minute
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// GCStats reports what a garbage collection removed.
+type GCStats struct {
+	Removed int   // leftovers of failed transfers
+	Evicted int   // cached files evicted to stay under the quota
+	Freed   int64 // bytes
+}
+
+// SetQuota limits the space used by the blob store, including files being
+// received, to quota bytes. 0 means unlimited.
+func (m *Manager) SetQuota(quota int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quota = quota
+}
+
+// Pin keeps a file in the blob store even when the quota is exceeded. A file
+// can be pinned before it has been received.
+func (m *Manager) Pin(fileID string) error {
+	if err := checkFileID(fileID); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pinned[fileID] {
+		return nil
+	}
+	m.pinned[fileID] = true
+	return m.savePins()
+}
+
+// Unpin lets a pinned file be evicted again.
+func (m *Manager) Unpin(fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.pinned[fileID] {
+		return nil
+	}
+	delete(m.pinned, fileID)
+	return m.savePins()
+}
+
+// Pinned returns the IDs of the pinned files.
+func (m *Manager) Pinned() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pinned := make([]string, 0, len(m.pinned))
+	for fileID := range m.pinned {
+		pinned = append(pinned, fileID)
+	}
+	sort.Strings(pinned)
+	return pinned
+}
+
+// loadPins reads the pinned files of a data directory.
+func loadPins(dataDir string) map[string]bool {
+	pinned := make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(dataDir, pinnedFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error reading pinned files: %v", err)
+		}
+		return pinned
+	}
+	var fileIDs []string
+	if err := json.Unmarshal(data, &fileIDs); err != nil {
+		log.Printf("Error reading pinned files: %v", err)
+		return pinned
+	}
+	for _, fileID := range fileIDs {
+		if ValidFileID(fileID) {
+			pinned[fileID] = true
+		}
+	}
+	return pinned
+}
+
+// savePins writes the pinned files. The caller must hold m.mu.
+func (m *Manager) savePins() error {
+	fileIDs := make([]string, 0, len(m.pinned))
+	for fileID := range m.pinned {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Strings(fileIDs)
+	return writeJSONFile(filepath.Join(m.dataDir, pinnedFile), fileIDs)
+}
+
+// RunGC collects garbage right away and then every interval until stop is
+// closed.
+func (m *Manager) RunGC(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats := m.GC()
+		if stats.Removed > 0 || stats.Evicted > 0 {
+			log.Printf("Garbage collection removed %d leftovers, evicted %d files, freed %d bytes", stats.Removed, stats.Evicted, stats.Freed)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GC removes the leftovers of failed transfers and evicts cached files while
+// the blob store is over its quota.
+func (m *Manager) GC() GCStats {
+	var stats GCStats
+	m.collectIncoming(&stats)
+	m.collectMetadata(&stats)
+
+	m.mu.Lock()
+	quota := m.quota
+	m.mu.Unlock()
+	if quota > 0 {
+		if usage := m.usage(); usage > quota {
+			m.evict(usage-quota, &stats)
+		}
+	}
+	return stats
+}
+
+// reserveSpace makes room for a file of size bytes about to be received,
+// evicting cached files if needed.
+func (m *Manager) reserveSpace(size int64) error {
+	m.mu.Lock()
+	quota := m.quota
+	m.mu.Unlock()
+	if quota <= 0 {
+		return nil
+	}
+	if size > quota {
+		return fmt.Errorf("%w: file of %d bytes, quota %d bytes", ErrQuotaExceeded, size, quota)
+	}
+	usage := m.usage()
+	if usage+size <= quota {
+		return nil
+	}
+	var stats GCStats
+	m.evict(usage+size-quota, &stats)
+	if stats.Freed < usage+size-quota {
+		return fmt.Errorf("%w: %d bytes used, quota %d bytes", ErrQuotaExceeded, usage-stats.Freed, quota)
+	}
+	log.Printf("Evicted %d files, %d bytes, to make room for %d bytes", stats.Evicted, stats.Freed, size)
+	return nil
+}
+
+// usage returns the space used by the blob store plus the full size of the
+// files being received.
+func (m *Manager) usage() int64 {
+	var usage int64
+	blobs, err := m.store.List()
+	if err != nil {
+		log.Printf("Error listing stored files: %v", err)
+	}
+	for _, blob := range blobs {
+		usage += blob.Size
+	}
+	m.mu.Lock()
+	for _, in := range m.incoming {
+		usage += in.metadata.FileSize
+	}
+	m.mu.Unlock()
+	return usage
+}
+
+// evict removes the least recently used files that are not in use until
+// at least need bytes are freed.
+func (m *Manager) evict(need int64, stats *GCStats) {
+	keep := m.inUse()
+	stored, err := m.store.List()
+	if err != nil {
+		log.Printf("Error listing stored files: %v", err)
+	}
+	var blobs []BlobInfo
+	for _, blob := range stored {
+		if ValidFileID(blob.Key) && !keep[blob.Key] {
+			blobs = append(blobs, blob)
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].ModTime.Before(blobs[j].ModTime) })
+
+	var freed int64
+	for _, blob := range blobs {
+		if freed >= need {
+			break
+		}
+		if err := m.store.Delete(blob.Key); err != nil {
+			log.Printf("Error evicting file %s: %v", blob.Key, err)
+			continue
+		}
+		size := blob.Size
+		if info, err := m.store.Stat(metadataKey(blob.Key)); err == nil && m.store.Delete(info.Key) == nil {
+			size += info.Size
+		}
+		log.Printf("Evicted file %s, %d bytes", blob.Key, blob.Size)
+		freed += size
+		stats.Evicted++
+	}
+	stats.Freed += freed
+}
+
+// inUse returns the files that must not be evicted: pinned and shared files,
+// files being sent or received and the files of directories being received.
+func (m *Manager) inUse() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keep := make(map[string]bool)
+	for fileID := range m.pinned {
+		keep[fileID] = true
+	}
+	for fileID := range m.shares.fileIDs {
+		keep[fileID] = true
+	}
+	for fileID := range m.incoming {
+		keep[fileID] = true
+	}
+	for _, t := range m.transfers {
+		if !t.finished() {
+			keep[t.FileID] = true
+		}
+	}
+	// 目录组装前已收到的文件不能被淘汰
+	for manifestID, dir := range m.directories {
+		keep[manifestID] = true
+		for _, entry := range dir.manifest.Entries {
+			if !entry.Dir {
+				keep[entry.FileID] = true
+			}
+		}
+	}
+	return keep
+}
+
+// collectIncoming removes the leftovers of failed transfers from the
+// incoming directory.
+func (m *Manager) collectIncoming(stats *GCStats) {
+	dir := filepath.Join(m.dataDir, incomingDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading %s: %v", dir, err)
+		return
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < minOrphanAge {
+			continue
+		}
+		if m.liveIncoming(name, names) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Error removing %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed leftover %s", path)
+		stats.Removed++
+		if !entry.IsDir() {
+			stats.Freed += info.Size()
+		}
+	}
+}
+
+// liveIncoming reports whether an entry of the incoming directory belongs
+// to a transfer that is still going on or can be resumed. names holds all
+// entries of the directory.
+func (m *Manager) liveIncoming(name string, names map[string]bool) bool {
+	ext := filepath.Ext(name)
+	fileID := strings.TrimSuffix(name, ext)
+	if !ValidFileID(fileID) {
+		// 临时文件
+		return false
+	}
+
+	m.mu.Lock()
+	_, receiving := m.incoming[fileID]
+	_, directory := m.directories[fileID]
+	m.mu.Unlock()
+	switch ext {
+	case ".part":
+		return receiving || names[fileID+transferStateExt]
+	case transferStateExt:
+		return receiving || names[fileID+".part"]
+	case directoryStateExt:
+		return directory || m.HasFile(fileID)
+	}
+	return false
+}
+
+// collectMetadata removes metadata of files that are neither stored nor
+// being received, and temporary files left by interrupted writes.
+func (m *Manager) collectMetadata(stats *GCStats) {
+	if local, ok := m.store.(*LocalStore); ok {
+		removed, freed := local.removeStale(minOrphanAge)
+		stats.Removed += removed
+		stats.Freed += freed
+	}
+
+	blobs, err := m.store.List()
+	if err != nil {
+		log.Printf("Error listing stored files: %v", err)
+		return
+	}
+	for _, blob := range blobs {
+		fileID := strings.TrimSuffix(blob.Key, metadataExt)
+		if fileID == blob.Key || !ValidFileID(fileID) || m.HasFile(fileID) {
+			continue
+		}
+		if time.Since(blob.ModTime) < minOrphanAge {
+			continue
+		}
+		m.mu.Lock()
+		_, receiving := m.incoming[fileID]
+		m.mu.Unlock()
+		if _, err := os.Stat(m.statePath(fileID)); receiving || err == nil {
+			continue
+		}
+		if err := m.store.Delete(blob.Key); err == nil {
+			stats.Removed++
+			stats.Freed += blob.Size
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package filetransfer
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+const (
+	// maxOpenFiles is how many partial files are kept open for writing.
+	// The least recently written one is closed when another is opened.
+	maxOpenFiles = 64
+)
+
+// handlePool keeps the partial files of incoming transfers open so chunks
+// are not written through a new file handle each. Writes to one file are
+// serialized by its own lock; writes to different files run in parallel.
+type handlePool struct {
+	mu    sync.Mutex
+	max   int
+	files map[string]*pooledFile
+	lru   *list.List // of *pooledFile, most recently used first
+}
+
+// pooledFile is an open partial file.
+type pooledFile struct {
+	mu     sync.Mutex // held while writing and closing
+	path   string
+	file   *os.File
+	closed bool
+	elem   *list.Element
+}
+
+func newHandlePool(max int) *handlePool {
+	return &handlePool{
+		max:   max,
+		files: make(map[string]*pooledFile),
+		lru:   list.New(),
+	}
+}
+
+// writeAt writes data at offset into the existing file at path.
+func (p *handlePool) writeAt(path string, data []byte, offset int64) error {
+	for {
+		f, err := p.get(path)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		if f.closed {
+			// 刚被淘汰，重新打开
+			f.mu.Unlock()
+			continue
+		}
+		_, err = f.file.WriteAt(data, offset)
+		f.mu.Unlock()
+		return err
+	}
+}
+
+// get returns the open handle of path, opening it if needed.
+func (p *handlePool) get(path string) (*pooledFile, error) {
+	p.mu.Lock()
+	if f, ok := p.files[path]; ok {
+		p.lru.MoveToFront(f.elem)
+		p.mu.Unlock()
+		return f, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	f := &pooledFile{path: path, file: file}
+	f.elem = p.lru.PushFront(f)
+	p.files[path] = f
+
+	var evicted []*pooledFile
+	for p.lru.Len() > p.max {
+		oldest := p.lru.Remove(p.lru.Back()).(*pooledFile)
+		delete(p.files, oldest.path)
+		evicted = append(evicted, oldest)
+	}
+	p.mu.Unlock()
+
+	for _, old := range evicted {
+		old.close()
+	}
+	return f, nil
+}
+
+// close closes the handle of path, if it is open, once pending writes are
+// done. Files must be closed before they are moved or removed.
+func (p *handlePool) close(path string) {
+	p.mu.Lock()
+	f, ok := p.files[path]
+	if ok {
+		p.lru.Remove(f.elem)
+		delete(p.files, path)
+	}
+	p.mu.Unlock()
+	if ok {
+		f.close()
+	}
+}
+
+// closeAll closes every open handle.
+func (p *handlePool) closeAll() {
+	p.mu.Lock()
+	files := p.files
+	p.files = make(map[string]*pooledFile)
+	p.lru.Init()
+	p.mu.Unlock()
+	for _, f := range files {
+		f.close()
+	}
+}
+
+func (f *pooledFile) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+	f.closed = true
+}
+
+// chunkBuffers recycles buffers of DefaultChunkSize bytes, the size of
+// almost every chunk read or written.
+var chunkBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, DefaultChunkSize)
+		return &buf
+	},
+}
+
+// getBuffer returns a buffer of size bytes. Buffers of at most
+// DefaultChunkSize bytes come from chunkBuffers.
+func getBuffer(size int) []byte {
+	if size > DefaultChunkSize {
+		return make([]byte, size)
+	}
+	return (*chunkBuffers.Get().(*[]byte))[:size]
+}
+
+// putBuffer returns a buffer from getBuffer for reuse.
+func putBuffer(buf []byte) {
+	if cap(buf) != DefaultChunkSize {
+		return
+	}
+	buf = buf[:DefaultChunkSize]
+	chunkBuffers.Put(&buf)
+}
@@ -0,0 +1,119 @@
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// hashBytes returns the hex encoded SHA-256 of data.
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the whole-file SHA-256 of the file at filePath together
+// with the SHA-256 of each chunkSize chunk.
+func hashFile(filePath string, chunkSize int) (string, []string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	chunkHashes := []string{}
+	buf := getBuffer(chunkSize)
+	defer putBuffer(buf)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			chunkHashes = append(chunkHashes, hashBytes(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(whole.Sum(nil)), chunkHashes, nil
+}
+
+// contentID returns the file ID of size bytes of content with the given
+// whole-file and chunk hashes. The ID commits to every chunk hash, so
+// metadata from any peer can be checked against the ID it was asked for.
+func contentID(size int64, sum string, chunkHashes []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "pp file\x00%d\x00%s", size, sum)
+	for _, chunkHash := range chunkHashes {
+		io.WriteString(h, "\x00"+chunkHash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkMetadata checks metadata received from a peer: the chunk size must
+// be the one this implementation uses, so nothing is allocated by the peer's
+// sizes, and the file ID must commit to the hashes.
+func checkMetadata(metadata Metadata) error {
+	if err := checkFileID(metadata.FileID); err != nil {
+		return err
+	}
+	if metadata.ChunkSize != DefaultChunkSize || metadata.FileSize < 0 {
+		return fmt.Errorf("invalid metadata for file %s", metadata.FileID)
+	}
+	if len(metadata.ChunkHashes) != metadata.ChunkCount() {
+		return fmt.Errorf("missing hashes in metadata for file %s", metadata.FileID)
+	}
+	if contentID(metadata.FileSize, metadata.SHA256, metadata.ChunkHashes) != metadata.FileID {
+		return fmt.Errorf("metadata of file %s: %w", metadata.FileID, ErrHashMismatch)
+	}
+	return nil
+}
+
+// verifyChunk checks a chunk against the hash recorded in metadata.
+func verifyChunk(metadata Metadata, chunk Chunk) error {
+	if err := checkChunkPosition(metadata, chunk); err != nil {
+		return err
+	}
+	if chunk.ChunkIndex >= len(metadata.ChunkHashes) {
+		return fmt.Errorf("no hash for chunk %d of file %s", chunk.ChunkIndex, metadata.FileID)
+	}
+	if hashBytes(chunk.ChunkData) != metadata.ChunkHashes[chunk.ChunkIndex] {
+		return fmt.Errorf("chunk %d of file %s: %w", chunk.ChunkIndex, metadata.FileID, ErrHashMismatch)
+	}
+	return nil
+}
+
+// checkChunkPosition checks that a chunk has the index, offset and length
+// metadata gives it, so it lies entirely within the file.
+func checkChunkPosition(metadata Metadata, chunk Chunk) error {
+	if chunk.ChunkIndex < 0 || chunk.ChunkIndex >= metadata.ChunkCount() {
+		return fmt.Errorf("chunk index %d out of range for file %s", chunk.ChunkIndex, metadata.FileID)
+	}
+	if chunk.Offset != metadata.ChunkOffset(chunk.ChunkIndex) {
+		return fmt.Errorf("chunk %d of file %s at offset %d, expected %d", chunk.ChunkIndex, metadata.FileID, chunk.Offset, metadata.ChunkOffset(chunk.ChunkIndex))
+	}
+	if int64(len(chunk.ChunkData)) != metadata.ChunkLength(chunk.ChunkIndex) {
+		return fmt.Errorf("chunk %d of file %s has %d bytes, expected %d", chunk.ChunkIndex, metadata.FileID, len(chunk.ChunkData), metadata.ChunkLength(chunk.ChunkIndex))
+	}
+	return nil
+}
+
+// verifyFile checks the whole file at filePath against the hash recorded in metadata.
+func verifyFile(metadata Metadata, filePath string) error {
+	sum, _, err := hashFile(filePath, metadata.ChunkSize)
+	if err != nil {
+		return err
+	}
+	if sum != metadata.SHA256 {
+		return fmt.Errorf("file %s: %w", metadata.FileID, ErrHashMismatch)
+	}
+	return nil
+}
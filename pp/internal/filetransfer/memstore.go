@@ -0,0 +1,113 @@
+package filetransfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a BlobStore in memory, for tests and short-lived nodes.
+type MemoryStore struct {
+	mu    sync.Mutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *MemoryStore) Put(key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = memoryBlob{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStore) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidOffset, offset)
+	}
+	s.mu.Lock()
+	blob, ok := s.blobs[key]
+	s.mu.Unlock()
+	if !ok {
+		return nil, notFound("get", key)
+	}
+	// 数据写入后不再修改，可以直接共享
+	data := blob.data[min(offset, int64(len(blob.data))):]
+	if length >= 0 {
+		data = data[:min(length, int64(len(data)))]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStore) Stat(key string) (BlobInfo, error) {
+	if err := checkKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return BlobInfo{}, notFound("stat", key)
+	}
+	return BlobInfo{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return notFound("delete", key)
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]BlobInfo, error) {
+	s.mu.Lock()
+	blobs := make([]BlobInfo, 0, len(s.blobs))
+	for key, blob := range s.blobs {
+		blobs = append(blobs, BlobInfo{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime})
+	}
+	s.mu.Unlock()
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+func (s *MemoryStore) touch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blob, ok := s.blobs[key]; ok {
+		blob.modTime = time.Now()
+		s.blobs[key] = blob
+	}
+}
+
+// notFound returns the error of a missing blob.
+func notFound(op string, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
@@ -6,4 +6,75 @@ type Metadata struct {
 	Filename  string `json:"filename"`
 	FileSize  int64  `json:"file_size"`
 	ChunkSize int    `json:"chunk_size"`
+
+	SHA256      string   `json:"sha256"`       // Hex encoded SHA-256 of the whole file
+	ChunkHashes []string `json:"chunk_hashes"` // Hex encoded SHA-256 of each chunk
+
+	Encrypted bool `json:"encrypted,omitempty"` // The data is encrypted, see EncryptFile
+	Manifest  bool `json:"manifest,omitempty"`  // The file is the Manifest of a directory
+}
+
+// ChunkCount returns the number of chunks the file is split into.
+func (m Metadata) ChunkCount() int {
+	if m.ChunkSize <= 0 {
+		return 0
+	}
+	return int((m.FileSize + int64(m.ChunkSize) - 1) / int64(m.ChunkSize))
+}
+
+// ChunkOffset returns the byte offset of chunk i in the file.
+func (m Metadata) ChunkOffset(i int) int64 {
+	return int64(i) * int64(m.ChunkSize)
+}
+
+// ChunkLength returns the length of chunk i; only the last chunk may be
+// shorter than ChunkSize.
+func (m Metadata) ChunkLength(i int) int64 {
+	return min(int64(m.ChunkSize), m.FileSize-m.ChunkOffset(i))
+}
+
+// Chunk is the payload of a file_chunk message.
+type Chunk struct {
+	FileID     string `json:"file_id"`
+	ChunkIndex int    `json:"chunk_index"`
+	Offset     int64  `json:"offset"` // byte offset of the chunk in the file
+	ChunkData  []byte `json:"chunk_data"`
+	Encoding   string `json:"encoding,omitempty"` // "deflate" when ChunkData is compressed
+}
+
+// ChunkRequest is the payload of a file_chunk_request message, asking the
+// sender to send some chunks of a file again.
+type ChunkRequest struct {
+	FileID       string `json:"file_id"`
+	ChunkIndices []int  `json:"chunk_indices"`
+}
+
+// ChunkAck is the payload of a file_chunk_ack message, acknowledging
+// chunks that arrived. A receiver over its download limits sets Backoff to
+// the milliseconds the sender should wait before sending more chunks.
+type ChunkAck struct {
+	FileID       string `json:"file_id"`
+	ChunkIndices []int  `json:"chunk_indices"`
+	Backoff      int64  `json:"backoff,omitempty"`
+}
+
+// HaveRequest is the payload of a file_have_request message, asking a peer
+// which chunks of a file it can serve.
+type HaveRequest struct {
+	FileID string `json:"file_id"`
+}
+
+// Have is the payload of a file_have message.
+type Have struct {
+	FileID   string   `json:"file_id"`
+	Metadata Metadata `json:"metadata"`
+	Complete bool     `json:"complete"`
+	Bitmap   Bitmap   `json:"bitmap,omitempty"` // set when the file is incomplete
+}
+
+// RequestError is the payload of a file_request_error message, telling the
+// requester why a file_request was refused.
+type RequestError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"` // "not found" or "not permitted"
 }
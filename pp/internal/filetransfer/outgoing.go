@@ -0,0 +1,265 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files pushed to a peer are offered to it: the peer, and only the peer,
+// may request chunks of them until it has them all. Offers are kept in
+// <data_dir>/outgoing, so a peer can still fetch the rest of a file after
+// this node restarted. Peers are identified by node ID where known, so an
+// offer survives reconnecting from another address.
+const (
+	offersFile = "outgoing"
+	// offerTTL is how long a peer has to fetch a file offered to it, for
+	// the files of a directory that the peer fetches one after another and
+	// for uploads that were interrupted.
+	offerTTL = 24 * time.Hour
+)
+
+// outgoingFile is a file offered to peers, from outside the data directory
+// or, with an empty path, from the blob store. It is served until every
+// peer it was offered to has acknowledged all of its chunks, its upload to
+// them failed or the offer expired.
+type outgoingFile struct {
+	path     string
+	metadata Metadata
+	peers    map[string]*delivery // peer -> what the peer has received
+}
+
+// delivery tracks an outgoing file offered to one peer.
+type delivery struct {
+	delivered Bitmap // chunks the peer acknowledged
+	count     int    // number of chunks acknowledged
+	expires   time.Time
+}
+
+// savedOffer is an offer as persisted in the outgoing file.
+type savedOffer struct {
+	Path      string    `json:"path"`
+	Metadata  Metadata  `json:"metadata"`
+	Peer      string    `json:"peer"`
+	Delivered Bitmap    `json:"delivered"`
+	Expires   time.Time `json:"expires"`
+}
+
+// SetPeerLookup sets the function that returns the node ID of the peer at
+// an address, or "" when it is not known.
+func (m *Manager) SetPeerLookup(lookup func(addr string) string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodeOf = lookup
+}
+
+// peerKey returns what offers to the peer at addr are recorded under: its
+// node ID, or the address when the node ID is not known.
+func (m *Manager) peerKey(addr string) string {
+	m.mu.Lock()
+	nodeOf := m.nodeOf
+	m.mu.Unlock()
+	if nodeID := nodeOf(addr); nodeID != "" {
+		return nodeID
+	}
+	return addr
+}
+
+// offer makes files available to the peer at addr. A zero expiry keeps the
+// offers until the files are delivered or their upload fails.
+func (m *Manager) offer(addr string, expires time.Time, files ...outgoingFile) {
+	peer := m.peerKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneOffers()
+	for _, file := range files {
+		out, ok := m.outgoing[file.metadata.FileID]
+		if !ok {
+			out = &outgoingFile{path: file.path, metadata: file.metadata, peers: make(map[string]*delivery)}
+			m.outgoing[file.metadata.FileID] = out
+		}
+		if _, ok := out.peers[peer]; !ok {
+			out.peers[peer] = &delivery{delivered: NewBitmap(file.metadata.ChunkCount())}
+		}
+		out.peers[peer].expires = expires
+	}
+	// 新的提供必须立即保存，重启后对方才能续传
+	m.saveOffers(true)
+}
+
+// keepOffer keeps an outgoing file available to the peer at addr for
+// offerTTL after its upload was interrupted, so the peer can resume it.
+func (m *Manager) keepOffer(addr string, fileID string) {
+	peer := m.peerKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out, ok := m.outgoing[fileID]
+	if !ok {
+		return
+	}
+	if d, ok := out.peers[peer]; ok {
+		d.expires = time.Now().Add(offerTTL)
+		m.saveOffers(true)
+	}
+}
+
+// offeredTo reports whether a file is offered to the peer at addr.
+func (m *Manager) offeredTo(addr string, fileID string) bool {
+	peer := m.peerKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneOffers()
+	out, ok := m.outgoing[fileID]
+	if !ok {
+		return false
+	}
+	_, ok = out.peers[peer]
+	return ok
+}
+
+// withdraw stops serving an outgoing file to the peer at addr, and drops
+// the file once no peer is left.
+func (m *Manager) withdraw(addr string, fileID string) {
+	peer := m.peerKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.withdrawLocked(peer, fileID)
+}
+
+// withdrawLocked withdraws the offer of a file to peer, as recorded by
+// peerKey. The caller must hold m.mu.
+func (m *Manager) withdrawLocked(peer string, fileID string) {
+	out, ok := m.outgoing[fileID]
+	if !ok {
+		return
+	}
+	if _, ok := out.peers[peer]; !ok {
+		return
+	}
+	delete(out.peers, peer)
+	if len(out.peers) == 0 {
+		delete(m.outgoing, fileID)
+	}
+	m.saveOffers(false)
+}
+
+// delivered records chunks of an outgoing file acknowledged by the peer at
+// addr and withdraws the offer once the peer has all of them.
+func (m *Manager) delivered(addr string, fileID string, chunkIndices []int) {
+	peer := m.peerKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out, ok := m.outgoing[fileID]
+	if !ok {
+		return
+	}
+	d, ok := out.peers[peer]
+	if !ok {
+		return
+	}
+	for _, index := range chunkIndices {
+		if index >= 0 && index < out.metadata.ChunkCount() && !d.delivered.Has(index) {
+			d.delivered.Set(index)
+			d.count++
+		}
+	}
+	if d.count == out.metadata.ChunkCount() {
+		m.withdrawLocked(peer, fileID)
+		return
+	}
+	m.saveOffers(false)
+}
+
+// pruneOffers drops expired offers. Callers must hold m.mu.
+func (m *Manager) pruneOffers() {
+	now := time.Now()
+	for fileID, out := range m.outgoing {
+		for peer, d := range out.peers {
+			if !d.expires.IsZero() && now.After(d.expires) {
+				m.withdrawLocked(peer, fileID)
+			}
+		}
+	}
+}
+
+// saveOffers writes the offers, at most once per stateSaveInterval unless
+// force is set. Skipped changes are written with a later one or by Close;
+// an offer saved after it ended only lingers until it expires. The caller
+// must hold m.mu.
+func (m *Manager) saveOffers(force bool) {
+	m.offersDirty = true
+	if !force && time.Since(m.offersSaved) < stateSaveInterval {
+		return
+	}
+	saved := []savedOffer{}
+	for _, out := range m.outgoing {
+		for peer, d := range out.peers {
+			saved = append(saved, savedOffer{
+				Path:      out.path,
+				Metadata:  out.metadata,
+				Peer:      peer,
+				Delivered: d.delivered,
+				Expires:   d.expires,
+			})
+		}
+	}
+	if err := writeJSONFile(filepath.Join(m.dataDir, offersFile), saved); err != nil {
+		log.Printf("Error saving outgoing files: %v", err)
+		return
+	}
+	m.offersDirty = false
+	m.offersSaved = time.Now()
+}
+
+// loadOffers reads the offers saved before a restart. Uploads that were
+// still running when the node stopped are kept for offerTTL so their peers
+// can resume them; files that no longer exist are dropped.
+func loadOffers(dataDir string) map[string]*outgoingFile {
+	outgoing := make(map[string]*outgoingFile)
+	data, err := os.ReadFile(filepath.Join(dataDir, offersFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error reading outgoing files: %v", err)
+		}
+		return outgoing
+	}
+	var saved []savedOffer
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Error reading outgoing files: %v", err)
+		return outgoing
+	}
+
+	now := time.Now()
+	for _, s := range saved {
+		if !ValidFileID(s.Metadata.FileID) || (!s.Expires.IsZero() && now.After(s.Expires)) {
+			continue
+		}
+		if _, err := os.Stat(s.Path); s.Path != "" && err != nil {
+			continue
+		}
+		out, ok := outgoing[s.Metadata.FileID]
+		if !ok {
+			out = &outgoingFile{path: s.Path, metadata: s.Metadata, peers: make(map[string]*delivery)}
+			outgoing[s.Metadata.FileID] = out
+		}
+		d := &delivery{delivered: NewBitmap(s.Metadata.ChunkCount()), expires: s.Expires}
+		if d.expires.IsZero() {
+			d.expires = now.Add(offerTTL)
+		}
+		for i := 0; i < s.Metadata.ChunkCount(); i++ {
+			if s.Delivered.Has(i) {
+				d.delivered.Set(i)
+				d.count++
+			}
+		}
+		out.peers[s.Peer] = d
+	}
+	return outgoing
+}
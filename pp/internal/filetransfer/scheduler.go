@@ -0,0 +1,464 @@
+package filetransfer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"pp/internal/message"
+)
+
+// Strategy decides in which order a swarm download requests chunks.
+type Strategy int
+
+const (
+	// RarestFirst requests the chunks held by the fewest peers first, so
+	// rare chunks spread before their holders leave.
+	RarestFirst Strategy = iota
+	// Sequential requests chunks in file order.
+	Sequential
+)
+
+const (
+	scheduleInterval = 200 * time.Millisecond
+	// haveRefreshInterval is how often peers with an incomplete copy are
+	// asked again which chunks they have.
+	haveRefreshInterval = 2 * time.Second
+	// minStallTimeout is the shortest time a requested chunk may take
+	// before it is reassigned to another peer.
+	minStallTimeout = 5 * time.Second
+	// maxStalls is how many stalls in a row drop a peer from the swarm.
+	maxStalls     = 3
+	initialWindow = 2
+	maxWindow     = 16
+	// windowLatency is how much of a peer's throughput is kept in flight.
+	windowLatency = time.Second
+)
+
+// swarmPeer is the scheduler's view of one peer of a swarm download.
+type swarmPeer struct {
+	addr     string
+	have     Bitmap // nil when the peer has the whole file
+	rate     float64
+	window   int
+	inFlight int
+	stalls   int
+}
+
+// pendingChunk is a chunk requested from a peer and not yet received.
+type pendingChunk struct {
+	peer   string
+	sentAt time.Time
+}
+
+// swarm downloads one file from several peers in parallel.
+type swarm struct {
+	manager  *Manager
+	fileID   string
+	strategy Strategy
+	invited  map[string]bool // peers the download was started with
+	haveMu   sync.Mutex      // 串行处理 file_have，避免重复创建传输
+	mu       sync.Mutex
+	peers    map[string]*swarmPeer
+	pending  map[int]pendingChunk
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// Download fetches a file from all of the given peers at once. The peers
+// are asked which chunks they have; chunks are then requested in the order
+// given by strategy, spread over the peers according to their throughput.
+// Chunks from peers that stall are requested again from other peers.
+// Download returns once the peers have been asked; the file appears in the
+// data directory when it is complete.
+func (m *Manager) Download(fileID string, peers []string, strategy Strategy) error {
+	if err := checkFileID(fileID); err != nil {
+		return err
+	}
+	if m.HasFile(fileID) {
+		log.Printf("Already have file %s, skipping download", fileID)
+		return nil
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("no peers to download %s from", fileID)
+	}
+
+	sw := &swarm{
+		manager:  m,
+		fileID:   fileID,
+		strategy: strategy,
+		invited:  make(map[string]bool),
+		peers:    make(map[string]*swarmPeer),
+		pending:  make(map[int]pendingChunk),
+		stopCh:   make(chan struct{}),
+	}
+	for _, addr := range peers {
+		sw.invited[addr] = true
+	}
+	m.mu.Lock()
+	if _, ok := m.swarms[fileID]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("file %s is already being downloaded", fileID)
+	}
+	m.swarms[fileID] = sw
+	m.mu.Unlock()
+
+	for _, addr := range peers {
+		m.requestHave(addr, fileID)
+	}
+	go sw.run()
+	return nil
+}
+
+// HandleHave records which chunks of a file the peer at addr can serve.
+// The first answer for a swarm download also starts the transfer, with
+// source saved for resuming it.
+func (m *Manager) HandleHave(addr string, have Have, source Source) error {
+	sw, ok := m.swarm(have.FileID)
+	if !ok {
+		return fmt.Errorf("unexpected file_have for %s", have.FileID)
+	}
+	if have.Metadata.FileID != have.FileID {
+		return fmt.Errorf("peer %s sent metadata of %s for %s", addr, have.Metadata.FileID, have.FileID)
+	}
+	// 文件 ID 包含了块哈希，先到的元数据与其他节点的一致
+	if err := checkMetadata(have.Metadata); err != nil {
+		return fmt.Errorf("peer %s: %w", addr, err)
+	}
+	sw.haveMu.Lock()
+	defer sw.haveMu.Unlock()
+
+	m.mu.Lock()
+	in, receiving := m.incoming[have.FileID]
+	m.mu.Unlock()
+	if !receiving {
+		if err := m.ReceiveMetadata(addr, have.Metadata, source); err != nil {
+			return err
+		}
+	} else {
+		m.mu.Lock()
+		in.addSource(source)
+		m.mu.Unlock()
+	}
+
+	sw.setHave(addr, have)
+	return nil
+}
+
+// swarm returns the swarm download of a file, if there is one.
+func (m *Manager) swarm(fileID string) (*swarm, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sw, ok := m.swarms[fileID]
+	return sw, ok
+}
+
+// stopSwarm ends the swarm download of a file, if there is one.
+func (m *Manager) stopSwarm(fileID string) {
+	m.mu.Lock()
+	sw, ok := m.swarms[fileID]
+	delete(m.swarms, fileID)
+	m.mu.Unlock()
+	if ok {
+		sw.stop()
+	}
+}
+
+// requestHave asks the peer at addr which chunks of a file it has.
+func (m *Manager) requestHave(addr string, fileID string) {
+	m.send(addr, message.Message{Type: "file_have_request", Data: HaveRequest{FileID: fileID}, Sender: m.serverAddr})
+}
+
+// addSource records another peer the file is being received from.
+// The caller must hold m.mu.
+func (in *incomingFile) addSource(source Source) {
+	if source == (Source{}) {
+		return
+	}
+	for _, s := range in.sources {
+		if s == source {
+			return
+		}
+	}
+	in.sources = append(in.sources, source)
+}
+
+func (sw *swarm) stop() {
+	sw.stopOnce.Do(func() { close(sw.stopCh) })
+}
+
+// run schedules chunk requests until the download completes or every
+// peer is gone.
+func (sw *swarm) run() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	lastRefresh := time.Now()
+	started := time.Now()
+	receiving := false
+
+	for {
+		select {
+		case <-sw.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		sw.manager.mu.Lock()
+		in, ok := sw.manager.incoming[sw.fileID]
+		var metadata Metadata
+		var received Bitmap
+		if ok {
+			metadata = in.metadata
+			received = append(Bitmap(nil), in.received...)
+		}
+		sw.manager.mu.Unlock()
+
+		if !ok {
+			if receiving {
+				// 传输已完成或已放弃
+				return
+			}
+			// 还没有任何节点回复 file_have
+			if time.Since(started) > minStallTimeout {
+				log.Printf("No peer has file %s", sw.fileID)
+				sw.manager.stopSwarm(sw.fileID)
+				sw.manager.directoryFileDone(sw.fileID, fmt.Errorf("no peer has file %s", sw.fileID))
+				return
+			}
+			continue
+		}
+		receiving = true
+		if sw.manager.transferPaused(transferID(Download, sw.fileID, "")) {
+			continue
+		}
+
+		if time.Since(lastRefresh) > haveRefreshInterval {
+			lastRefresh = time.Now()
+			for _, addr := range sw.partialPeers() {
+				sw.manager.requestHave(addr, sw.fileID)
+			}
+		}
+
+		requests, alive := sw.schedule(metadata, received)
+		if !alive {
+			log.Printf("All peers of file %s stalled, download stopped", sw.fileID)
+			sw.manager.stopSwarm(sw.fileID)
+			sw.manager.directoryFileDone(sw.fileID, fmt.Errorf("all peers of file %s stalled", sw.fileID))
+			return
+		}
+		for addr, indices := range requests {
+			sw.manager.RequestChunks(addr, sw.fileID, indices)
+		}
+	}
+}
+
+// schedule reassigns stalled chunks and fills every peer's window with new
+// requests. It reports false when no peers are left.
+func (sw *swarm) schedule(metadata Metadata, received Bitmap) (map[string][]int, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	now := time.Now()
+	for index, p := range sw.pending {
+		if received.Has(index) {
+			sw.release(index)
+			continue
+		}
+		peer, ok := sw.peers[p.peer]
+		if !ok {
+			delete(sw.pending, index)
+			continue
+		}
+		if now.Sub(p.sentAt) < peer.stallTimeout(metadata.ChunkSize) {
+			continue
+		}
+		// 超时的块交给其他节点，连续超时的节点被移出
+		sw.release(index)
+		peer.stalls++
+		peer.window = max(1, peer.window/2)
+		if peer.stalls >= maxStalls {
+			log.Printf("Dropping stalled peer %s from download of %s", peer.addr, sw.fileID)
+			sw.dropPeer(peer.addr)
+		}
+	}
+	if len(sw.peers) == 0 {
+		return nil, false
+	}
+
+	candidates := []int{}
+	for _, index := range received.Missing(metadata.ChunkCount()) {
+		if _, ok := sw.pending[index]; !ok {
+			candidates = append(candidates, index)
+		}
+	}
+	if sw.strategy == RarestFirst {
+		availability := make(map[int]int, len(candidates))
+		for _, index := range candidates {
+			for _, peer := range sw.peers {
+				if peer.has(index) {
+					availability[index]++
+				}
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return availability[candidates[i]] < availability[candidates[j]]
+		})
+	}
+
+	// 吞吐量高的节点优先分配
+	peers := make([]*swarmPeer, 0, len(sw.peers))
+	for _, peer := range sw.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].rate > peers[j].rate })
+
+	requests := make(map[string][]int)
+	for _, index := range candidates {
+		for _, peer := range peers {
+			if peer.inFlight >= peer.window || !peer.has(index) {
+				continue
+			}
+			// 超出下载限速的块留到下一轮再请求
+			if !sw.manager.throttle.downloadReady(peer.addr) {
+				continue
+			}
+			sw.pending[index] = pendingChunk{peer: peer.addr, sentAt: now}
+			peer.inFlight++
+			requests[peer.addr] = append(requests[peer.addr], index)
+			break
+		}
+	}
+	return requests, true
+}
+
+// clearPending forgets the chunks requested so far, without counting them
+// as stalls, so a paused download requests them again when resumed.
+func (sw *swarm) clearPending() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for index := range sw.pending {
+		sw.release(index)
+	}
+}
+
+// setHave records the chunks a peer has, adding it to the swarm.
+func (sw *swarm) setHave(addr string, have Have) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	peer, ok := sw.peers[addr]
+	if !ok {
+		peer = &swarmPeer{addr: addr, window: initialWindow}
+		sw.peers[addr] = peer
+	}
+	peer.have = nil
+	if !have.Complete {
+		peer.have = have.Bitmap
+	}
+}
+
+// includes reports whether the peer at addr takes part in the swarm, so it
+// may fetch the chunks this node already has in return.
+func (sw *swarm) includes(addr string) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	_, ok := sw.peers[addr]
+	return ok || sw.invited[addr]
+}
+
+// partialPeers returns the peers that do not have the whole file.
+func (sw *swarm) partialPeers() []string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	addrs := []string{}
+	for addr, peer := range sw.peers {
+		if peer.have != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// chunkReceived updates the throughput estimate of the peer a chunk came from.
+func (sw *swarm) chunkReceived(addr string, index int, size int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	p, ok := sw.pending[index]
+	if !ok {
+		return
+	}
+	sw.release(index)
+	peer, ok := sw.peers[addr]
+	if !ok || p.peer != addr {
+		return
+	}
+
+	elapsed := time.Since(p.sentAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed
+	if peer.rate == 0 {
+		peer.rate = rate
+	} else {
+		peer.rate = 0.8*peer.rate + 0.2*rate
+	}
+	peer.stalls = 0
+	if size > 0 {
+		// 窗口保持约 windowLatency 的数据在途
+		window := int(peer.rate*windowLatency.Seconds())/size + 1
+		peer.window = min(maxWindow, max(1, window))
+	}
+}
+
+// chunkFailed frees a chunk that failed verification so it is scheduled again.
+func (sw *swarm) chunkFailed(addr string, index int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if _, ok := sw.pending[index]; ok {
+		sw.release(index)
+	}
+	if peer, ok := sw.peers[addr]; ok {
+		peer.window = max(1, peer.window/2)
+	}
+}
+
+// release removes a chunk from the pending set. The caller must hold sw.mu.
+func (sw *swarm) release(index int) {
+	p := sw.pending[index]
+	delete(sw.pending, index)
+	if peer, ok := sw.peers[p.peer]; ok && peer.inFlight > 0 {
+		peer.inFlight--
+	}
+}
+
+// dropPeer removes a peer and frees its pending chunks. The caller must hold sw.mu.
+func (sw *swarm) dropPeer(addr string) {
+	for index, p := range sw.pending {
+		if p.peer == addr {
+			sw.release(index)
+		}
+	}
+	delete(sw.peers, addr)
+}
+
+// has reports whether the peer can serve chunk i.
+func (p *swarmPeer) has(i int) bool {
+	return p.have == nil || p.have.Has(i)
+}
+
+// stallTimeout is how long a chunk requested from the peer may take,
+// based on its measured throughput.
+func (p *swarmPeer) stallTimeout(chunkSize int) time.Duration {
+	if p.rate <= 0 {
+		return minStallTimeout
+	}
+	expected := time.Duration(4 * float64(chunkSize) / p.rate * float64(time.Second))
+	return max(minStallTimeout, expected)
+}
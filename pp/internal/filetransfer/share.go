@@ -0,0 +1,249 @@
+package filetransfer
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFileNotFound = errors.New("not found")
+	ErrNotPermitted = errors.New("not permitted")
+)
+
+// Shares is the set of files peers may request with file_request: files
+// below the shared directories and files of the blob store listed by ID.
+// Nothing is shared by default.
+type Shares struct {
+	dirs    []string // absolute, symlink-free paths
+	fileIDs map[string]bool
+
+	mu      sync.Mutex
+	hashes  map[string]hashedFile // path -> content address, kept between scans
+	indexed map[string]string     // file ID -> name of a file in a shared directory
+}
+
+// hashedFile is the content address of a file in a shared directory, valid
+// while its size and modification time stay the same.
+type hashedFile struct {
+	size    int64
+	modTime time.Time
+	fileID  string
+	sha256  string
+}
+
+// SharedFile is a file peers may request, by its ID.
+type SharedFile struct {
+	FileID string
+	Name   string // path below its shared directory, or the stored filename
+	Size   int64
+	SHA256 string // hex SHA-256 of the whole file
+}
+
+// NewShares creates the share set from the configured directories and file
+// IDs. Directories that do not exist are skipped.
+func NewShares(dirs []string, fileIDs []string) *Shares {
+	s := &Shares{
+		fileIDs: make(map[string]bool),
+		hashes:  make(map[string]hashedFile),
+		indexed: make(map[string]string),
+	}
+	for _, dir := range dirs {
+		real, err := realPath(dir)
+		if err != nil {
+			log.Printf("Not sharing %s: %v", dir, err)
+			continue
+		}
+		s.dirs = append(s.dirs, real)
+	}
+	for _, fileID := range fileIDs {
+		if !ValidFileID(fileID) {
+			log.Printf("Not sharing %q: %v", fileID, ErrInvalidFileID)
+			continue
+		}
+		s.fileIDs[fileID] = true
+	}
+	return s
+}
+
+// resolve maps a name requested by a peer to a file below a shared
+// directory. The name must be relative and stay inside the directory, also
+// after following symlinks.
+func (s *Shares) resolve(name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", ErrNotPermitted
+	}
+	for _, part := range strings.FieldsFunc(name, isPathSeparator) {
+		if part == ".." {
+			return "", ErrNotPermitted
+		}
+	}
+
+	for _, dir := range s.dirs {
+		real, err := realPath(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// 符号链接可能指向共享目录之外
+		if !within(dir, real) {
+			return "", ErrNotPermitted
+		}
+		info, err := os.Stat(real)
+		if err != nil {
+			return "", err
+		}
+		// 目录作为整体发送，见 SendDirectory
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return "", ErrNotPermitted
+		}
+		return real, nil
+	}
+	return "", ErrFileNotFound
+}
+
+// scan lists the files in the shared directories with their content
+// addresses. Symlinks are not followed.
+func (s *Shares) scan() []SharedFile {
+	files := []SharedFile{}
+	hashes := make(map[string]hashedFile)
+	indexed := make(map[string]string)
+	for _, dir := range s.dirs {
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("Error scanning shared directory: %v", err)
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+
+			// 只有大小或修改时间变化的文件才重新计算哈希
+			s.mu.Lock()
+			hashed, ok := s.hashes[path]
+			s.mu.Unlock()
+			if !ok || hashed.size != info.Size() || !hashed.modTime.Equal(info.ModTime()) {
+				sum, chunkHashes, err := hashFile(path, DefaultChunkSize)
+				if err != nil {
+					log.Printf("Error hashing shared file %s: %v", path, err)
+					return nil
+				}
+				hashed = hashedFile{size: info.Size(), modTime: info.ModTime(), fileID: contentID(info.Size(), sum, chunkHashes), sha256: sum}
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			name := filepath.ToSlash(rel)
+			hashes[path] = hashed
+			indexed[hashed.fileID] = name
+			files = append(files, SharedFile{FileID: hashed.fileID, Name: name, Size: hashed.size, SHA256: hashed.sha256})
+			return nil
+		})
+	}
+
+	s.mu.Lock()
+	s.hashes = hashes
+	s.indexed = indexed
+	s.mu.Unlock()
+	return files
+}
+
+// indexedName returns the name of a file found by the last scan.
+func (s *Shares) indexedName(fileID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.indexed[fileID]
+	return name, ok
+}
+
+// SharedFiles lists every file peers may request: the files in the shared
+// directories, which are hashed on first sight, and the shared files of the
+// blob store.
+func (m *Manager) SharedFiles() []SharedFile {
+	files := m.shares.scan()
+	for fileID := range m.shares.fileIDs {
+		if !m.HasFile(fileID) {
+			continue
+		}
+		metadata, err := m.GetMetadata(fileID)
+		if err != nil {
+			continue
+		}
+		files = append(files, SharedFile{FileID: fileID, Name: metadata.Filename, Size: metadata.FileSize, SHA256: metadata.SHA256})
+	}
+	return files
+}
+
+// ResolveRequest maps the name in a file_request to what to send: the path
+// of a file or directory, or the ID of a file in the blob store. The name is
+// either a path relative to a shared directory or the ID of a shared file,
+// in the blob store or found in a shared directory by the last SharedFiles
+// call.
+func (m *Manager) ResolveRequest(name string) (string, error) {
+	if ValidFileID(name) {
+		if indexed, ok := m.shares.indexedName(name); ok {
+			return m.shares.resolve(indexed)
+		}
+		if !m.shares.fileIDs[name] {
+			return "", ErrNotPermitted
+		}
+		if !m.HasFile(name) {
+			return "", ErrFileNotFound
+		}
+		return name, nil
+	}
+	return m.shares.resolve(name)
+}
+
+// permitted reports whether the peer at addr may fetch chunks of a file:
+// a shared file, a file offered to the peer or a file the peer takes part
+// in a swarm download of with this node.
+func (m *Manager) permitted(addr string, fileID string) bool {
+	if m.shares.fileIDs[fileID] {
+		return true
+	}
+	if _, ok := m.shares.indexedName(fileID); ok {
+		return true
+	}
+	if m.offeredTo(addr, fileID) {
+		return true
+	}
+	sw, ok := m.swarm(fileID)
+	return ok && sw.includes(addr)
+}
+
+// realPath returns the absolute path of path with all symlinks resolved.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// within reports whether path is dir or below it.
+func within(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isPathSeparator accepts both separators so a name written for another
+// operating system cannot sneak in a "..".
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
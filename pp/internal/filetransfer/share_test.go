@@ -0,0 +1,71 @@
+package filetransfer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharesResolve(t *testing.T) {
+	root := t.TempDir()
+	shared := filepath.Join(root, "shared")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(shared, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(shared, "a.txt"), filepath.Join(shared, "sub", "b.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 指向共享目录之外和之内的符号链接
+	links := map[string]string{
+		filepath.Join(shared, "escape.txt"):    filepath.Join(outside, "secret.txt"),
+		filepath.Join(shared, "escape"):        outside,
+		filepath.Join(shared, "sub", "up.txt"): filepath.Join("..", "..", "outside", "secret.txt"),
+		filepath.Join(shared, "inside.txt"):    filepath.Join(shared, "sub", "b.txt"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	s := NewShares([]string{shared}, nil)
+	real := func(name string) string {
+		path, err := realPath(filepath.Join(shared, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"a.txt", real("a.txt"), nil},
+		{"sub/b.txt", real("sub/b.txt"), nil},
+		{"sub", real("sub"), nil},
+		{"inside.txt", real("sub/b.txt"), nil},
+
+		{"", "", ErrNotPermitted},
+		{"../outside/secret.txt", "", ErrNotPermitted},
+		{"sub/../../outside/secret.txt", "", ErrNotPermitted},
+		{`sub\..\..\outside\secret.txt`, "", ErrNotPermitted},
+		{filepath.Join(outside, "secret.txt"), "", ErrNotPermitted},
+		{"escape.txt", "", ErrNotPermitted},
+		{"escape/secret.txt", "", ErrNotPermitted},
+		{"sub/up.txt", "", ErrNotPermitted},
+		{"missing.txt", "", ErrFileNotFound},
+	}
+	for _, tt := range tests {
+		got, err := s.resolve(tt.name)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("resolve(%q) = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+﻿package filetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transferStateExt is the extension of the per-transfer state files in the incoming directory.
+const transferStateExt = ".transfer"
+
+// Bitmap records which chunks of a file have been received.
+type Bitmap []byte
+
+// NewBitmap creates a Bitmap for n chunks.
+func NewBitmap(n int) Bitmap {
+	return make(Bitmap, (n+7)/8)
+}
+
+// Set marks chunk i as received.
+func (b Bitmap) Set(i int) {
+	b[i/8] |= 1 << (i % 8)
+}
+
+// Has reports whether chunk i has been received.
+func (b Bitmap) Has(i int) bool {
+	return i/8 < len(b) && b[i/8]&(1<<(i%8)) != 0
+}
+
+// Missing returns the indices of the first n chunks that have not been received.
+func (b Bitmap) Missing(n int) []int {
+	missing := []int{}
+	for i := 0; i < n; i++ {
+		if !b.Has(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// Source identifies a peer a file is being received from.
+type Source struct {
+	NodeID     string `json:"node_id,omitempty"`
+	ListenAddr string `json:"listen_addr,omitempty"`
+}
+
+// transferState is what is persisted about an incoming transfer, so it can
+// be resumed after a restart.
+type transferState struct {
+	Metadata Metadata `json:"metadata"`
+	Received Bitmap   `json:"received"`
+	Sources  []Source `json:"sources"`
+}
+
+// Resumable describes an incomplete transfer found on startup. For a
+// directory, FileID is the ID of its manifest and the download continues
+// with ResumeDirectory.
+type Resumable struct {
+	FileID    string
+	Missing   []int
+	Sources   []Source
+	Directory bool
+}
+
+// ResumeTransfers reloads the incomplete transfers recorded in the data
+// directory and returns the chunks each of them still needs.
+func (m *Manager) ResumeTransfers() []Resumable {
+	entries, err := os.ReadDir(filepath.Join(m.dataDir, incomingDir))
+	if err != nil {
+		log.Printf("Error reading data directory: %v", err)
+		return nil
+	}
+
+	resumable := []Resumable{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), transferStateExt) {
+			continue
+		}
+		fileID := strings.TrimSuffix(entry.Name(), transferStateExt)
+		if !ValidFileID(fileID) {
+			continue
+		}
+		state, err := m.loadState(fileID)
+		if err == nil && state.Metadata.FileID != fileID {
+			err = fmt.Errorf("state belongs to file %s", state.Metadata.FileID)
+		}
+		if err == nil && state.Metadata.ChunkSize != DefaultChunkSize {
+			err = fmt.Errorf("unsupported chunk size %d", state.Metadata.ChunkSize)
+		}
+		if err != nil {
+			log.Printf("Skipping transfer state %s: %v", entry.Name(), err)
+			continue
+		}
+		// 没有 .part 文件就无法续传
+		if _, err := os.Stat(m.partialPath(state.Metadata.FileID)); err != nil {
+			log.Printf("Skipping transfer %s: partial file missing", state.Metadata.FileID)
+			os.Remove(m.statePath(state.Metadata.FileID))
+			continue
+		}
+
+		missing := state.Received.Missing(state.Metadata.ChunkCount())
+		m.mu.Lock()
+		m.incoming[state.Metadata.FileID] = &incomingFile{
+			metadata: state.Metadata,
+			received: state.Received,
+			count:    state.Metadata.ChunkCount() - len(missing),
+			retries:  make(map[int]int),
+			sources:  state.Sources,
+		}
+		m.mu.Unlock()
+
+		var done int64
+		for i := 0; i < state.Metadata.ChunkCount(); i++ {
+			if state.Received.Has(i) {
+				done += state.Metadata.ChunkLength(i)
+			}
+		}
+		m.startTransfer(Download, state.Metadata, "", state.Metadata.FileSize, done, Queued)
+
+		resumable = append(resumable, Resumable{
+			FileID:  state.Metadata.FileID,
+			Missing: missing,
+			Sources: state.Sources,
+		})
+	}
+	return append(resumable, m.resumeDirectories()...)
+}
+
+// saveState persists the state of an incoming transfer. Callers must hold m.mu.
+func (m *Manager) saveState(in *incomingFile) error {
+	in.savedAt = time.Now()
+	state := transferState{
+		Metadata: in.metadata,
+		Received: in.received,
+		Sources:  in.sources,
+	}
+	return writeJSONFile(m.statePath(in.metadata.FileID), state)
+}
+
+// Close waits for received files to be finalized, then saves the state of
+// every incoming transfer and closes their partial files, so the transfers
+// resume where they stopped.
+func (m *Manager) Close() {
+	m.finalizers.Wait()
+	m.mu.Lock()
+	for fileID, in := range m.incoming {
+		if err := m.saveState(in); err != nil {
+			log.Printf("Error saving transfer state for %s: %v", fileID, err)
+		}
+	}
+	if m.offersDirty {
+		m.saveOffers(true)
+	}
+	m.mu.Unlock()
+	m.handles.closeAll()
+}
+
+// loadState reads the persisted state of an incoming transfer.
+func (m *Manager) loadState(fileID string) (transferState, error) {
+	var state transferState
+	data, err := os.ReadFile(m.statePath(fileID))
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if len(state.Received) != len(NewBitmap(state.Metadata.ChunkCount())) {
+		state.Received = NewBitmap(state.Metadata.ChunkCount())
+	}
+	return state, nil
+}
+
+// statePath returns the path of the state file of an incoming transfer.
+func (m *Manager) statePath(fileID string) string {
+	return filepath.Join(m.dataDir, incomingDir, fileID+transferStateExt)
+}
+
+// writeJSONFile writes v to path through a temporary file, so readers never
+// see a half-written file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
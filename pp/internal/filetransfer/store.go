@@ -0,0 +1,179 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Files are stored by content: a file's ID is the hex SHA-256 of its size,
+// whole-file hash and chunk hashes (see contentID), so the same ID names the
+// same bytes on every node. Complete files live in
+// a BlobStore; the default LocalStore shards them by the first two
+// characters of the ID:
+//
+//	<data_dir>/blobs/ab/ab12...ef           file data
+//	<data_dir>/blobs/ab/ab12...ef.metadata  metadata, including the filename
+//	<data_dir>/incoming/ab12...ef.part      data of an incomplete transfer
+const (
+	blobsDir    = "blobs"
+	incomingDir = "incoming"
+	metadataExt = ".metadata"
+	tmpExt      = ".tmp"
+)
+
+var ErrInvalidFileID = errors.New("invalid file ID")
+
+// ValidFileID reports whether id looks like a content address, a lowercase
+// hex SHA-256.
+func ValidFileID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFileID returns ErrInvalidFileID for IDs that are not content
+// addresses. IDs come from the network, so they are checked before being
+// used in a path.
+func checkFileID(fileID string) error {
+	if !ValidFileID(fileID) {
+		return fmt.Errorf("%w: %q", ErrInvalidFileID, fileID)
+	}
+	return nil
+}
+
+// metadataKey returns the key the metadata of a file is stored under.
+func metadataKey(fileID string) string {
+	return fileID + metadataExt
+}
+
+// SetBlobStore replaces the store complete files are kept in, the local
+// directory <data_dir>/blobs by default. It must be called before the
+// Manager is used.
+func (m *Manager) SetBlobStore(store BlobStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store = store
+}
+
+// HasFile reports whether the blob store holds the complete file fileID.
+func (m *Manager) HasFile(fileID string) bool {
+	if !ValidFileID(fileID) {
+		return false
+	}
+	_, err := m.store.Stat(fileID)
+	return err == nil
+}
+
+// storeBlob moves the verified file at path into the blob store. Local
+// stores flush the data to disk before renaming the file into place, so a
+// blob is never seen, not even after a crash, before all of it is written;
+// other stores get a copy. When the content is already stored the file is
+// dropped instead.
+func (m *Manager) storeBlob(path string, fileID string) error {
+	// 相同内容只保存一份
+	if m.HasFile(fileID) {
+		m.touch(fileID)
+		return os.Remove(path)
+	}
+	if mover, ok := m.store.(blobMover); ok {
+		return mover.moveIn(fileID, path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = m.store.Put(fileID, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// chunkReader reads the chunks of a file being served.
+type chunkReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openBlob opens a stored file for reading chunks.
+func (m *Manager) openBlob(fileID string) (chunkReader, error) {
+	if opener, ok := m.store.(blobOpener); ok {
+		return opener.open(fileID)
+	}
+	if _, err := m.store.Stat(fileID); err != nil {
+		return nil, err
+	}
+	return storeReaderAt{store: m.store, key: fileID}, nil
+}
+
+// storeReaderAt reads a blob with one ranged Get per read.
+type storeReaderAt struct {
+	store BlobStore
+	key   string
+}
+
+func (r storeReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	body, err := r.store.Get(r.key, offset, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r storeReaderAt) Close() error {
+	return nil
+}
+
+// localBlobPath returns the path of a stored file, or "" when the store is
+// not on the local filesystem.
+func (m *Manager) localBlobPath(fileID string) string {
+	if local, ok := m.store.(*LocalStore); ok {
+		return local.path(fileID)
+	}
+	return ""
+}
+
+// touch records that a stored file was used, for LRU eviction.
+func (m *Manager) touch(fileID string) {
+	if toucher, ok := m.store.(blobToucher); ok {
+		toucher.touch(fileID)
+	}
+}
+
+// syncFile flushes the file at path to disk.
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes a directory to disk, making renames into it durable.
+// Not every platform can sync a directory, so failures are ignored.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	file.Sync()
+	return file.Close()
+}
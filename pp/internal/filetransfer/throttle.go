@@ -0,0 +1,119 @@
+package filetransfer
+
+import (
+	"sync"
+	"time"
+
+	"pp/internal/ratelimit"
+)
+
+// Limits are bandwidth limits for file traffic in bytes per second, for
+// all peers together and for each peer. Zero means unlimited.
+//
+// Only file chunks are throttled. Uploads wait for tokens before a chunk is
+// handed to the network. Received chunks are charged to the download
+// buckets; when they run into debt, the acknowledgement asks the sender to
+// hold back further chunks until the debt is paid, and swarm downloads
+// request no more chunks. Control messages such as ping and chat do not
+// pass through the buckets, but share the connection with chunks, so they
+// can still queue behind chunks already handed to the network.
+type Limits struct {
+	Upload       int64 `json:"upload"`
+	Download     int64 `json:"download"`
+	PeerUpload   int64 `json:"peer_upload"`
+	PeerDownload int64 `json:"peer_download"`
+}
+
+// throttle holds the token buckets that enforce Limits.
+type throttle struct {
+	mu           sync.Mutex
+	limits       Limits
+	upload       *ratelimit.Bucket
+	download     *ratelimit.Bucket
+	peerUpload   map[string]*ratelimit.Bucket
+	peerDownload map[string]*ratelimit.Bucket
+}
+
+func newThrottle(limits Limits) *throttle {
+	return &throttle{
+		limits:       limits,
+		upload:       ratelimit.NewBucket(limits.Upload, limits.Upload),
+		download:     ratelimit.NewBucket(limits.Download, limits.Download),
+		peerUpload:   make(map[string]*ratelimit.Bucket),
+		peerDownload: make(map[string]*ratelimit.Bucket),
+	}
+}
+
+// SetLimits changes the bandwidth limits of file traffic at runtime.
+func (m *Manager) SetLimits(limits Limits) {
+	t := m.throttle
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limits = limits
+	t.upload.SetRate(limits.Upload, limits.Upload)
+	t.download.SetRate(limits.Download, limits.Download)
+	for _, b := range t.peerUpload {
+		b.SetRate(limits.PeerUpload, limits.PeerUpload)
+	}
+	for _, b := range t.peerDownload {
+		b.SetRate(limits.PeerDownload, limits.PeerDownload)
+	}
+}
+
+// Limits returns the current bandwidth limits of file traffic.
+func (m *Manager) Limits() Limits {
+	m.throttle.mu.Lock()
+	defer m.throttle.mu.Unlock()
+	return m.throttle.limits
+}
+
+// PeerDisconnected drops the per-peer buckets of a peer.
+func (m *Manager) PeerDisconnected(addr string) {
+	t := m.throttle
+	t.mu.Lock()
+	delete(t.peerUpload, addr)
+	delete(t.peerDownload, addr)
+	t.mu.Unlock()
+}
+
+// waitUpload blocks until n bytes may be sent to addr.
+func (t *throttle) waitUpload(addr string, n int) {
+	upload, _ := t.peerBuckets(addr)
+	upload.Wait(n)
+	t.upload.Wait(n)
+}
+
+// reserveDownload charges n bytes received from addr to the download
+// buckets and returns how long the sender should hold back more chunks.
+func (t *throttle) reserveDownload(addr string, n int) time.Duration {
+	_, download := t.peerBuckets(addr)
+	return max(download.Reserve(n), t.download.Reserve(n))
+}
+
+// downloadReady reports whether more chunks may be requested from addr now.
+// The per-peer bucket is asked first; neither spends tokens, as chunks are
+// charged when they arrive.
+func (t *throttle) downloadReady(addr string) bool {
+	_, download := t.peerBuckets(addr)
+	return download.Ready() && t.download.Ready()
+}
+
+// peerBuckets returns the upload and download buckets of addr, creating
+// them with the current per-peer limits.
+func (t *throttle) peerBuckets(addr string) (*ratelimit.Bucket, *ratelimit.Bucket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upload, ok := t.peerUpload[addr]
+	if !ok {
+		upload = ratelimit.NewBucket(t.limits.PeerUpload, t.limits.PeerUpload)
+		t.peerUpload[addr] = upload
+	}
+	download, ok := t.peerDownload[addr]
+	if !ok {
+		download = ratelimit.NewBucket(t.limits.PeerDownload, t.limits.PeerDownload)
+		t.peerDownload[addr] = download
+	}
+	return upload, download
+}
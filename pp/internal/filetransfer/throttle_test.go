@@ -0,0 +1,54 @@
+package filetransfer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownloadThrottle(t *testing.T) {
+	th := newThrottle(Limits{Download: 1000, PeerDownload: 100})
+
+	// 单个节点超出限速不应消耗其他节点的全局额度
+	if backoff := th.reserveDownload("a", 60); backoff != 0 {
+		t.Fatalf("backoff within the burst = %v", backoff)
+	}
+	backoff := th.reserveDownload("a", 90)
+	if backoff < 400*time.Millisecond || backoff > 500*time.Millisecond {
+		t.Fatalf("backoff = %v, want about 500ms", backoff)
+	}
+	for i := 0; i < 10; i++ {
+		if th.downloadReady("a") {
+			t.Fatal("peer a ready while in debt")
+		}
+	}
+	if !th.downloadReady("b") {
+		t.Fatal("peer b held back by peer a")
+	}
+	if backoff := th.reserveDownload("a", 0); backoff <= 0 {
+		t.Fatal("no backoff while in debt")
+	}
+
+	unlimited := newThrottle(Limits{})
+	if backoff := unlimited.reserveDownload("a", 1<<30); backoff != 0 || !unlimited.downloadReady("a") {
+		t.Fatalf("unlimited throttle held back downloads: %v", backoff)
+	}
+}
+
+func TestWindowHold(t *testing.T) {
+	w := newSendWindow()
+	if w.held() {
+		t.Fatal("new window held")
+	}
+	w.hold(50 * time.Millisecond)
+	if !w.held() {
+		t.Fatal("window not held")
+	}
+	start := time.Now()
+	w.wait(nil)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > windowPoll/2 {
+		t.Fatalf("wait returned after %v, want about 50ms", elapsed)
+	}
+	if w.held() {
+		t.Fatal("window still held")
+	}
+}
@@ -0,0 +1,408 @@
+package filetransfer
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"pp/internal/events"
+)
+
+// State is the state of a transfer.
+type State string
+
+const (
+	Queued    State = "queued"
+	Active    State = "active"
+	Paused    State = "paused"
+	Completed State = "completed"
+	Failed    State = "failed"
+)
+
+// Direction tells uploads from downloads.
+type Direction string
+
+const (
+	Upload   Direction = "upload"
+	Download Direction = "download"
+)
+
+const (
+	// progressInterval limits how often progress events are published for
+	// one transfer. State changes are always published.
+	progressInterval = 500 * time.Millisecond
+	// rateInterval is the sampling period of the transfer rate.
+	rateInterval = time.Second
+	// maxFinishedTransfers is how many completed or failed transfers List
+	// keeps reporting.
+	maxFinishedTransfers = 100
+)
+
+var (
+	ErrUnknownTransfer  = errors.New("unknown transfer")
+	ErrTransferFinished = errors.New("transfer already finished")
+	ErrCancelled        = errors.New("cancelled")
+)
+
+// Transfer is a snapshot of an upload or download.
+type Transfer struct {
+	ID        string        `json:"id"`
+	FileID    string        `json:"file_id"`
+	Filename  string        `json:"filename"`
+	Direction Direction     `json:"direction"`
+	Peer      string        `json:"peer"` // address of the last peer data came from or went to
+	State     State         `json:"state"`
+	Size      int64         `json:"size"`
+	Done      int64         `json:"done"`
+	Rate      float64       `json:"rate"` // bytes per second
+	ETA       time.Duration `json:"eta"`
+	Error     string        `json:"error,omitempty"`
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished,omitempty"`
+}
+
+// transfer is the tracked state behind a Transfer.
+type transfer struct {
+	Transfer
+	lastPublish time.Time
+	sampleAt    time.Time
+	sampleBytes int64
+	resumeCh    chan struct{} // closed while the transfer is not paused
+	batches     int           // chunk batches of an upload still being sent
+}
+
+// transferID returns the ID of the download of a file, or of its upload to addr.
+func transferID(direction Direction, fileID string, addr string) string {
+	if direction == Download {
+		return string(Download) + "/" + fileID
+	}
+	return string(Upload) + "/" + fileID + "/" + addr
+}
+
+// List returns all transfers, oldest first.
+func (m *Manager) List() []Transfer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]Transfer, 0, len(m.transfers))
+	for _, t := range m.transfers {
+		list = append(list, t.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// Pause stops a transfer until Resume is called. A paused upload sends no
+// more chunks; a paused download requests none and drops the chunks that
+// still arrive.
+func (m *Manager) Pause(id string) error {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrUnknownTransfer
+	}
+	if t.finished() {
+		m.mu.Unlock()
+		return ErrTransferFinished
+	}
+	if t.State != Paused {
+		t.State = Paused
+		t.Rate, t.ETA = 0, 0
+		t.resumeCh = make(chan struct{})
+	}
+	snapshot := t.snapshot()
+	sw := m.swarms[t.FileID]
+	m.mu.Unlock()
+
+	if sw != nil && t.Direction == Download {
+		sw.clearPending()
+	}
+	m.publishTransfer(snapshot)
+	// 暂停目录下载时也暂停正在接收的文件
+	if current, ok := m.directoryFile(snapshot.FileID); ok && current != "" && snapshot.Direction == Download {
+		m.Pause(transferID(Download, current, ""))
+	}
+	return nil
+}
+
+// Resume continues a paused transfer. A download that is not a swarm
+// download asks the peer it came from for the missing chunks.
+func (m *Manager) Resume(id string) error {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrUnknownTransfer
+	}
+	if t.State != Paused {
+		m.mu.Unlock()
+		return nil
+	}
+	t.State = Active
+	t.sampleAt, t.sampleBytes = time.Now(), t.Done
+	close(t.resumeCh)
+	snapshot := t.snapshot()
+	_, swarming := m.swarms[t.FileID]
+	var missing []int
+	if in, ok := m.incoming[t.FileID]; ok {
+		missing = in.received.Missing(in.metadata.ChunkCount())
+	}
+	m.mu.Unlock()
+
+	m.publishTransfer(snapshot)
+	if t.Direction == Download && !swarming && snapshot.Peer != "" && len(missing) > 0 {
+		m.RequestChunks(snapshot.Peer, snapshot.FileID, missing)
+	}
+	if current, ok := m.directoryFile(snapshot.FileID); ok && snapshot.Direction == Download {
+		if current != "" {
+			m.Resume(transferID(Download, current, ""))
+		}
+		m.nextDirectoryFile(snapshot.FileID)
+	}
+	return nil
+}
+
+// Cancel stops a transfer for good. A cancelled download is deleted.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrUnknownTransfer
+	}
+	if t.finished() {
+		m.mu.Unlock()
+		return ErrTransferFinished
+	}
+	direction, fileID := t.Direction, t.FileID
+	m.mu.Unlock()
+
+	if direction == Download {
+		m.abort(fileID, ErrCancelled)
+		return nil
+	}
+	m.finishTransfer(id, ErrCancelled)
+	return nil
+}
+
+// startTransfer begins tracking the transfer of size bytes of a file, or
+// restarts a finished one with the same ID. Uploads count their chunk
+// batches: each call must be matched by a call to endUpload, and a batch
+// sent while another is in flight adds to its size.
+func (m *Manager) startTransfer(direction Direction, metadata Metadata, addr string, size int64, done int64, state State) {
+	id := transferID(direction, metadata.FileID, addr)
+	now := time.Now()
+
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if ok && !t.finished() {
+		if direction == Upload {
+			t.Size += size
+			t.batches++
+		}
+		m.mu.Unlock()
+		return
+	}
+	t = &transfer{
+		Transfer: Transfer{
+			ID:        id,
+			FileID:    metadata.FileID,
+			Filename:  metadata.Filename,
+			Direction: direction,
+			Peer:      addr,
+			State:     state,
+			Size:      size,
+			Done:      done,
+			Started:   now,
+		},
+		lastPublish: now,
+		sampleAt:    now,
+		sampleBytes: done,
+		resumeCh:    make(chan struct{}),
+	}
+	if direction == Upload {
+		t.batches = 1
+	}
+	close(t.resumeCh)
+	m.transfers[id] = t
+	snapshot := t.snapshot()
+	m.mu.Unlock()
+
+	m.publishTransfer(snapshot)
+}
+
+// addProgress records n more bytes of a transfer, moved from or to addr.
+func (m *Manager) addProgress(id string, addr string, n int) {
+	now := time.Now()
+
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok || t.State == Paused || t.finished() {
+		m.mu.Unlock()
+		return
+	}
+
+	changed := t.State != Active
+	t.State = Active
+	if addr != "" {
+		t.Peer = addr
+	}
+	t.Done = min(t.Size, t.Done+int64(n))
+	if elapsed := now.Sub(t.sampleAt); elapsed >= rateInterval {
+		rate := float64(t.Done-t.sampleBytes) / elapsed.Seconds()
+		if t.Rate == 0 {
+			t.Rate = rate
+		} else {
+			t.Rate = 0.7*t.Rate + 0.3*rate
+		}
+		t.sampleAt, t.sampleBytes = now, t.Done
+	}
+	if t.Rate > 0 {
+		t.ETA = time.Duration(float64(t.Size-t.Done) / t.Rate * float64(time.Second))
+	}
+	publish := changed || now.Sub(t.lastPublish) >= progressInterval
+	if publish {
+		t.lastPublish = now
+	}
+	snapshot := t.snapshot()
+	m.mu.Unlock()
+
+	if publish {
+		m.publishTransfer(snapshot)
+	}
+}
+
+// endUpload ends a chunk batch of an upload. The upload fails with the
+// first error and completes when its last batch has been sent.
+func (m *Manager) endUpload(id string, err error) {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if ok && t.batches > 0 {
+		t.batches--
+	}
+	last := ok && t.batches == 0
+	m.mu.Unlock()
+
+	if err != nil || last {
+		m.finishTransfer(id, err)
+	}
+}
+
+// finishTransfer marks a transfer completed, or failed when err is set.
+func (m *Manager) finishTransfer(id string, err error) {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok || t.finished() {
+		m.mu.Unlock()
+		return
+	}
+	if err != nil {
+		t.State = Failed
+		t.Error = err.Error()
+	} else {
+		t.State = Completed
+		t.Done = t.Size
+	}
+	t.Rate, t.ETA = 0, 0
+	t.Finished = time.Now()
+	// 唤醒等待中的暂停上传，让其退出
+	select {
+	case <-t.resumeCh:
+	default:
+		close(t.resumeCh)
+	}
+	snapshot := t.snapshot()
+	m.pruneTransfers()
+	m.mu.Unlock()
+
+	m.publishTransfer(snapshot)
+	if snapshot.Direction == Download {
+		m.directoryFileDone(snapshot.FileID, err)
+	}
+}
+
+// transferPeer returns the peer a transfer last moved data with.
+func (m *Manager) transferPeer(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.transfers[id]; ok {
+		return t.Peer
+	}
+	return ""
+}
+
+// waitTransfer blocks while a transfer is paused. It returns ErrCancelled
+// once the transfer has been cancelled.
+func (m *Manager) waitTransfer(id string) error {
+	for {
+		m.mu.Lock()
+		t, ok := m.transfers[id]
+		if !ok {
+			m.mu.Unlock()
+			return nil
+		}
+		state, resumeCh := t.State, t.resumeCh
+		m.mu.Unlock()
+
+		switch state {
+		case Paused:
+			<-resumeCh
+		case Failed:
+			return ErrCancelled
+		default:
+			return nil
+		}
+	}
+}
+
+// transferPaused reports whether a transfer is paused.
+func (m *Manager) transferPaused(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.transfers[id]
+	return ok && t.State == Paused
+}
+
+// pruneTransfers forgets the oldest finished transfers beyond
+// maxFinishedTransfers. The caller must hold m.mu.
+func (m *Manager) pruneTransfers() {
+	finished := []*transfer{}
+	for _, t := range m.transfers {
+		if t.finished() {
+			finished = append(finished, t)
+		}
+	}
+	if len(finished) <= maxFinishedTransfers {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(finished[j].Finished) })
+	for _, t := range finished[:len(finished)-maxFinishedTransfers] {
+		delete(m.transfers, t.ID)
+	}
+}
+
+// publishTransfer publishes a TransferProgressEvent. It must be called
+// without holding m.mu, since handlers may call back into the Manager.
+func (m *Manager) publishTransfer(snapshot Transfer) {
+	m.eventManager.Publish(events.TransferProgressEvent{EventData: events.TransferProgressEventData{Transfer: snapshot}})
+}
+
+// publishCompleted publishes a FileCompletedEvent for a file that has just
+// been stored. Like publishTransfer it must be called without holding m.mu.
+func (m *Manager) publishCompleted(metadata Metadata) {
+	m.eventManager.Publish(events.FileCompletedEvent{EventData: events.FileCompletedEventData{
+		FileID:   metadata.FileID,
+		Filename: metadata.Filename,
+		Size:     metadata.FileSize,
+		Path:     m.localBlobPath(metadata.FileID),
+	}})
+}
+
+func (t *transfer) snapshot() Transfer {
+	return t.Transfer
+}
+
+func (t *transfer) finished() bool {
+	return t.State == Completed || t.State == Failed
+}
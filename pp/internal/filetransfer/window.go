@@ -0,0 +1,381 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"pp/internal/message"
+)
+
+// Chunks are streamed with a sliding window. The receiver acknowledges every
+// chunk it gets with a file_chunk_ack, and the sender keeps at most cwnd
+// chunks of an upload unacknowledged. Chunks not acknowledged within the
+// retransmission timeout are sent again.
+//
+// The window grows by one chunk per acknowledged chunk until the first loss,
+// then by one chunk per window, and stops growing while the round trip time
+// is well above the lowest seen, since chunks are then queueing up. A
+// timeout halves the window and doubles the timeout. The timeout itself
+// follows the smoothed round trip time.
+const (
+	initialSendWindow = 2
+	maxSendWindow     = 32
+	initialRTO        = 5 * time.Second
+	minRTO            = time.Second
+	maxRTO            = time.Minute
+	// maxRetransmits is how many times an unacknowledged chunk is sent
+	// again before the upload fails.
+	maxRetransmits = 4
+	// windowPoll bounds how long an upload waits for acknowledgements
+	// before checking whether it was paused or cancelled.
+	windowPoll = time.Second
+)
+
+// ErrNotAcknowledged fails an upload whose peer stopped acknowledging chunks.
+var ErrNotAcknowledged = errors.New("not acknowledged")
+
+// sendWindow is the congestion window of one upload. Chunk batches of the
+// same upload share it.
+type sendWindow struct {
+	mu       sync.Mutex
+	cwnd     float64
+	ssthresh float64
+	srtt     time.Duration
+	rttvar   time.Duration
+	minRTT   time.Duration
+	rto      time.Duration
+	inFlight map[int]*flightChunk
+	changed  chan struct{} // closed and replaced whenever chunks leave the window
+	batches  int
+	heldTill time.Time // no new chunks are sent before, as the receiver asked
+}
+
+// flightChunk is a chunk sent and not yet acknowledged.
+type flightChunk struct {
+	length int64
+	sentAt time.Time
+	sends  int
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{
+		cwnd:     initialSendWindow,
+		ssthresh: maxSendWindow,
+		rto:      initialRTO,
+		inFlight: make(map[int]*flightChunk),
+		changed:  make(chan struct{}),
+	}
+}
+
+// AckChunk acknowledges a chunk received from the peer at addr.
+func (m *Manager) AckChunk(addr string, fileID string, chunkIndex int) {
+	m.ackChunk(addr, fileID, chunkIndex, 0)
+}
+
+// ackChunk acknowledges a chunk and asks the sender to wait for backoff
+// before sending more.
+func (m *Manager) ackChunk(addr string, fileID string, chunkIndex int, backoff time.Duration) {
+	ack := ChunkAck{FileID: fileID, ChunkIndices: []int{chunkIndex}, Backoff: backoff.Milliseconds()}
+	m.send(addr, message.Message{Type: "file_chunk_ack", Data: ack, Sender: m.serverAddr})
+}
+
+// HandleAck records the chunks of an upload the peer at addr acknowledged,
+// making room in the window for more.
+func (m *Manager) HandleAck(addr string, ack ChunkAck) {
+	m.delivered(addr, ack.FileID, ack.ChunkIndices)
+
+	uploadID := transferID(Upload, ack.FileID, addr)
+	m.mu.Lock()
+	w, ok := m.windows[uploadID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, index := range ack.ChunkIndices {
+		if length, ok := w.ack(index); ok {
+			m.addProgress(uploadID, addr, int(length))
+		}
+	}
+	if ack.Backoff > 0 {
+		w.hold(min(time.Duration(ack.Backoff)*time.Millisecond, maxRTO))
+	}
+}
+
+// acquireWindow returns the window of an upload, creating it for the first
+// batch. Each call must be matched by a call to releaseWindow.
+func (m *Manager) acquireWindow(uploadID string) *sendWindow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[uploadID]
+	if !ok {
+		w = newSendWindow()
+		m.windows[uploadID] = w
+	}
+	w.batches++
+	return w
+}
+
+// releaseWindow drops the window of an upload after its last batch.
+func (m *Manager) releaseWindow(uploadID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[uploadID]
+	if !ok {
+		return
+	}
+	w.batches--
+	if w.batches <= 0 {
+		delete(m.windows, uploadID)
+	}
+}
+
+// streamChunks sends chunks of a file through the window of an upload and
+// returns once all of them have been acknowledged.
+func (m *Manager) streamChunks(addr string, file io.ReaderAt, metadata Metadata, indices []int, w *sendWindow, uploadID string) error {
+	framed := m.binaryChunks(addr)
+	buf := getBuffer(metadata.ChunkSize)
+	defer putBuffer(buf)
+	sendChunk := func(index int) error {
+		if framed {
+			return m.sendChunkFrame(addr, file, metadata, index, w)
+		}
+		offset := metadata.ChunkOffset(index)
+		length := metadata.ChunkLength(index)
+		if _, err := file.ReadAt(buf[:length], offset); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", index, err)
+		}
+		data, encoding := m.encodeChunkData(addr, buf[:length])
+		m.throttle.waitUpload(addr, len(data))
+		w.sent(index)
+		chunk := Chunk{
+			FileID:     metadata.FileID,
+			ChunkIndex: index,
+			Offset:     offset,
+			ChunkData:  data,
+			Encoding:   encoding,
+		}
+		m.send(addr, message.Message{Type: "file_chunk", Data: chunk, Sender: m.serverAddr})
+		return nil
+	}
+
+	queue := indices
+	sent := []int{} // 本批已发送、尚未确认的块
+	defer func() { w.forget(sent) }()
+	for {
+		if err := m.waitTransfer(uploadID); err != nil {
+			return err
+		}
+		expired, err := w.expired(sent)
+		if err != nil {
+			return err
+		}
+		for _, index := range expired {
+			if err := sendChunk(index); err != nil {
+				return err
+			}
+		}
+		for len(queue) > 0 && !w.held() {
+			index := queue[0]
+			reserved, ok := w.reserve(index, metadata.ChunkLength(index))
+			if !ok {
+				break
+			}
+			queue = queue[1:]
+			// 其他批次已在发送该块
+			if !reserved {
+				continue
+			}
+			sent = append(sent, index)
+			if err := sendChunk(index); err != nil {
+				return err
+			}
+		}
+
+		sent = w.unacked(sent)
+		if len(queue) == 0 && len(sent) == 0 {
+			return nil
+		}
+		w.wait(sent)
+	}
+}
+
+// reserve takes a slot of the window for a chunk. It reports ok false when
+// the window is full, and reserved false when the chunk is already in
+// flight for another batch.
+func (w *sendWindow) reserve(index int, length int64) (reserved bool, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, inFlight := w.inFlight[index]; inFlight {
+		return false, true
+	}
+	if len(w.inFlight) >= max(1, int(w.cwnd)) {
+		return false, false
+	}
+	w.inFlight[index] = &flightChunk{length: length}
+	return true, true
+}
+
+// hold stops new chunks from being sent for d, as the receiver asked.
+func (w *sendWindow) hold(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.heldTill = time.Now().Add(d)
+}
+
+// held reports whether new chunks are held back.
+func (w *sendWindow) held() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.heldTill)
+}
+
+// sent records that a reserved chunk is being sent, now.
+func (w *sendWindow) sent(index int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if c, ok := w.inFlight[index]; ok {
+		c.sentAt = time.Now()
+		c.sends++
+	}
+}
+
+// ack removes an acknowledged chunk from the window and returns its length.
+func (w *sendWindow) ack(index int) (int64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	c, ok := w.inFlight[index]
+	if !ok {
+		return 0, false
+	}
+	delete(w.inFlight, index)
+	// 重传过的块无法确定确认对应哪次发送，不采样
+	if c.sends == 1 {
+		w.sampleRTT(time.Since(c.sentAt))
+	}
+	if w.minRTT == 0 || w.srtt <= 2*w.minRTT {
+		if w.cwnd < w.ssthresh {
+			w.cwnd++
+		} else {
+			w.cwnd += 1 / w.cwnd
+		}
+		w.cwnd = min(w.cwnd, maxSendWindow)
+	}
+	w.signal()
+	return c.length, true
+}
+
+// expired returns the chunks among indices whose acknowledgement timed out
+// and shrinks the window for the loss. It fails once a chunk has been
+// retransmitted maxRetransmits times.
+func (w *sendWindow) expired(indices []int) ([]int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	expired := []int{}
+	for _, index := range indices {
+		c, ok := w.inFlight[index]
+		if !ok || c.sends == 0 || now.Sub(c.sentAt) < w.rto {
+			continue
+		}
+		if c.sends > maxRetransmits {
+			return nil, fmt.Errorf("chunk %d %w after %d retransmissions", index, ErrNotAcknowledged, maxRetransmits)
+		}
+		expired = append(expired, index)
+	}
+	if len(expired) > 0 {
+		// 丢包：窗口减半，超时时间加倍
+		w.ssthresh = max(w.cwnd/2, 1)
+		w.cwnd = w.ssthresh
+		w.rto = min(2*w.rto, maxRTO)
+	}
+	return expired, nil
+}
+
+// unacked returns the chunks among indices still waiting for an
+// acknowledgement.
+func (w *sendWindow) unacked(indices []int) []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	unacked := indices[:0]
+	for _, index := range indices {
+		if _, ok := w.inFlight[index]; ok {
+			unacked = append(unacked, index)
+		}
+	}
+	return unacked
+}
+
+// forget frees the slots of chunks a failed batch will not wait for.
+func (w *sendWindow) forget(indices []int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, index := range indices {
+		delete(w.inFlight, index)
+	}
+	w.signal()
+}
+
+// wait blocks until chunks leave the window or the next of indices times
+// out, but at most windowPoll.
+func (w *sendWindow) wait(indices []int) {
+	w.mu.Lock()
+	changed := w.changed
+	timeout := windowPoll
+	now := time.Now()
+	if now.Before(w.heldTill) {
+		timeout = min(timeout, w.heldTill.Sub(now))
+	}
+	for _, index := range indices {
+		if c, ok := w.inFlight[index]; ok && c.sends > 0 {
+			timeout = min(timeout, c.sentAt.Add(w.rto).Sub(now))
+		}
+	}
+	w.mu.Unlock()
+
+	if timeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
+
+// sampleRTT updates the round trip estimate and the retransmission timeout
+// as in RFC 6298. The caller must hold w.mu.
+func (w *sendWindow) sampleRTT(rtt time.Duration) {
+	if w.srtt == 0 {
+		w.srtt = rtt
+		w.rttvar = rtt / 2
+	} else {
+		diff := w.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		w.rttvar = (3*w.rttvar + diff) / 4
+		w.srtt = (7*w.srtt + rtt) / 8
+	}
+	if w.minRTT == 0 || rtt < w.minRTT {
+		w.minRTT = rtt
+	}
+	w.rto = min(maxRTO, max(minRTO, w.srtt+4*w.rttvar))
+}
+
+// signal wakes the batches waiting on the window. The caller must hold w.mu.
+func (w *sendWindow) signal() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
@@ -0,0 +1,166 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeySize is the size of public and private identity keys.
+const KeySize = 32
+
+var ErrInvalidSealed = errors.New("invalid sealed data")
+
+// Identity is the key material of a node: an X25519 key pair, whose public
+// key is sent to peers in the hello message so they can seal data only this
+// node can open, and an Ed25519 key pair the node signs with. The signing
+// key is derived from the X25519 private key, so one stored key is enough.
+//
+// The ID of a node is the hash of its signing key. A node can only claim an
+// ID by signing with the matching key, and everything it signs can be
+// checked against its ID without asking anyone.
+type Identity struct {
+	key     *ecdh.PrivateKey
+	signing ed25519.PrivateKey
+}
+
+func newIdentity(key *ecdh.PrivateKey) *Identity {
+	// 签名密钥由存储的私钥派生，两种用途使用不同的密钥
+	seed := sha256.Sum256(append([]byte("pp identity signing key"), key.Bytes()...))
+	return &Identity{key: key, signing: ed25519.NewKeyFromSeed(seed[:])}
+}
+
+// Load reads the identity key stored at path, generating and storing a new
+// one when there is none.
+func Load(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := ecdh.X25519().NewPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key %s: %w", path, err)
+		}
+		return newIdentity(key), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// 私钥只允许本用户读取
+	if err := os.WriteFile(path, key.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	return newIdentity(key), nil
+}
+
+// PublicKey returns the public key data is sealed to.
+func (id *Identity) PublicKey() []byte {
+	return id.key.PublicKey().Bytes()
+}
+
+// SigningKey returns the public key signatures of the identity are checked
+// with.
+func (id *Identity) SigningKey() []byte {
+	return id.signing.Public().(ed25519.PublicKey)
+}
+
+// NodeID returns the ID of the node holding the identity.
+func (id *Identity) NodeID() string {
+	return NodeIDOf(id.SigningKey())
+}
+
+// Sign signs message with the identity.
+func (id *Identity) Sign(message []byte) []byte {
+	return ed25519.Sign(id.signing, message)
+}
+
+// NodeIDOf returns the ID of the node whose signing key is signingKey.
+func NodeIDOf(signingKey []byte) string {
+	sum := sha256.Sum256(signingKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether signature is a signature of message by the holder
+// of signingKey.
+func Verify(signingKey []byte, message []byte, signature []byte) bool {
+	return len(signingKey) == ed25519.PublicKeySize && ed25519.Verify(signingKey, message, signature)
+}
+
+// Seal encrypts data so that only the holder of the private key matching
+// publicKey can open it. Every call uses a fresh ephemeral key pair, whose
+// public key is prepended to the ciphertext.
+func Seal(publicKey []byte, data []byte) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealCipher(shared, ephemeral.PublicKey().Bytes(), publicKey)
+	if err != nil {
+		return nil, err
+	}
+	// 每次密封的密钥都不同，固定 nonce 是安全的
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeral.PublicKey().Bytes(), nonce, data, nil), nil
+}
+
+// Open decrypts data sealed to this identity with Seal.
+func (id *Identity) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < KeySize {
+		return nil, ErrInvalidSealed
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:KeySize])
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	shared, err := id.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	aead, err := sealCipher(shared, sealed[:KeySize], id.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	data, err := aead.Open(nil, nonce, sealed[KeySize:], nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	return data, nil
+}
+
+// sealCipher derives the AES-256-GCM cipher of a sealed message from the
+// shared secret and both public keys.
+func sealCipher(shared []byte, ephemeralKey []byte, recipientKey []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("pp identity seal"))
+	h.Write(shared)
+	h.Write(ephemeralKey)
+	h.Write(recipientKey)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
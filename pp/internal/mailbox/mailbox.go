@@ -0,0 +1,500 @@
+package mailbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/routing"
+	"pp/internal/util"
+)
+
+const (
+	// mailboxFile is the file in the data directory holding queued mail.
+	mailboxFile = "mailbox.json"
+	// DefaultTTL is how long mail is kept when no lifetime is given.
+	DefaultTTL = 7 * 24 * time.Hour
+	// maxTTL bounds the lifetime of mail. Custodians refuse mail that
+	// expires later, allowing for clockSkew between the nodes' clocks.
+	maxTTL    = 30 * 24 * time.Hour
+	clockSkew = 10 * time.Minute
+	// pollInterval is how often queued mail is checked for delivery.
+	pollInterval = 5 * time.Second
+	// minBackoff and maxBackoff bound the wait between delivery attempts.
+	// Mail for a connected node that has not reached it is tried every poll.
+	minBackoff = 10 * time.Second
+	maxBackoff = 10 * time.Minute
+	// deliveryTimeout bounds one delivery attempt.
+	deliveryTimeout = 10 * time.Second
+	// maxCustodians is how many peers mail is handed to for forwarding.
+	maxCustodians = 3
+	// maxCustody bounds the mail held for other nodes.
+	maxCustody = 1000
+)
+
+var (
+	ErrCustodyFull  = errors.New("mailbox custody full")
+	ErrNotMailable  = errors.New("message type cannot be sent by mail")
+	ErrSignature    = errors.New("mail not signed by its sender")
+	errExpiresLater = errors.New("mail expires too late")
+)
+
+// mailable lists the message types that may be sent by mail. Mail to this
+// node is handled as if routed from its sender, so other messages stay
+// with the overlay.
+var mailable = map[string]bool{"chat": true}
+
+// Mail is a message for a node that may be offline. Payload holds the
+// serialized message, which is handled as if it had been routed from From
+// once it arrives. The sender signs the mail, so custodians can hold it
+// without being able to alter or forge it.
+type Mail struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"` // node ID of the sender
+	To        string    `json:"to"`   // node ID of the recipient
+	Payload   []byte    `json:"payload"`
+	Expires   time.Time `json:"expires"`
+	Key       []byte    `json:"key"` // sender's signing key
+	Signature []byte    `json:"signature"`
+}
+
+// signedData returns what the sender of mail signs.
+func (m Mail) signedData() []byte {
+	data := []byte("pp mail\x00")
+	for _, field := range []string{m.ID, m.From, m.To, strconv.FormatInt(m.Expires.UnixNano(), 10)} {
+		data = append(append(data, field...), 0)
+	}
+	return append(data, m.Payload...)
+}
+
+// Receipt is the payload of a mail_receipt message, sent and signed by the
+// recipient to the sender of mail it got.
+type Receipt struct {
+	ID        string `json:"id"`
+	From      string `json:"from"` // node ID of the recipient
+	Key       []byte `json:"key"`  // recipient's signing key
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns what the recipient of mail signs in a receipt.
+func (r Receipt) signedData() []byte {
+	return []byte("pp mail receipt\x00" + r.ID + "\x00" + r.From)
+}
+
+// Status is the outcome of mail sent by this node.
+type Status string
+
+const (
+	Delivered Status = "delivered"
+	Expired   Status = "expired"
+)
+
+// entry is queued mail.
+type entry struct {
+	Mail
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	HandedOff   bool      `json:"handed_off"` // given to custodians
+	inFlight    bool
+	reached     bool // the last attempt got to the recipient
+}
+
+// state is what the mailbox keeps in the data directory.
+type state struct {
+	Outbox  []*entry             `json:"outbox"`
+	Custody []*entry             `json:"custody"`
+	Seen    map[string]time.Time `json:"seen"`
+}
+
+// Mailbox delivers messages to nodes that are not reachable yet. Mail is
+// queued until it expires and delivered over the overlay once the recipient
+// can be reached; the recipient answers with a receipt. With forwarding
+// enabled, mail that cannot be delivered right away is also handed to
+// connected peers, which hold it and deliver it if the recipient shows up
+// there while this node is gone. Mail and receipts are signed, so
+// custodians cannot alter or forge them.
+type Mailbox struct {
+	identity       *identity.Identity
+	nodeID         string
+	serverAddr     string
+	dataDir        string
+	forward        bool
+	eventManager   *events.EventManager
+	peerManager    *peer.Manager
+	routingService *routing.Service
+	handler        func(string, []byte)
+
+	mu      sync.Mutex
+	outbox  map[string]*entry    // mail sent by this node
+	custody map[string]*entry    // mail held for other nodes
+	seen    map[string]time.Time // mail delivered to this node -> expiry
+}
+
+// NewMailbox creates a Mailbox and loads the mail queued in dataDir. With
+// forward set, undeliverable mail is handed to connected peers.
+func NewMailbox(dataDir string, id *identity.Identity, serverAddr string, forward bool, eventManager *events.EventManager, peerManager *peer.Manager, routingService *routing.Service) *Mailbox {
+	m := &Mailbox{
+		identity:       id,
+		nodeID:         id.NodeID(),
+		serverAddr:     serverAddr,
+		dataDir:        dataDir,
+		forward:        forward,
+		eventManager:   eventManager,
+		peerManager:    peerManager,
+		routingService: routingService,
+		handler:        func(string, []byte) {},
+		outbox:         make(map[string]*entry),
+		custody:        make(map[string]*entry),
+		seen:           make(map[string]time.Time),
+	}
+	m.load()
+	return m
+}
+
+// SetMessageHandler sets the function that handles the messages of mail
+// delivered to this node, with the node:// address of the sender.
+func (m *Mailbox) SetMessageHandler(handler func(string, []byte)) {
+	m.handler = handler
+}
+
+// Send queues msg for the node nodeID, to be delivered within ttl, at most
+// maxTTL, and returns the ID of the mail. A MailStatusEvent tells when it
+// was delivered or expired. Only message types in mailable can be sent.
+func (m *Mailbox) Send(nodeID string, msg message.Message, ttl time.Duration) (string, error) {
+	if !mailable[msg.Type] {
+		return "", fmt.Errorf("%w: %q", ErrNotMailable, msg.Type)
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	payload, err := message.Serialize(msg)
+	if err != nil {
+		return "", err
+	}
+	e := &entry{Mail: Mail{
+		ID:      util.GenerateUUID(),
+		From:    m.nodeID,
+		To:      nodeID,
+		Payload: payload,
+		Expires: time.Now().Add(min(ttl, maxTTL)).UTC(),
+		Key:     m.identity.SigningKey(),
+	}}
+	e.Signature = m.identity.Sign(e.signedData())
+
+	m.mu.Lock()
+	m.outbox[e.ID] = e
+	err = m.save()
+	e.inFlight = true
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	go m.attempt(e, true)
+	return e.ID, nil
+}
+
+// Pending returns the mail this node sent that has not been delivered yet.
+func (m *Mailbox) Pending() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := make([]Mail, 0, len(m.outbox))
+	for _, e := range m.outbox {
+		pending = append(pending, e.Mail)
+	}
+	return pending
+}
+
+// Run delivers queued mail and drops expired mail until stop is closed.
+func (m *Mailbox) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.poll()
+		}
+	}
+}
+
+// HandleMail handles mail received from addr: mail for this node is
+// handled and acknowledged with a receipt, mail for others is held if
+// forwarding is enabled. Mail must be signed by its sender, whichever peer
+// delivers it, and only mailable messages are handled.
+func (m *Mailbox) HandleMail(addr string, mail Mail) error {
+	if mail.ID == "" || mail.From == "" || time.Now().After(mail.Expires) {
+		return fmt.Errorf("invalid or expired mail %s from %s", mail.ID, addr)
+	}
+	if identity.NodeIDOf(mail.Key) != mail.From || !identity.Verify(mail.Key, mail.signedData(), mail.Signature) {
+		return fmt.Errorf("%w: mail %s from %s", ErrSignature, mail.ID, addr)
+	}
+	if mail.To != m.nodeID {
+		return m.hold(mail)
+	}
+	if msg, err := message.Deserialize(mail.Payload); err != nil || !mailable[msg.Type] {
+		return fmt.Errorf("%w: mail %s holds %q", ErrNotMailable, mail.ID, msg.Type)
+	}
+
+	m.mu.Lock()
+	_, seen := m.seen[mail.ID]
+	if !seen {
+		m.seen[mail.ID] = mail.Expires
+		if err := m.save(); err != nil {
+			log.Printf("Error saving mailbox: %v", err)
+		}
+	}
+	m.mu.Unlock()
+
+	// 重复投递的邮件只回执，不再处理
+	if !seen {
+		m.handler(routing.NodeAddr(mail.From), mail.Payload)
+	}
+	go m.sendReceipt(mail)
+	return nil
+}
+
+// HandleReceipt records that mail sent by this node was delivered, as the
+// recipient at addr reports.
+func (m *Mailbox) HandleReceipt(addr string, receipt Receipt) {
+	if m.nodeAt(addr) != receipt.From {
+		log.Printf("Ignoring receipt for mail %s from %s on behalf of %s", receipt.ID, addr, receipt.From)
+		return
+	}
+	if identity.NodeIDOf(receipt.Key) != receipt.From || !identity.Verify(receipt.Key, receipt.signedData(), receipt.Signature) {
+		log.Printf("Ignoring unsigned receipt for mail %s from %s", receipt.ID, addr)
+		return
+	}
+	m.mu.Lock()
+	e, ok := m.outbox[receipt.ID]
+	if !ok || e.To != receipt.From {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.outbox, receipt.ID)
+	if err := m.save(); err != nil {
+		log.Printf("Error saving mailbox: %v", err)
+	}
+	m.mu.Unlock()
+
+	m.publish(e.Mail, Delivered)
+}
+
+// hold keeps mail for another node until it can be delivered.
+func (m *Mailbox) hold(mail Mail) error {
+	if !m.forward {
+		return fmt.Errorf("not holding mail %s for %s", mail.ID, mail.To)
+	}
+	// 过期时间已签名，不能缩短，只能拒收
+	if mail.Expires.After(time.Now().Add(maxTTL + clockSkew)) {
+		return fmt.Errorf("%w: mail %s for %s", errExpiresLater, mail.ID, mail.To)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.custody[mail.ID]; ok {
+		return nil
+	}
+	if len(m.custody) >= maxCustody {
+		return ErrCustodyFull
+	}
+	m.custody[mail.ID] = &entry{Mail: mail}
+	return m.save()
+}
+
+// poll drops expired mail and starts the delivery attempts that are due.
+func (m *Mailbox) poll() {
+	now := time.Now()
+	expired := []Mail{}
+	due := []*entry{}
+
+	m.mu.Lock()
+	for _, queue := range []map[string]*entry{m.outbox, m.custody} {
+		for id, e := range queue {
+			if now.After(e.Expires) {
+				delete(queue, id)
+				if e.From == m.nodeID {
+					expired = append(expired, e.Mail)
+				}
+				continue
+			}
+			if e.inFlight {
+				continue
+			}
+			// 收件人已连接时立即投递，除非上次已送达、正等待回执
+			_, connected := m.peerManager.FindByID(e.To)
+			if (connected && !e.reached) || !now.Before(e.NextAttempt) {
+				e.inFlight = true
+				due = append(due, e)
+			}
+		}
+	}
+	for id, expires := range m.seen {
+		if now.After(expires) {
+			delete(m.seen, id)
+		}
+	}
+	if len(expired) > 0 {
+		if err := m.save(); err != nil {
+			log.Printf("Error saving mailbox: %v", err)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, mail := range expired {
+		m.publish(mail, Expired)
+	}
+	for _, e := range due {
+		go m.attempt(e, false)
+	}
+}
+
+// attempt tries to deliver queued mail once. Mail held for another node is
+// dropped once delivered; mail sent by this node waits for the receipt.
+// After the first failed attempt mail is handed to custodians, if
+// forwarding is enabled. The caller must have set e.inFlight.
+func (m *Mailbox) attempt(e *entry, first bool) {
+	payload, err := message.Serialize(message.Message{Type: "mail", Data: e.Mail, Sender: m.serverAddr})
+	if err == nil {
+		err = m.routingService.Send(e.To, payload, deliveryTimeout)
+	}
+
+	m.mu.Lock()
+	e.inFlight = false
+	e.reached = err == nil
+	e.Attempts++
+	backoff := min(maxBackoff, minBackoff<<min(e.Attempts-1, 10))
+	e.NextAttempt = time.Now().Add(backoff)
+	handOff := err != nil && first && m.forward && !e.HandedOff
+	if handOff {
+		e.HandedOff = true
+	}
+	_, held := m.custody[e.ID]
+	if err == nil && held {
+		delete(m.custody, e.ID)
+	}
+	if saveErr := m.save(); saveErr != nil {
+		log.Printf("Error saving mailbox: %v", saveErr)
+	}
+	m.mu.Unlock()
+
+	if handOff {
+		m.handOff(e.Mail)
+	}
+}
+
+// handOff gives mail to up to maxCustodians connected peers other than
+// the recipient.
+func (m *Mailbox) handOff(mail Mail) {
+	count := 0
+	for _, addr := range m.peerManager.GetPeers() {
+		if count == maxCustodians {
+			break
+		}
+		p, ok := m.peerManager.GetPeer(addr)
+		if !ok || p.NodeID == "" || p.NodeID == mail.To {
+			continue
+		}
+		m.send(addr, message.Message{Type: "mail", Data: mail, Sender: m.serverAddr})
+		count++
+	}
+}
+
+// sendReceipt tells the sender of mail that it was delivered.
+func (m *Mailbox) sendReceipt(mail Mail) {
+	receipt := Receipt{ID: mail.ID, From: m.nodeID, Key: m.identity.SigningKey()}
+	receipt.Signature = m.identity.Sign(receipt.signedData())
+	payload, err := message.Serialize(message.Message{Type: "mail_receipt", Data: receipt, Sender: m.serverAddr})
+	if err == nil {
+		err = m.routingService.Send(mail.From, payload, deliveryTimeout)
+	}
+	if err != nil {
+		// 发送方会重发，届时再回执
+		log.Printf("Error sending receipt for mail %s to %s: %v", mail.ID, mail.From, err)
+	}
+}
+
+// nodeAt returns the node ID of the peer at addr, or "" when unknown.
+func (m *Mailbox) nodeAt(addr string) string {
+	if nodeID, ok := routing.ParseNodeAddr(addr); ok {
+		return nodeID
+	}
+	p, _ := m.peerManager.GetPeer(addr)
+	return p.NodeID
+}
+
+// publish publishes the MailStatusEvent of mail sent by this node.
+func (m *Mailbox) publish(mail Mail, status Status) {
+	m.eventManager.Publish(events.MailStatusEvent{EventData: events.MailStatusEventData{
+		MailID: mail.ID,
+		To:     mail.To,
+		Status: string(status),
+	}})
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (m *Mailbox) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	m.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// load reads the mailbox from the data directory.
+func (m *Mailbox) load() {
+	data, err := os.ReadFile(filepath.Join(m.dataDir, mailboxFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error reading mailbox: %v", err)
+		}
+		return
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		log.Printf("Error reading mailbox: %v", err)
+		return
+	}
+	for _, e := range s.Outbox {
+		m.outbox[e.ID] = e
+	}
+	for _, e := range s.Custody {
+		m.custody[e.ID] = e
+	}
+	for id, expires := range s.Seen {
+		m.seen[id] = expires
+	}
+}
+
+// save writes the mailbox to the data directory. The caller must hold m.mu.
+func (m *Mailbox) save() error {
+	s := state{Outbox: []*entry{}, Custody: []*entry{}, Seen: m.seen}
+	for _, e := range m.outbox {
+		s.Outbox = append(s.Outbox, e)
+	}
+	for _, e := range m.custody {
+		s.Custody = append(s.Custody, e)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.dataDir, mailboxFile)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,70 @@
+package mailbox
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/peer"
+	"pp/internal/routing"
+)
+
+func testIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+	id, err := identity.Load(filepath.Join(t.TempDir(), "identity.key"))
+	if err != nil {
+		t.Fatalf("identity.Load: %v", err)
+	}
+	return id
+}
+
+// receiptFrom returns a receipt for mail signed by id.
+func receiptFrom(id *identity.Identity, mailID string) Receipt {
+	receipt := Receipt{ID: mailID, From: id.NodeID(), Key: id.SigningKey()}
+	receipt.Signature = id.Sign(receipt.signedData())
+	return receipt
+}
+
+func TestHandleReceipt(t *testing.T) {
+	sender, recipient, other := testIdentity(t), testIdentity(t), testIdentity(t)
+	const mailID = "mail-1"
+
+	tests := []struct {
+		name      string
+		addr      string
+		receipt   func() Receipt
+		delivered bool
+	}{
+		{"recipient", routing.NodeAddr(recipient.NodeID()), func() Receipt { return receiptFrom(recipient, mailID) }, true},
+		{"non-recipient", routing.NodeAddr(other.NodeID()), func() Receipt { return receiptFrom(other, mailID) }, false},
+		// 转发别人的回执
+		{"relayed by non-recipient", routing.NodeAddr(other.NodeID()), func() Receipt { return receiptFrom(recipient, mailID) }, false},
+		{"claiming the recipient", routing.NodeAddr(recipient.NodeID()), func() Receipt {
+			receipt := receiptFrom(other, mailID)
+			receipt.From = recipient.NodeID()
+			return receipt
+		}, false},
+		{"unsigned", routing.NodeAddr(recipient.NodeID()), func() Receipt {
+			receipt := receiptFrom(recipient, mailID)
+			receipt.Signature = nil
+			return receipt
+		}, false},
+		{"other mail", routing.NodeAddr(recipient.NodeID()), func() Receipt { return receiptFrom(recipient, "mail-2") }, false},
+		{"unknown peer", "10.0.0.1:9000", func() Receipt { return receiptFrom(recipient, mailID) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMailbox(t.TempDir(), sender, "127.0.0.1:9000", false, events.NewEventManager(), peer.NewManager(10), nil)
+			mail := Mail{ID: mailID, From: sender.NodeID(), To: recipient.NodeID(), Expires: time.Now().Add(time.Hour), Key: sender.SigningKey()}
+			mail.Signature = sender.Sign(mail.signedData())
+			m.outbox[mail.ID] = &entry{Mail: mail}
+
+			m.HandleReceipt(tt.addr, tt.receipt())
+			if delivered := len(m.Pending()) == 0; delivered != tt.delivered {
+				t.Fatalf("delivered = %v, want %v", delivered, tt.delivered)
+			}
+		})
+	}
+}
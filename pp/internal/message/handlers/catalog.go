@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"log"
+	"pp/internal/catalog"
+	"pp/internal/events"
+	"pp/internal/message"
+)
+
+// FileSearchHandler answers file searches from the local catalog.
+type FileSearchHandler struct {
+	catalog      *catalog.Catalog
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewFileSearchHandler creates a new FileSearchHandler instance.
+func NewFileSearchHandler(catalog *catalog.Catalog, serverAddr string, eventManager *events.EventManager) *FileSearchHandler {
+	return &FileSearchHandler{
+		catalog:      catalog,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes a file search message.
+func (h *FileSearchHandler) Handle(senderAddr string, msg message.Message) {
+	var query catalog.Query
+	if err := msg.DecodeData(&query); err != nil || query.ID == "" {
+		log.Printf("Invalid file search from %s", senderAddr)
+		return
+	}
+
+	// 没有匹配的文件也回复，请求方不必等到超时
+	eventData := events.SendMessageEventData{
+		DestinationAddr: senderAddr,
+		Message: message.Message{
+			Type:   "file_search_result",
+			Data:   catalog.Results{ID: query.ID, Entries: h.catalog.Match(query)},
+			Sender: h.serverAddr,
+		},
+	}
+	h.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// FileSearchResultHandler handles answers to file searches.
+type FileSearchResultHandler struct {
+	catalog *catalog.Catalog
+}
+
+// NewFileSearchResultHandler creates a new FileSearchResultHandler instance.
+func NewFileSearchResultHandler(catalog *catalog.Catalog) *FileSearchResultHandler {
+	return &FileSearchResultHandler{catalog: catalog}
+}
+
+// Handle processes a file search result message.
+func (h *FileSearchResultHandler) Handle(senderAddr string, msg message.Message) {
+	var results catalog.Results
+	if err := msg.DecodeData(&results); err != nil {
+		log.Printf("Invalid file search result from %s", senderAddr)
+		return
+	}
+	h.catalog.HandleResults(senderAddr, results)
+}
+
+// FileAnnounceHandler handles file announcements from peers.
+type FileAnnounceHandler struct {
+	catalog *catalog.Catalog
+}
+
+// NewFileAnnounceHandler creates a new FileAnnounceHandler instance.
+func NewFileAnnounceHandler(catalog *catalog.Catalog) *FileAnnounceHandler {
+	return &FileAnnounceHandler{catalog: catalog}
+}
+
+// Handle processes a file announce message.
+func (h *FileAnnounceHandler) Handle(senderAddr string, msg message.Message) {
+	var announce catalog.Announce
+	if err := msg.DecodeData(&announce); err != nil {
+		log.Printf("Invalid file announcement from %s", senderAddr)
+		return
+	}
+	log.Printf("Peer %s announced %d files", senderAddr, len(announce.Entries))
+	h.catalog.HandleAnnounce(senderAddr, announce)
+}
@@ -1,28 +1,112 @@
 ﻿package handlers
 
 import (
-	"fmt"
 	"log"
+	"pp/internal/chat"
 	"pp/internal/message"
 )
 
 // ChatHandler handles chat messages.
 type ChatHandler struct {
-	// node *node.Node  //不再需要node
+	chatService *chat.Service
 }
 
 // NewChatHandler creates a new ChatHandler instance.
-func NewChatHandler() *ChatHandler {
-	return &ChatHandler{}
+func NewChatHandler(chatService *chat.Service) *ChatHandler {
+	return &ChatHandler{chatService: chatService}
 }
 
 // Handle processes a chat message.
 func (h *ChatHandler) Handle(senderAddr string, msg message.Message) {
-	chatText, ok := msg.Data.(string)
-	if !ok {
+	var chatMsg chat.Message
+	if err := msg.DecodeData(&chatMsg); err != nil {
 		log.Printf("Invalid chat message data from %s", senderAddr)
 		return
 	}
 
-	fmt.Printf("[%s]: %s\n", senderAddr, chatText)
+	if err := h.chatService.HandleMessage(senderAddr, chatMsg); err != nil {
+		log.Printf("Rejected chat message from %s: %v", senderAddr, err)
+	}
+}
+
+// ChatHistoryRequestHandler answers requests for the history of a room.
+type ChatHistoryRequestHandler struct {
+	chatService *chat.Service
+}
+
+// NewChatHistoryRequestHandler creates a new ChatHistoryRequestHandler instance.
+func NewChatHistoryRequestHandler(chatService *chat.Service) *ChatHistoryRequestHandler {
+	return &ChatHistoryRequestHandler{chatService: chatService}
+}
+
+// Handle processes a chat history request message.
+func (h *ChatHistoryRequestHandler) Handle(senderAddr string, msg message.Message) {
+	var request chat.HistoryRequest
+	if err := msg.DecodeData(&request); err != nil || request.Room == "" {
+		log.Printf("Invalid chat history request from %s", senderAddr)
+		return
+	}
+	h.chatService.HandleHistoryRequest(senderAddr, request)
+}
+
+// ChatHistoryHandler handles the history of a room sent by a peer.
+type ChatHistoryHandler struct {
+	chatService *chat.Service
+}
+
+// NewChatHistoryHandler creates a new ChatHistoryHandler instance.
+func NewChatHistoryHandler(chatService *chat.Service) *ChatHistoryHandler {
+	return &ChatHistoryHandler{chatService: chatService}
+}
+
+// Handle processes a chat history message.
+func (h *ChatHistoryHandler) Handle(senderAddr string, msg message.Message) {
+	var response chat.HistoryResponse
+	if err := msg.DecodeData(&response); err != nil {
+		log.Printf("Invalid chat history from %s", senderAddr)
+		return
+	}
+	if err := h.chatService.HandleHistory(senderAddr, response); err != nil {
+		log.Printf("Rejected chat history from %s: %v", senderAddr, err)
+	}
+}
+
+// ChatJoinHandler handles peers joining chat rooms.
+type ChatJoinHandler struct {
+	chatService *chat.Service
+}
+
+// NewChatJoinHandler creates a new ChatJoinHandler instance.
+func NewChatJoinHandler(chatService *chat.Service) *ChatJoinHandler {
+	return &ChatJoinHandler{chatService: chatService}
+}
+
+// Handle processes a chat join message.
+func (h *ChatJoinHandler) Handle(senderAddr string, msg message.Message) {
+	var membership chat.Membership
+	if err := msg.DecodeData(&membership); err != nil {
+		log.Printf("Invalid chat join from %s", senderAddr)
+		return
+	}
+	h.chatService.HandleJoin(senderAddr, membership)
+}
+
+// ChatLeaveHandler handles peers leaving chat rooms.
+type ChatLeaveHandler struct {
+	chatService *chat.Service
+}
+
+// NewChatLeaveHandler creates a new ChatLeaveHandler instance.
+func NewChatLeaveHandler(chatService *chat.Service) *ChatLeaveHandler {
+	return &ChatLeaveHandler{chatService: chatService}
+}
+
+// Handle processes a chat leave message.
+func (h *ChatLeaveHandler) Handle(senderAddr string, msg message.Message) {
+	var membership chat.Membership
+	if err := msg.DecodeData(&membership); err != nil {
+		log.Printf("Invalid chat leave from %s", senderAddr)
+		return
+	}
+	h.chatService.HandleLeave(senderAddr, membership)
 }
@@ -1,9 +1,13 @@
 ﻿package handlers
 
 import (
+	"errors"
 	"log"
+	"pp/internal/events"
 	"pp/internal/filetransfer"
 	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/routing"
 	// "pp/internal/node" //不再需要node
 )
 
@@ -19,32 +23,39 @@ func NewFileChunkHandler(fileTransferManager *filetransfer.Manager) *FileChunkHa
 
 // Handle processes a file chunk message.
 func (h *FileChunkHandler) Handle(senderAddr string, msg message.Message) {
-	data, ok := msg.Data.(map[string]interface{})
+	// 二进制块帧已解码为 Chunk，不必再经过 JSON
+	chunk, ok := msg.Data.(filetransfer.Chunk)
 	if !ok {
-		log.Printf("Invalid file chunk data from %s", senderAddr)
-		return
+		if err := msg.DecodeData(&chunk); err != nil || chunk.FileID == "" {
+			log.Printf("Invalid file chunk data from %s", senderAddr)
+			return
+		}
 	}
-
-	fileID, ok := data["file_id"].(string)
-	if !ok {
-		log.Printf("Invalid file_id in chunk from %s", senderAddr)
+	// 内容已存在（去重），多余的块直接丢弃
+	if h.fileTransferManager.HasFile(chunk.FileID) {
+		h.fileTransferManager.AckChunk(senderAddr, chunk.FileID, chunk.ChunkIndex)
 		return
 	}
 
-	chunkIndexFloat, ok := data["chunk_index"].(float64)
-	if !ok {
-		log.Printf("Invalid chunk_index in chunk from %s", senderAddr)
+	decoded, err := h.fileTransferManager.DecodeChunk(chunk)
+	if err != nil {
+		log.Printf("Rejected chunk from %s: %v", senderAddr, err)
+		if err := h.fileTransferManager.RetryChunk(senderAddr, chunk.FileID, chunk.ChunkIndex); err != nil {
+			log.Printf("Error requesting chunk again: %v", err)
+		}
 		return
 	}
-	chunkIndex := int(chunkIndexFloat)
 
-	chunkData, ok := data["chunk_data"].([]byte)
-	if !ok {
-		log.Printf("Invalid chunk_data in chunk from %s", senderAddr)
+	// 写入前先校验块哈希，损坏的块请求对方重发
+	if err := h.fileTransferManager.VerifyChunk(decoded); err != nil {
+		log.Printf("Rejected chunk from %s: %v", senderAddr, err)
+		if err := h.fileTransferManager.RetryChunk(senderAddr, chunk.FileID, chunk.ChunkIndex); err != nil {
+			log.Printf("Error requesting chunk again: %v", err)
+		}
 		return
 	}
 
-	if err := h.fileTransferManager.WriteChunk(fileID, chunkData, chunkIndex); err != nil {
+	if err := h.fileTransferManager.ReceiveChunk(senderAddr, decoded); err != nil {
 		log.Printf("Error writing chunk to file: %v", err)
 	}
 }
@@ -52,22 +63,197 @@ func (h *FileChunkHandler) Handle(senderAddr string, msg message.Message) {
 // FileMetadataHandler handles file metadata messages.
 type FileMetadataHandler struct {
 	fileTransferManager *filetransfer.Manager
+	peerManager         *peer.Manager
 }
 
 // NewFileMetadataHandler creates a new FileMetadataHandler instance.
-func NewFileMetadataHandler(fileTransferManager *filetransfer.Manager) *FileMetadataHandler {
-	return &FileMetadataHandler{fileTransferManager: fileTransferManager}
+func NewFileMetadataHandler(fileTransferManager *filetransfer.Manager, peerManager *peer.Manager) *FileMetadataHandler {
+	return &FileMetadataHandler{
+		fileTransferManager: fileTransferManager,
+		peerManager:         peerManager,
+	}
 }
 
 // Handle processes a file metadata message.
 func (h *FileMetadataHandler) Handle(senderAddr string, msg message.Message) {
-	metadata, ok := msg.Data.(filetransfer.Metadata)
-	if !ok {
+	var metadata filetransfer.Metadata
+	if err := msg.DecodeData(&metadata); err != nil {
 		log.Printf("Invalid file metadata from %s", senderAddr)
 		return
 	}
 
-	if err := h.fileTransferManager.StoreMetadata(metadata); err != nil {
+	// 记录来源节点，以便重启后续传
+	source := sourceOf(h.peerManager, senderAddr)
+	if err := h.fileTransferManager.ReceiveMetadata(senderAddr, metadata, source); err != nil {
 		log.Printf("Error storing file metadata: %v", err)
 	}
 }
+
+// FileChunkRequestHandler handles requests to send chunks again.
+type FileChunkRequestHandler struct {
+	fileTransferManager *filetransfer.Manager
+	serverAddr          string
+	eventManager        *events.EventManager
+}
+
+// NewFileChunkRequestHandler creates a new FileChunkRequestHandler instance.
+func NewFileChunkRequestHandler(fileTransferManager *filetransfer.Manager, serverAddr string, eventManager *events.EventManager) *FileChunkRequestHandler {
+	return &FileChunkRequestHandler{
+		fileTransferManager: fileTransferManager,
+		serverAddr:          serverAddr,
+		eventManager:        eventManager,
+	}
+}
+
+// Handle processes a file chunk request message.
+func (h *FileChunkRequestHandler) Handle(senderAddr string, msg message.Message) {
+	var request filetransfer.ChunkRequest
+	if err := msg.DecodeData(&request); err != nil || request.FileID == "" {
+		log.Printf("Invalid file chunk request from %s", senderAddr)
+		return
+	}
+
+	log.Printf("Received request for %d chunks of %s from %s", len(request.ChunkIndices), request.FileID, senderAddr)
+	go func() {
+		err := h.fileTransferManager.SendChunks(senderAddr, request.FileID, request.ChunkIndices)
+		if err != nil {
+			log.Printf("Error sending chunks of %s to %s: %v", request.FileID, senderAddr, err)
+		}
+		// 只有共享、推送给对方或一起下载的文件才能请求
+		if errors.Is(err, filetransfer.ErrNotPermitted) {
+			refuseFile(h.eventManager, h.serverAddr, senderAddr, request.FileID, filetransfer.ErrNotPermitted)
+		}
+	}()
+}
+
+// FileChunkAckHandler handles acknowledgements of sent chunks.
+type FileChunkAckHandler struct {
+	fileTransferManager *filetransfer.Manager
+}
+
+// NewFileChunkAckHandler creates a new FileChunkAckHandler instance.
+func NewFileChunkAckHandler(fileTransferManager *filetransfer.Manager) *FileChunkAckHandler {
+	return &FileChunkAckHandler{fileTransferManager: fileTransferManager}
+}
+
+// Handle processes a file chunk ack message.
+func (h *FileChunkAckHandler) Handle(senderAddr string, msg message.Message) {
+	var ack filetransfer.ChunkAck
+	if err := msg.DecodeData(&ack); err != nil || ack.FileID == "" {
+		log.Printf("Invalid file chunk ack from %s", senderAddr)
+		return
+	}
+
+	h.fileTransferManager.HandleAck(senderAddr, ack)
+}
+
+// FileHaveRequestHandler answers which chunks of a file this node can serve.
+type FileHaveRequestHandler struct {
+	fileTransferManager *filetransfer.Manager
+	serverAddr          string
+	eventManager        *events.EventManager
+}
+
+// NewFileHaveRequestHandler creates a new FileHaveRequestHandler instance.
+func NewFileHaveRequestHandler(fileTransferManager *filetransfer.Manager, serverAddr string, eventManager *events.EventManager) *FileHaveRequestHandler {
+	return &FileHaveRequestHandler{
+		fileTransferManager: fileTransferManager,
+		serverAddr:          serverAddr,
+		eventManager:        eventManager,
+	}
+}
+
+// Handle processes a file have request message.
+func (h *FileHaveRequestHandler) Handle(senderAddr string, msg message.Message) {
+	var request filetransfer.HaveRequest
+	if err := msg.DecodeData(&request); err != nil || request.FileID == "" {
+		log.Printf("Invalid file have request from %s", senderAddr)
+		return
+	}
+
+	have, err := h.fileTransferManager.Have(senderAddr, request.FileID)
+	if errors.Is(err, filetransfer.ErrNotPermitted) {
+		log.Printf("Refused file have request for %s from %s: %v", request.FileID, senderAddr, err)
+		refuseFile(h.eventManager, h.serverAddr, senderAddr, request.FileID, err)
+		return
+	}
+	if err != nil {
+		// 没有该文件时不回复，请求方会超时
+		return
+	}
+	eventData := events.SendMessageEventData{
+		DestinationAddr: senderAddr,
+		Message:         message.Message{Type: "file_have", Data: have, Sender: h.serverAddr},
+	}
+	h.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// FileHaveHandler handles the chunk lists of peers in a swarm download.
+type FileHaveHandler struct {
+	fileTransferManager *filetransfer.Manager
+	peerManager         *peer.Manager
+}
+
+// NewFileHaveHandler creates a new FileHaveHandler instance.
+func NewFileHaveHandler(fileTransferManager *filetransfer.Manager, peerManager *peer.Manager) *FileHaveHandler {
+	return &FileHaveHandler{
+		fileTransferManager: fileTransferManager,
+		peerManager:         peerManager,
+	}
+}
+
+// Handle processes a file have message.
+func (h *FileHaveHandler) Handle(senderAddr string, msg message.Message) {
+	var have filetransfer.Have
+	if err := msg.DecodeData(&have); err != nil || have.FileID == "" {
+		log.Printf("Invalid file have data from %s", senderAddr)
+		return
+	}
+
+	if err := h.fileTransferManager.HandleHave(senderAddr, have, sourceOf(h.peerManager, senderAddr)); err != nil {
+		log.Printf("Error handling file have from %s: %v", senderAddr, err)
+	}
+}
+
+// FileKeyHandler handles keys of encrypted files sent by peers.
+type FileKeyHandler struct {
+	fileTransferManager *filetransfer.Manager
+	peerManager         *peer.Manager
+}
+
+// NewFileKeyHandler creates a new FileKeyHandler instance.
+func NewFileKeyHandler(fileTransferManager *filetransfer.Manager, peerManager *peer.Manager) *FileKeyHandler {
+	return &FileKeyHandler{fileTransferManager: fileTransferManager, peerManager: peerManager}
+}
+
+// Handle processes a file key message.
+func (h *FileKeyHandler) Handle(senderAddr string, msg message.Message) {
+	var envelope filetransfer.KeyEnvelope
+	if err := msg.DecodeData(&envelope); err != nil || envelope.FileID == "" {
+		log.Printf("Invalid file key from %s", senderAddr)
+		return
+	}
+
+	// 只接受已证明身份的节点发来、由其签名的密钥
+	p, ok := h.peerManager.GetPeer(senderAddr)
+	if !ok || p.NodeID == "" {
+		log.Printf("Ignoring file key from %s, which has not proven its identity", senderAddr)
+		return
+	}
+	if err := h.fileTransferManager.ReceiveKey(envelope, p.SigningKey); err != nil {
+		log.Printf("Error storing key of %s from %s: %v", envelope.FileID, senderAddr, err)
+		return
+	}
+	log.Printf("Received key of encrypted file %s from %s", envelope.FileID, senderAddr)
+}
+
+// sourceOf identifies the peer at addr for resuming a transfer from it later.
+func sourceOf(peerManager *peer.Manager, addr string) filetransfer.Source {
+	if p, ok := peerManager.GetPeer(addr); ok {
+		return filetransfer.Source{NodeID: p.NodeID, ListenAddr: p.ListenAddr}
+	}
+	if nodeID, ok := routing.ParseNodeAddr(addr); ok {
+		return filetransfer.Source{NodeID: nodeID}
+	}
+	return filetransfer.Source{}
+}
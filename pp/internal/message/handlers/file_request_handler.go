@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"pp/internal/events"
 	"pp/internal/filetransfer"
@@ -33,10 +34,53 @@ func (h *FileRequestHandler) Handle(senderAddr string, msg message.Message) {
 
 	log.Printf("Received file request for %s from %s", filename, senderAddr)
 
+	// 只允许请求共享目录中的文件或共享的文件 ID
+	target, err := h.fileTransferManager.ResolveRequest(filename)
+	if err != nil {
+		log.Printf("Refused file request for %s from %s: %v", filename, senderAddr, err)
+		reason := filetransfer.ErrFileNotFound
+		if errors.Is(err, filetransfer.ErrNotPermitted) {
+			reason = filetransfer.ErrNotPermitted
+		}
+		refuseFile(h.eventManager, h.serverAddr, senderAddr, filename, reason)
+		return
+	}
+
 	// 触发一个事件，通知 Node 发送文件
 	eventData := events.FileRequestEventData{
-		Filename:        filename,
+		Filename:        target,
 		DestinationAddr: senderAddr,
 	}
 	h.eventManager.Publish(events.FileRequestEvent{EventData: eventData})
 }
+
+// refuseFile tells the peer at addr that its request for name failed.
+func refuseFile(eventManager *events.EventManager, serverAddr string, addr string, name string, reason error) {
+	reply := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message: message.Message{
+			Type:   "file_request_error",
+			Data:   filetransfer.RequestError{Name: name, Error: reason.Error()},
+			Sender: serverAddr,
+		},
+	}
+	eventManager.Publish(events.SendMessageEvent{EventData: reply})
+}
+
+// FileRequestErrorHandler handles refusals of file requests.
+type FileRequestErrorHandler struct{}
+
+// NewFileRequestErrorHandler creates a new FileRequestErrorHandler instance.
+func NewFileRequestErrorHandler() *FileRequestErrorHandler {
+	return &FileRequestErrorHandler{}
+}
+
+// Handle processes a file request error message.
+func (h *FileRequestErrorHandler) Handle(senderAddr string, msg message.Message) {
+	var requestError filetransfer.RequestError
+	if err := msg.DecodeData(&requestError); err != nil {
+		log.Printf("Invalid file request error from %s", senderAddr)
+		return
+	}
+	log.Printf("File request for %s refused by %s: %s", requestError.Name, senderAddr, requestError.Error)
+}
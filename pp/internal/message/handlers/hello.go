@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"pp/internal/compress"
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/message"
+	"pp/internal/nat"
+	"pp/internal/peer"
+	"pp/internal/relay"
+	"strconv"
+)
+
+// HelloHandler handles the hello message peers send when a connection opens.
+type HelloHandler struct {
+	peerManager  *peer.Manager
+	identity     *identity.Identity
+	listenPort   int
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewHelloHandler creates a new HelloHandler instance.
+func NewHelloHandler(peerManager *peer.Manager, id *identity.Identity, listenPort int, serverAddr string, eventManager *events.EventManager) *HelloHandler {
+	return &HelloHandler{
+		peerManager:  peerManager,
+		identity:     id,
+		listenPort:   listenPort,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes a hello message.
+func (h *HelloHandler) Handle(senderAddr string, msg message.Message) {
+	var data peer.HelloData
+	if err := msg.DecodeData(&data); err != nil || data.NodeID == "" || len(data.Challenge) != peer.ChallengeSize ||
+		len(data.PublicKey) != identity.KeySize || identity.NodeIDOf(data.SigningKey) != data.NodeID {
+		log.Printf("Invalid hello from %s", senderAddr)
+		return
+	}
+
+	// circuit 和 UDP 路径没有连接事件，由发起方的 hello 开始握手
+	if _, ok := h.peerManager.GetPeer(senderAddr); !ok && (relay.IsCircuitAddr(senderAddr) || nat.IsUDPAddr(senderAddr)) {
+		h.peerManager.AddPeer(senderAddr)
+		h.sendHello(senderAddr)
+	}
+
+	listenAddr := ""
+	if host, _, err := net.SplitHostPort(senderAddr); err == nil && data.ListenPort > 0 {
+		listenAddr = net.JoinHostPort(host, strconv.Itoa(data.ListenPort))
+	}
+	if !h.peerManager.SetClaim(senderAddr, data, listenAddr) {
+		return
+	}
+	// 双方都支持的压缩算法，之后发给对方的帧按需压缩
+	h.peerManager.SetCompression(senderAddr, compress.Negotiate(data.Compression))
+	h.peerManager.SetChunkFrames(senderAddr, data.ChunkFrames)
+	h.send(senderAddr, message.Message{Type: "hello_proof", Data: peer.Prove(h.identity, data.Challenge), Sender: h.serverAddr})
+
+	// 通过 UDP 让对方观察我们的外部地址
+	if listenAddr != "" {
+		h.send("udp://"+listenAddr, message.Message{
+			Type:   "observe_addr",
+			Data:   nat.ObserveData{NodeID: h.identity.NodeID()},
+			Sender: h.serverAddr,
+		})
+	}
+}
+
+// sendHello sends this node's hello to the peer at addr.
+func (h *HelloHandler) sendHello(addr string) {
+	challenge, ok := h.peerManager.NewChallenge(addr)
+	if !ok {
+		return
+	}
+	hello := peer.NewHello(h.identity, h.listenPort, challenge)
+	h.send(addr, message.Message{Type: "hello", Data: hello, Sender: h.serverAddr})
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (h *HelloHandler) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	h.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// HelloProofHandler handles the answers of peers to the challenge in this
+// node's hello.
+type HelloProofHandler struct {
+	peerManager  *peer.Manager
+	eventManager *events.EventManager
+}
+
+// NewHelloProofHandler creates a new HelloProofHandler instance.
+func NewHelloProofHandler(peerManager *peer.Manager, eventManager *events.EventManager) *HelloProofHandler {
+	return &HelloProofHandler{peerManager: peerManager, eventManager: eventManager}
+}
+
+// Handle processes a hello_proof message.
+func (h *HelloProofHandler) Handle(senderAddr string, msg message.Message) {
+	var proof peer.HelloProof
+	if err := msg.DecodeData(&proof); err != nil {
+		log.Printf("Invalid hello proof from %s", senderAddr)
+		return
+	}
+
+	p, ok := h.peerManager.Prove(senderAddr, proof)
+	if !ok {
+		log.Printf("Peer %s failed to prove its identity", senderAddr)
+		return
+	}
+	log.Printf("Peer %s is node %s", senderAddr, p.NodeID)
+
+	eventData := events.PeerIdentifiedEventData{Addr: senderAddr, NodeID: p.NodeID}
+	h.eventManager.Publish(events.PeerIdentifiedEvent{EventData: eventData})
+}
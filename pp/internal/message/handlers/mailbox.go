@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"log"
+	"pp/internal/mailbox"
+	"pp/internal/message"
+)
+
+// MailHandler handles mail for this node and mail held for other nodes.
+type MailHandler struct {
+	mailbox *mailbox.Mailbox
+}
+
+// NewMailHandler creates a new MailHandler instance.
+func NewMailHandler(mailbox *mailbox.Mailbox) *MailHandler {
+	return &MailHandler{mailbox: mailbox}
+}
+
+// Handle processes a mail message.
+func (h *MailHandler) Handle(senderAddr string, msg message.Message) {
+	var mail mailbox.Mail
+	if err := msg.DecodeData(&mail); err != nil {
+		log.Printf("Invalid mail from %s", senderAddr)
+		return
+	}
+	if err := h.mailbox.HandleMail(senderAddr, mail); err != nil {
+		log.Printf("Rejected mail from %s: %v", senderAddr, err)
+	}
+}
+
+// MailReceiptHandler handles delivery receipts of sent mail.
+type MailReceiptHandler struct {
+	mailbox *mailbox.Mailbox
+}
+
+// NewMailReceiptHandler creates a new MailReceiptHandler instance.
+func NewMailReceiptHandler(mailbox *mailbox.Mailbox) *MailReceiptHandler {
+	return &MailReceiptHandler{mailbox: mailbox}
+}
+
+// Handle processes a mail receipt message.
+func (h *MailReceiptHandler) Handle(senderAddr string, msg message.Message) {
+	var receipt mailbox.Receipt
+	if err := msg.DecodeData(&receipt); err != nil || receipt.ID == "" {
+		log.Printf("Invalid mail receipt from %s", senderAddr)
+		return
+	}
+	h.mailbox.HandleReceipt(senderAddr, receipt)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"log"
+	"pp/internal/events"
+	"pp/internal/message"
+	"pp/internal/nat"
+	"pp/internal/peer"
+)
+
+// ObserveAddrHandler answers "what address do you see me as" requests.
+type ObserveAddrHandler struct {
+	natService   *nat.Service
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewObserveAddrHandler creates a new ObserveAddrHandler instance.
+func NewObserveAddrHandler(natService *nat.Service, serverAddr string, eventManager *events.EventManager) *ObserveAddrHandler {
+	return &ObserveAddrHandler{
+		natService:   natService,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes an observe_addr message.
+func (h *ObserveAddrHandler) Handle(senderAddr string, msg message.Message) {
+	var data nat.ObserveData
+	if err := msg.DecodeData(&data); err != nil {
+		log.Printf("Invalid observe_addr from %s", senderAddr)
+		return
+	}
+
+	// 记录 UDP 映射地址，用于之后协调打洞
+	if nat.IsUDPAddr(senderAddr) && data.NodeID != "" {
+		h.natService.RecordObserved(data.NodeID, senderAddr)
+	}
+
+	eventData := events.SendMessageEventData{
+		DestinationAddr: senderAddr,
+		Message: message.Message{
+			Type:   "observed_addr",
+			Data:   nat.ObservedData{Addr: senderAddr},
+			Sender: h.serverAddr,
+		},
+	}
+	h.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// ObservedAddrHandler handles answers to observe_addr.
+type ObservedAddrHandler struct {
+	natService *nat.Service
+}
+
+// NewObservedAddrHandler creates a new ObservedAddrHandler instance.
+func NewObservedAddrHandler(natService *nat.Service) *ObservedAddrHandler {
+	return &ObservedAddrHandler{natService: natService}
+}
+
+// Handle processes an observed_addr message.
+func (h *ObservedAddrHandler) Handle(senderAddr string, msg message.Message) {
+	var data nat.ObservedData
+	if err := msg.DecodeData(&data); err != nil {
+		log.Printf("Invalid observed_addr from %s", senderAddr)
+		return
+	}
+
+	if nat.IsUDPAddr(data.Addr) {
+		h.natService.SetPublicAddr(data.Addr)
+	} else {
+		log.Printf("Peer %s sees us as %s", senderAddr, data.Addr)
+	}
+}
+
+// PunchRequestHandler coordinates hole punching between two peers that are
+// both connected to this node.
+type PunchRequestHandler struct {
+	natService   *nat.Service
+	peerManager  *peer.Manager
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewPunchRequestHandler creates a new PunchRequestHandler instance.
+func NewPunchRequestHandler(natService *nat.Service, peerManager *peer.Manager, serverAddr string, eventManager *events.EventManager) *PunchRequestHandler {
+	return &PunchRequestHandler{
+		natService:   natService,
+		peerManager:  peerManager,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes a punch_request message.
+func (h *PunchRequestHandler) Handle(senderAddr string, msg message.Message) {
+	var data nat.PunchRequestData
+	if err := msg.DecodeData(&data); err != nil || data.Nonce == "" {
+		log.Printf("Invalid punch_request from %s", senderAddr)
+		return
+	}
+
+	source, ok := h.peerManager.GetPeer(senderAddr)
+	if !ok || source.NodeID == "" {
+		h.send(senderAddr, nat.PunchSyncData{Nonce: data.Nonce, Error: "requester has not said hello"})
+		return
+	}
+	target, ok := h.peerManager.FindByID(data.Target)
+	if !ok {
+		h.send(senderAddr, nat.PunchSyncData{Nonce: data.Nonce, Error: "target is not connected"})
+		return
+	}
+	sourceUDP, ok := h.natService.Observed(source.NodeID)
+	if !ok {
+		h.send(senderAddr, nat.PunchSyncData{Nonce: data.Nonce, Error: "requester udp address unknown"})
+		return
+	}
+	targetUDP, ok := h.natService.Observed(target.NodeID)
+	if !ok {
+		h.send(senderAddr, nat.PunchSyncData{Nonce: data.Nonce, Error: "target udp address unknown"})
+		return
+	}
+
+	log.Printf("Coordinating hole punching between %s and %s", source.NodeID, target.NodeID)
+	h.send(target.Addr, nat.PunchSyncData{PeerID: source.NodeID, Addr: sourceUDP, Nonce: data.Nonce})
+	h.send(senderAddr, nat.PunchSyncData{PeerID: target.NodeID, Addr: targetUDP, Nonce: data.Nonce})
+}
+
+// send publishes a SendMessageEvent carrying a punch_sync message.
+func (h *PunchRequestHandler) send(addr string, data nat.PunchSyncData) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message: message.Message{
+			Type:   "punch_sync",
+			Data:   data,
+			Sender: h.serverAddr,
+		},
+	}
+	h.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
+
+// PunchSyncHandler starts hole punching when the rendezvous peer says so.
+type PunchSyncHandler struct {
+	natService *nat.Service
+}
+
+// NewPunchSyncHandler creates a new PunchSyncHandler instance.
+func NewPunchSyncHandler(natService *nat.Service) *PunchSyncHandler {
+	return &PunchSyncHandler{natService: natService}
+}
+
+// Handle processes a punch_sync message.
+func (h *PunchSyncHandler) Handle(senderAddr string, msg message.Message) {
+	var data nat.PunchSyncData
+	if err := msg.DecodeData(&data); err != nil || data.Nonce == "" {
+		log.Printf("Invalid punch_sync from %s", senderAddr)
+		return
+	}
+
+	// 打洞会持续发送探测包，不能阻塞网络事件循环
+	go h.natService.Sync(data)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"log"
+	"pp/internal/events"
+	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/relay"
+)
+
+// RelayReserveHandler handles relay reservation requests.
+type RelayReserveHandler struct {
+	relayService *relay.Service
+	peerManager  *peer.Manager
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewRelayReserveHandler creates a new RelayReserveHandler instance.
+func NewRelayReserveHandler(relayService *relay.Service, peerManager *peer.Manager, serverAddr string, eventManager *events.EventManager) *RelayReserveHandler {
+	return &RelayReserveHandler{
+		relayService: relayService,
+		peerManager:  peerManager,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes a relay_reserve message.
+func (h *RelayReserveHandler) Handle(senderAddr string, msg message.Message) {
+	var data relay.ReserveData
+	if err := msg.DecodeData(&data); err != nil || data.NodeID == "" {
+		log.Printf("Invalid relay reservation from %s", senderAddr)
+		return
+	}
+
+	// 只能为本连接 hello 中证明过的节点 ID 预留
+	status := relay.StatusData{OK: true}
+	if p, ok := h.peerManager.GetPeer(senderAddr); !ok || p.NodeID == "" || p.NodeID != data.NodeID {
+		status = relay.StatusData{Error: relay.ErrUnprovenNode.Error()}
+	} else if err := h.relayService.Reserve(senderAddr, data.NodeID); err != nil {
+		status = relay.StatusData{Error: err.Error()}
+	}
+	sendRelayStatus(h.eventManager, h.serverAddr, senderAddr, status)
+}
+
+// RelayConnectHandler handles circuit requests on the relay and circuit
+// notifications on the target.
+type RelayConnectHandler struct {
+	relayService *relay.Service
+	relayClient  *relay.Client
+	nodeID       string
+	serverAddr   string
+	eventManager *events.EventManager
+}
+
+// NewRelayConnectHandler creates a new RelayConnectHandler instance.
+func NewRelayConnectHandler(relayService *relay.Service, relayClient *relay.Client, nodeID string, serverAddr string, eventManager *events.EventManager) *RelayConnectHandler {
+	return &RelayConnectHandler{
+		relayService: relayService,
+		relayClient:  relayClient,
+		nodeID:       nodeID,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+	}
+}
+
+// Handle processes a relay_connect message.
+func (h *RelayConnectHandler) Handle(senderAddr string, msg message.Message) {
+	var data relay.ConnectData
+	if err := msg.DecodeData(&data); err != nil || data.CircuitID == "" {
+		log.Printf("Invalid relay connect from %s", senderAddr)
+		return
+	}
+
+	// 目标是本节点：中继通知我们有新的 circuit
+	if data.Target == h.nodeID {
+		addr := h.relayClient.Accept(senderAddr, data)
+		log.Printf("Accepted relayed connection from %s on %s", data.From, addr)
+		return
+	}
+
+	status := relay.StatusData{CircuitID: data.CircuitID, OK: true}
+	if err := h.relayService.Connect(senderAddr, data); err != nil {
+		status = relay.StatusData{CircuitID: data.CircuitID, Error: err.Error()}
+	}
+	sendRelayStatus(h.eventManager, h.serverAddr, senderAddr, status)
+}
+
+// RelayDataHandler handles relayed frames.
+type RelayDataHandler struct {
+	relayService *relay.Service
+	relayClient  *relay.Client
+}
+
+// NewRelayDataHandler creates a new RelayDataHandler instance.
+func NewRelayDataHandler(relayService *relay.Service, relayClient *relay.Client) *RelayDataHandler {
+	return &RelayDataHandler{relayService: relayService, relayClient: relayClient}
+}
+
+// Handle processes a relay_data message.
+func (h *RelayDataHandler) Handle(senderAddr string, msg message.Message) {
+	var data relay.Data
+	if err := msg.DecodeData(&data); err != nil {
+		log.Printf("Invalid relay data from %s", senderAddr)
+		return
+	}
+
+	if h.relayService.Forward(senderAddr, data) {
+		return
+	}
+	if err := h.relayClient.Deliver(senderAddr, data); err != nil {
+		log.Printf("Dropping relay data on circuit %s from %s: %v", data.CircuitID, senderAddr, err)
+	}
+}
+
+// RelayCloseHandler handles circuit teardown.
+type RelayCloseHandler struct {
+	relayService *relay.Service
+	relayClient  *relay.Client
+}
+
+// NewRelayCloseHandler creates a new RelayCloseHandler instance.
+func NewRelayCloseHandler(relayService *relay.Service, relayClient *relay.Client) *RelayCloseHandler {
+	return &RelayCloseHandler{relayService: relayService, relayClient: relayClient}
+}
+
+// Handle processes a relay_close message.
+func (h *RelayCloseHandler) Handle(senderAddr string, msg message.Message) {
+	var data relay.CloseData
+	if err := msg.DecodeData(&data); err != nil {
+		log.Printf("Invalid relay close from %s", senderAddr)
+		return
+	}
+
+	if h.relayService.Close(senderAddr, data.CircuitID) {
+		return
+	}
+	h.relayClient.Close(relay.CircuitAddr(senderAddr, data.CircuitID), false)
+}
+
+// RelayStatusHandler handles relay responses.
+type RelayStatusHandler struct {
+	relayClient *relay.Client
+}
+
+// NewRelayStatusHandler creates a new RelayStatusHandler instance.
+func NewRelayStatusHandler(relayClient *relay.Client) *RelayStatusHandler {
+	return &RelayStatusHandler{relayClient: relayClient}
+}
+
+// Handle processes a relay_status message.
+func (h *RelayStatusHandler) Handle(senderAddr string, msg message.Message) {
+	var status relay.StatusData
+	if err := msg.DecodeData(&status); err != nil {
+		log.Printf("Invalid relay status from %s", senderAddr)
+		return
+	}
+
+	if status.CircuitID == "" {
+		if !status.OK {
+			log.Printf("Relay %s rejected reservation: %s", senderAddr, status.Error)
+		}
+		return
+	}
+	h.relayClient.HandleStatus(status)
+}
+
+// sendRelayStatus publishes a SendMessageEvent carrying a relay_status reply.
+func sendRelayStatus(eventManager *events.EventManager, serverAddr string, destinationAddr string, status relay.StatusData) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: destinationAddr,
+		Message: message.Message{
+			Type:   "relay_status",
+			Data:   status,
+			Sender: serverAddr,
+		},
+	}
+	eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
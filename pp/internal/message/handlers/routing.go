@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"log"
+	"pp/internal/message"
+	"pp/internal/routing"
+)
+
+// RoutedHandler handles messages routed by node ID.
+type RoutedHandler struct {
+	routingService *routing.Service
+}
+
+// NewRoutedHandler creates a new RoutedHandler instance.
+func NewRoutedHandler(routingService *routing.Service) *RoutedHandler {
+	return &RoutedHandler{routingService: routingService}
+}
+
+// Handle processes a routed message.
+func (h *RoutedHandler) Handle(senderAddr string, msg message.Message) {
+	var env routing.Envelope
+	if err := msg.DecodeData(&env); err != nil || env.ID == "" || env.To == "" {
+		log.Printf("Invalid routed message from %s", senderAddr)
+		return
+	}
+
+	h.routingService.HandleEnvelope(senderAddr, env)
+}
+
+// RouteLookupHandler handles route lookups.
+type RouteLookupHandler struct {
+	routingService *routing.Service
+}
+
+// NewRouteLookupHandler creates a new RouteLookupHandler instance.
+func NewRouteLookupHandler(routingService *routing.Service) *RouteLookupHandler {
+	return &RouteLookupHandler{routingService: routingService}
+}
+
+// Handle processes a route_lookup message.
+func (h *RouteLookupHandler) Handle(senderAddr string, msg message.Message) {
+	var data routing.LookupData
+	if err := msg.DecodeData(&data); err != nil || data.ID == "" || data.Target == "" {
+		log.Printf("Invalid route lookup from %s", senderAddr)
+		return
+	}
+
+	h.routingService.HandleLookup(senderAddr, data)
+}
+
+// RouteFoundHandler handles answers to route lookups.
+type RouteFoundHandler struct {
+	routingService *routing.Service
+}
+
+// NewRouteFoundHandler creates a new RouteFoundHandler instance.
+func NewRouteFoundHandler(routingService *routing.Service) *RouteFoundHandler {
+	return &RouteFoundHandler{routingService: routingService}
+}
+
+// Handle processes a route_found message.
+func (h *RouteFoundHandler) Handle(senderAddr string, msg message.Message) {
+	var data routing.FoundData
+	if err := msg.DecodeData(&data); err != nil || data.ID == "" {
+		log.Printf("Invalid route answer from %s", senderAddr)
+		return
+	}
+
+	h.routingService.HandleFound(senderAddr, data)
+}
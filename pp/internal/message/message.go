@@ -22,3 +22,13 @@ func Deserialize(data []byte) (Message, error) {
 	err := json.Unmarshal(data, &msg)
 	return msg, err
 }
+
+// DecodeData decodes the message payload into v.
+// Payloads arrive from the network as generic JSON values, so they are re-encoded first.
+func (m Message) DecodeData(v interface{}) error {
+	raw, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,171 @@
+package nat
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/message"
+)
+
+// DefaultPunchTimeout bounds how long each side keeps sending probes.
+const DefaultPunchTimeout = 5 * time.Second
+
+// ObserveData is the payload of an observe_addr message.
+type ObserveData struct {
+	NodeID string `json:"node_id"`
+}
+
+// ObservedData is the payload of an observed_addr message.
+type ObservedData struct {
+	Addr string `json:"addr"`
+}
+
+// PunchRequestData is the payload of a punch_request message, sent to a
+// peer connected to both sides to start hole punching towards Target.
+type PunchRequestData struct {
+	Target string `json:"target"`
+	Nonce  string `json:"nonce"`
+}
+
+// PunchSyncData is the payload of a punch_sync message. The rendezvous peer
+// sends it to both sides at once; a non-empty Error aborts the attempt.
+type PunchSyncData struct {
+	PeerID string `json:"peer_id,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	Nonce  string `json:"nonce"`
+	Error  string `json:"error,omitempty"`
+}
+
+// punchResult is the outcome of a hole punching attempt.
+type punchResult struct {
+	addr string
+	err  error
+}
+
+// Service tracks observed UDP addresses and coordinates hole punching.
+type Service struct {
+	transport    *Transport
+	serverAddr   string
+	eventManager *events.EventManager
+
+	mu         sync.Mutex
+	observed   map[string]string // node ID -> UDP address as seen by this node
+	publicAddr string            // this node's UDP address as seen by a peer
+	pending    map[string]chan punchResult
+}
+
+// NewService creates a new Service instance.
+func NewService(transport *Transport, serverAddr string, eventManager *events.EventManager) *Service {
+	return &Service{
+		transport:    transport,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+		observed:     make(map[string]string),
+		pending:      make(map[string]chan punchResult),
+	}
+}
+
+// RecordObserved remembers the UDP address a node's traffic arrived from.
+func (s *Service) RecordObserved(nodeID string, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observed[nodeID] = addr
+}
+
+// Observed returns the UDP address recorded for nodeID.
+func (s *Service) Observed(nodeID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr, ok := s.observed[nodeID]
+	return addr, ok
+}
+
+// SetPublicAddr records this node's UDP address as reported by a peer.
+func (s *Service) SetPublicAddr(addr string) {
+	s.mu.Lock()
+	changed := s.publicAddr != addr
+	s.publicAddr = addr
+	s.mu.Unlock()
+
+	if changed {
+		log.Printf("Public UDP address is %s", addr)
+	}
+}
+
+// PublicAddr returns this node's UDP address as reported by a peer.
+func (s *Service) PublicAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publicAddr
+}
+
+// HolePunch asks the rendezvous peer to coordinate a direct UDP path to
+// targetID and waits for it. Both nodes must have been observed by the
+// rendezvous peer beforehand.
+func (s *Service) HolePunch(rendezvousAddr string, targetID string, nonce string, timeout time.Duration) (string, error) {
+	resultCh := make(chan punchResult, 1)
+	s.mu.Lock()
+	s.pending[nonce] = resultCh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, nonce)
+		s.mu.Unlock()
+	}()
+
+	s.send(rendezvousAddr, message.Message{
+		Type:   "punch_request",
+		Data:   PunchRequestData{Target: targetID, Nonce: nonce},
+		Sender: s.serverAddr,
+	})
+
+	select {
+	case result := <-resultCh:
+		return result.addr, result.err
+	case <-time.After(timeout):
+		return "", ErrPunchTimeout
+	}
+}
+
+// Sync starts punching towards the address announced in a punch_sync
+// message and reports the outcome to a waiting HolePunch, if any.
+func (s *Service) Sync(data PunchSyncData) {
+	if data.Error != "" {
+		s.resolve(data.Nonce, punchResult{err: errors.New(data.Error)})
+		return
+	}
+
+	addr, err := s.transport.Punch(data.Addr, data.Nonce, DefaultPunchTimeout)
+	if err != nil {
+		log.Printf("Hole punching to %s at %s failed: %v", data.PeerID, data.Addr, err)
+	} else {
+		log.Printf("Hole punching to %s succeeded via %s", data.PeerID, addr)
+	}
+	s.resolve(data.Nonce, punchResult{addr: addr, err: err})
+}
+
+// resolve hands a result to the HolePunch waiting on nonce.
+func (s *Service) resolve(nonce string, result punchResult) {
+	s.mu.Lock()
+	resultCh, ok := s.pending[nonce]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case resultCh <- result:
+	default:
+	}
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (s *Service) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	s.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
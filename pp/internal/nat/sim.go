@@ -0,0 +1,206 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// simInboxSize bounds the datagrams queued on a simulated socket; extra ones are dropped.
+const simInboxSize = 256
+
+// Simulator is an in-process packet network for exercising hole punching
+// without real NATs or network namespaces. Hosts behind a simulated NAT get
+// an endpoint-independent mapping with port-restricted filtering: inbound
+// datagrams are dropped unless the host has already sent to that address.
+type Simulator struct {
+	mu       sync.Mutex
+	hosts    map[string]*simConn // address on the simulated network -> socket
+	nextPort int
+}
+
+// NewSimulator creates a new Simulator instance.
+func NewSimulator() *Simulator {
+	return &Simulator{
+		hosts:    make(map[string]*simConn),
+		nextPort: 40000,
+	}
+}
+
+// Listen attaches a publicly reachable socket at addr.
+func (s *Simulator) Listen(addr string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.attach(udpAddr, udpAddr, false)
+}
+
+// ListenBehindNAT attaches a socket at privateAddr behind a NAT whose
+// external address is publicIP. The socket is mapped to a fresh public port.
+func (s *Simulator) ListenBehindNAT(privateAddr string, publicIP string) (net.PacketConn, error) {
+	inner, err := net.ResolveUDPAddr("udp", privateAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	port := s.nextPort
+	s.nextPort++
+	s.mu.Unlock()
+
+	mapped, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", publicIP, port))
+	if err != nil {
+		return nil, err
+	}
+	return s.attach(mapped, inner, true)
+}
+
+// NATListener returns a ListenFunc that attaches sockets behind a NAT with
+// external address publicIP, for injecting into a node.
+func (s *Simulator) NATListener(publicIP string) ListenFunc {
+	return func(addr string) (net.PacketConn, error) {
+		return s.ListenBehindNAT(addr, publicIP)
+	}
+}
+
+// attach registers a socket reachable at external.
+func (s *Simulator) attach(external *net.UDPAddr, local *net.UDPAddr, natted bool) (*simConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hosts[external.String()]; ok {
+		return nil, fmt.Errorf("address %s already in use", external)
+	}
+	c := &simConn{
+		sim:      s,
+		external: external,
+		local:    local,
+		natted:   natted,
+		allowed:  make(map[string]bool),
+		inbox:    make(chan simPacket, simInboxSize),
+		done:     make(chan struct{}),
+	}
+	s.hosts[external.String()] = c
+	return c, nil
+}
+
+// deliver routes a datagram from one external address to another.
+func (s *Simulator) deliver(from *net.UDPAddr, to string, payload []byte) {
+	s.mu.Lock()
+	c, ok := s.hosts[to]
+	s.mu.Unlock()
+	if !ok || !c.accepts(from.String()) {
+		return
+	}
+	select {
+	case c.inbox <- simPacket{from: from, payload: payload}:
+	default:
+	}
+}
+
+// detach removes a closed socket.
+func (s *Simulator) detach(c *simConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hosts, c.external.String())
+}
+
+// simPacket is a datagram in flight on the simulated network.
+type simPacket struct {
+	from    *net.UDPAddr
+	payload []byte
+}
+
+// simConn is a net.PacketConn on the simulated network.
+type simConn struct {
+	sim      *Simulator
+	external *net.UDPAddr // address seen by other hosts
+	local    *net.UDPAddr // address the host bound to
+	natted   bool
+
+	mu       sync.Mutex
+	allowed  map[string]bool // NAT filter: remotes this host has sent to
+	deadline time.Time
+
+	inbox     chan simPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// accepts reports whether the NAT in front of c lets a datagram from addr through.
+func (c *simConn) accepts(addr string) bool {
+	if !c.natted {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allowed[addr]
+}
+
+func (c *simConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.inbox:
+		return copy(p, pkt.payload), pkt.from, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	to := addr.String()
+	if c.natted {
+		c.mu.Lock()
+		c.allowed[to] = true
+		c.mu.Unlock()
+	}
+	c.sim.deliver(c.external, to, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.sim.detach(c)
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	udpAddrPrefix = "udp://"
+
+	// maxDatagramSize is the largest message that fits in a single UDP datagram.
+	maxDatagramSize = 65507 - 1
+
+	punchInterval = 200 * time.Millisecond
+)
+
+// Packet kinds, carried in the first byte of every datagram.
+const (
+	kindData byte = iota + 1
+	kindPunch
+	kindPunchAck
+)
+
+var (
+	ErrNotStarted     = errors.New("udp transport not started")
+	ErrTooLarge       = errors.New("message too large for a datagram")
+	ErrPunchTimeout   = errors.New("hole punching timed out")
+	ErrInvalidUDPAddr = errors.New("invalid udp address")
+)
+
+// ListenFunc opens the packet socket a Transport serves on. Nodes use
+// ListenUDP; tests pass a Simulator socket instead.
+type ListenFunc func(addr string) (net.PacketConn, error)
+
+// ListenUDP opens a real UDP socket at addr.
+func ListenUDP(addr string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", addr)
+}
+
+// UDPAddr returns the address under which a UDP endpoint is known locally.
+func UDPAddr(addr net.Addr) string {
+	return udpAddrPrefix + addr.String()
+}
+
+// IsUDPAddr reports whether addr refers to a UDP endpoint.
+func IsUDPAddr(addr string) bool {
+	return strings.HasPrefix(addr, udpAddrPrefix)
+}
+
+// Transport carries messages and hole punching probes over a UDP socket.
+type Transport struct {
+	mu       sync.Mutex
+	conn     net.PacketConn
+	handler  func(string, []byte)
+	sessions map[string]chan net.Addr // punch nonce -> waiting Punch
+}
+
+// NewTransport creates a new Transport instance.
+func NewTransport() *Transport {
+	return &Transport{
+		handler:  func(string, []byte) {}, // 默认空函数
+		sessions: make(map[string]chan net.Addr),
+	}
+}
+
+// SetMessageHandler 设置消息处理函数
+func (t *Transport) SetMessageHandler(handler func(string, []byte)) {
+	t.handler = handler
+}
+
+// Serve reads datagrams from conn until it is closed.
+// Any net.PacketConn works, which allows running over a simulated NAT.
+func (t *Transport) Serve(conn net.PacketConn) error {
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize+1)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		t.handlePacket(from, buf[0], append([]byte(nil), buf[1:n]...))
+	}
+}
+
+// Close closes the underlying socket.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+// LocalAddr returns the local address of the socket.
+func (t *Transport) LocalAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.LocalAddr()
+}
+
+// Send sends a serialized message to a udp:// address.
+func (t *Transport) Send(addr string, message []byte) error {
+	if len(message) > maxDatagramSize {
+		return ErrTooLarge
+	}
+	remote, err := resolve(addr)
+	if err != nil {
+		return err
+	}
+	return t.write(remote, kindData, message)
+}
+
+// Punch sends probes carrying nonce to remote until the other side's probes
+// get through or timeout expires. Both sides must punch at the same time.
+// It returns the address the remote side's traffic actually arrived from.
+func (t *Transport) Punch(addr string, nonce string, timeout time.Duration) (string, error) {
+	remote, err := resolve(addr)
+	if err != nil {
+		return "", err
+	}
+
+	established := make(chan net.Addr, 1)
+	t.mu.Lock()
+	t.sessions[nonce] = established
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.sessions, nonce)
+		t.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		if err := t.write(remote, kindPunch, []byte(nonce)); err != nil {
+			return "", err
+		}
+		select {
+		case from := <-established:
+			return UDPAddr(from), nil
+		case <-ticker.C:
+		case <-deadline:
+			return "", ErrPunchTimeout
+		}
+	}
+}
+
+// handlePacket dispatches a received datagram by kind.
+func (t *Transport) handlePacket(from net.Addr, kind byte, payload []byte) {
+	switch kind {
+	case kindData:
+		t.handler(UDPAddr(from), payload)
+	case kindPunch, kindPunchAck:
+		if kind == kindPunch {
+			// 回复 ack，确保对方也能看到我们的包
+			t.write(from, kindPunchAck, payload)
+		}
+		t.mu.Lock()
+		established, ok := t.sessions[string(payload)]
+		t.mu.Unlock()
+		if ok {
+			select {
+			case established <- from:
+			default:
+			}
+		}
+	}
+}
+
+// write sends one datagram of the given kind.
+func (t *Transport) write(remote net.Addr, kind byte, payload []byte) error {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return ErrNotStarted
+	}
+
+	packet := make([]byte, 0, len(payload)+1)
+	packet = append(packet, kind)
+	packet = append(packet, payload...)
+	_, err := conn.WriteTo(packet, remote)
+	return err
+}
+
+// resolve parses a udp:// address.
+func resolve(addr string) (net.Addr, error) {
+	if !IsUDPAddr(addr) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUDPAddr, addr)
+	}
+	return net.ResolveUDPAddr("udp", strings.TrimPrefix(addr, udpAddrPrefix))
+}
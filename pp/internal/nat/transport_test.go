@@ -0,0 +1,121 @@
+package nat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// udpPacket is a data message received by a test transport.
+type udpPacket struct {
+	from    string
+	payload string
+}
+
+// startNATted serves a Transport on a socket behind a simulated NAT and
+// returns it with the address other hosts reach it at.
+func startNATted(t *testing.T, sim *Simulator, privateAddr string, publicIP string) (*Transport, string, <-chan udpPacket) {
+	t.Helper()
+
+	conn, err := sim.NATListener(publicIP)(privateAddr)
+	if err != nil {
+		t.Fatalf("ListenBehindNAT(%s): %v", privateAddr, err)
+	}
+	received := make(chan udpPacket, 16)
+	transport := NewTransport()
+	transport.SetMessageHandler(func(from string, payload []byte) {
+		received <- udpPacket{from: from, payload: string(payload)}
+	})
+	go transport.Serve(conn)
+	t.Cleanup(func() { transport.Close() })
+	for transport.LocalAddr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	return transport, UDPAddr(conn.(*simConn).external), received
+}
+
+// expectPacket waits for a data message on received.
+func expectPacket(t *testing.T, received <-chan udpPacket, from string, payload string) {
+	t.Helper()
+
+	select {
+	case pkt := <-received:
+		if pkt.from != from || pkt.payload != payload {
+			t.Fatalf("received %q from %s, want %q from %s", pkt.payload, pkt.from, payload, from)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no message from %s", from)
+	}
+}
+
+func TestPunchThroughSimulatedNATs(t *testing.T) {
+	sim := NewSimulator()
+	a, addrA, receivedA := startNATted(t, sim, "192.168.1.10:9000", "203.0.113.1")
+	b, addrB, receivedB := startNATted(t, sim, "10.0.0.20:9000", "198.51.100.2")
+
+	// 没有打洞之前，B 的 NAT 会丢弃 A 的包
+	if err := a.Send(addrB, []byte("too early")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case pkt := <-receivedB:
+		t.Fatalf("NAT let %q through before punching", pkt.payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	type result struct {
+		addr string
+		err  error
+	}
+	resultA := make(chan result, 1)
+	go func() {
+		addr, err := a.Punch(addrB, "nonce", time.Second)
+		resultA <- result{addr, err}
+	}()
+	addr, err := b.Punch(addrA, "nonce", time.Second)
+	if err != nil || addr != addrA {
+		t.Fatalf("B punched to %q (%v), want %s", addr, err, addrA)
+	}
+	if r := <-resultA; r.err != nil || r.addr != addrB {
+		t.Fatalf("A punched to %q (%v), want %s", r.addr, r.err, addrB)
+	}
+
+	if err := a.Send(addrB, []byte("hello from a")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	expectPacket(t, receivedB, addrA, "hello from a")
+	if err := b.Send(addrA, []byte("hello from b")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	expectPacket(t, receivedA, addrB, "hello from b")
+}
+
+func TestPunchTimesOutWithoutPeer(t *testing.T) {
+	sim := NewSimulator()
+	a, _, _ := startNATted(t, sim, "192.168.1.10:9000", "203.0.113.1")
+	_, addrB, _ := startNATted(t, sim, "10.0.0.20:9000", "198.51.100.2")
+
+	// B 不打洞，A 的探测包全部被 B 的 NAT 丢弃
+	if _, err := a.Punch(addrB, "nonce", 500*time.Millisecond); !errors.Is(err, ErrPunchTimeout) {
+		t.Fatalf("Punch = %v, want %v", err, ErrPunchTimeout)
+	}
+}
+
+func TestSimulatorRejectsAddressInUse(t *testing.T) {
+	sim := NewSimulator()
+	conn, err := sim.Listen("192.0.2.1:9000")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := sim.Listen("192.0.2.1:9000"); err == nil {
+		t.Fatal("second Listen on the same address succeeded")
+	}
+	conn.Close()
+	if conn, err = sim.Listen("192.0.2.1:9000"); err != nil {
+		t.Fatalf("Listen after Close: %v", err)
+	}
+	conn.Close()
+}
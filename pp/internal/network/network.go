@@ -1,16 +1,25 @@
 ﻿package network
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/panjf2000/gnet"
 )
 
+// frameHeaderLen is the size of the big-endian length prefix on every frame.
+const frameHeaderLen = 4
+
 // NetworkServer 定义网络服务的接口
 type NetworkServer interface {
 	Start() error
 	Stop() error
 	SendMessage(addr string, message []byte) error
+	SendFrame(addr string, frame []byte, release func()) error
+	Connect(addr string) (string, error)
 	SetMessageHandler(handler func(string, []byte))
 	SetConnectHandler(handler func(string))
 	SetDisconnectHandler(handler func(string))
@@ -20,7 +29,9 @@ type NetworkServer interface {
 type Server struct {
 	addr         string
 	eventHandler *eventHandler
-	// gnetServer   gnet.Server
+	codec        gnet.ICodec
+	clientMu     sync.Mutex
+	client       *gnet.Client // 用于主动连接其他节点
 	*gnet.Server
 }
 
@@ -33,27 +44,103 @@ func NewServer(addr string) *Server {
 			connectHandler:    func(string) {},         // 默认空函数
 			disconnectHandler: func(string) {},         // 默认空函数
 		},
+		codec: newFrameCodec(),
+	}
+}
+
+// newFrameCodec returns the length-prefixed codec used on every connection.
+func newFrameCodec() gnet.ICodec {
+	encoderConfig := gnet.EncoderConfig{
+		ByteOrder:         binary.BigEndian,
+		LengthFieldLength: frameHeaderLen,
 	}
+	decoderConfig := gnet.DecoderConfig{
+		ByteOrder:           binary.BigEndian,
+		LengthFieldLength:   frameHeaderLen,
+		InitialBytesToStrip: frameHeaderLen,
+	}
+	return gnet.NewLengthFieldBasedFrameCodec(encoderConfig, decoderConfig)
 }
 
 // Start starts the gnet server.
 func (s *Server) Start() error {
 	log.Printf("Starting network server on %s", s.addr)
-	return gnet.Serve(s.eventHandler, "tcp://"+"localhost"+s.addr, gnet.WithMulticore(true))
+	return gnet.Serve(s.eventHandler, "tcp://"+s.addr, gnet.WithMulticore(true), gnet.WithCodec(s.codec))
 }
 
 // Stop stops the gnet server.
 func (s *Server) Stop() error {
 	log.Println("Stopping network server...")
-	// return s.gnetServer.Shutdown()
-	return nil
+	s.clientMu.Lock()
+	if s.client != nil {
+		s.client.Stop()
+		s.client = nil
+	}
+	s.clientMu.Unlock()
+	return gnet.Stop(context.Background(), "tcp://"+s.addr)
+}
+
+// Connect dials a remote node and returns the address the connection is tracked under.
+func (s *Server) Connect(addr string) (string, error) {
+	client, err := s.dialer()
+	if err != nil {
+		return "", err
+	}
+	c, err := client.Dial("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	remoteAddr := c.RemoteAddr().String()
+	s.eventHandler.conns.Store(remoteAddr, c)
+	return remoteAddr, nil
+}
+
+// dialer returns the gnet client used for outbound connections, starting it on first use.
+func (s *Server) dialer() (*gnet.Client, error) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	client, err := gnet.NewClient(s.eventHandler, gnet.WithCodec(s.codec))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	if err := client.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start client: %w", err)
+	}
+	s.client = client
+	return client, nil
 }
 
 // SendMessage sends a message to a specific address.
 func (s *Server) SendMessage(addr string, message []byte) error {
-	// Implementation using gnet to send the message
-	// (You'll need to maintain a map of connections to addresses)
-	return nil // Placeholder
+	value, ok := s.eventHandler.conns.Load(addr)
+	if !ok {
+		return fmt.Errorf("no connection to %s", addr)
+	}
+	return value.(gnet.Conn).AsyncWrite(message)
+}
+
+// SendFrame sends a frame like SendMessage and calls release once the
+// connection has copied it, so the caller can reuse the buffer. frame must
+// not be empty. release is not called when the connection closes before the
+// frame is written.
+func (s *Server) SendFrame(addr string, frame []byte, release func()) error {
+	value, ok := s.eventHandler.conns.Load(addr)
+	if !ok {
+		release()
+		return fmt.Errorf("no connection to %s", addr)
+	}
+	key := &frame[0]
+	s.eventHandler.pending.Store(key, pendingFrame{addr: addr, release: release})
+	if err := value.(gnet.Conn).AsyncWrite(frame); err != nil {
+		s.eventHandler.pending.Delete(key)
+		release()
+		return err
+	}
+	return nil
 }
 
 // SetMessageHandler 设置消息处理函数
@@ -74,13 +161,24 @@ func (s *Server) SetDisconnectHandler(handler func(string)) {
 // eventHandler implements gnet.EventHandler interface.
 type eventHandler struct {
 	gnet.EventServer
+	conns             sync.Map // map[string]gnet.Conn
+	pending           sync.Map // map[*byte]pendingFrame，等待写出的帧
 	messageHandler    func(string, []byte)
 	connectHandler    func(string)
 	disconnectHandler func(string)
 }
 
+// pendingFrame is a frame sent with SendFrame that has not been written yet.
+type pendingFrame struct {
+	addr    string
+	release func()
+}
+
 // OnInitComplete is called when the server is ready.
 func (eh *eventHandler) OnInitComplete(server gnet.Server) (action gnet.Action) {
+	if server.Addr == nil { // client event loop
+		return
+	}
 	log.Printf("Network server started on %s", server.Addr.String())
 	return
 }
@@ -89,6 +187,7 @@ func (eh *eventHandler) OnInitComplete(server gnet.Server) (action gnet.Action)
 func (eh *eventHandler) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
 	addr := c.RemoteAddr().String()
 	log.Printf("Connection opened: %s", addr)
+	eh.conns.Store(addr, c)
 	eh.connectHandler(addr)
 	return
 }
@@ -97,10 +196,29 @@ func (eh *eventHandler) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
 func (eh *eventHandler) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
 	addr := c.RemoteAddr().String()
 	log.Printf("Connection closed: %s, error: %v", addr, err)
+	eh.conns.Delete(addr)
+	// 连接关闭后不会再写出这些帧，也不会再调用 release
+	eh.pending.Range(func(key, value interface{}) bool {
+		if value.(pendingFrame).addr == addr {
+			eh.pending.Delete(key)
+		}
+		return true
+	})
 	eh.disconnectHandler(addr)
 	return
 }
 
+// AfterWrite is called once a buffer passed to AsyncWrite has been encoded
+// and written or queued, after which gnet no longer refers to it.
+func (eh *eventHandler) AfterWrite(c gnet.Conn, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if value, ok := eh.pending.LoadAndDelete(&b[0]); ok {
+		value.(pendingFrame).release()
+	}
+}
+
 // React is called when data is received.
 func (eh *eventHandler) React(inputFrame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
 	addr := c.RemoteAddr().String()
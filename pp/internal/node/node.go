@@ -1,21 +1,52 @@
 ﻿package node
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
+	"pp/internal/catalog"
+	"pp/internal/chat"
+	"pp/internal/compress"
 	"pp/internal/config"
 	"pp/internal/events"
 	"pp/internal/filetransfer"
+	"pp/internal/identity"
+	"pp/internal/mailbox"
 	"pp/internal/message"
+	"pp/internal/nat"
 	"pp/internal/network"
 	"pp/internal/peer"
+	"pp/internal/relay"
+	"pp/internal/routing"
+	"pp/internal/util"
+)
+
+const (
+	// relayDialTimeout bounds how long DialRelay waits for the relay to answer.
+	relayDialTimeout = 10 * time.Second
+	// holePunchTimeout bounds a whole HolePunch attempt, including coordination.
+	holePunchTimeout = nat.DefaultPunchTimeout + 5*time.Second
+	// deliveryTimeout bounds how long SendTo waits for a delivery acknowledgement.
+	deliveryTimeout = 10 * time.Second
+	// searchTimeout is how long SearchFiles collects answers from peers.
+	searchTimeout = 3 * time.Second
+	// defaultCatalogRescan is used when the configuration sets no rescan interval.
+	defaultCatalogRescan = 60 * time.Second
+	// defaultGCInterval is used when the configuration sets no garbage collection interval.
+	defaultGCInterval = time.Hour
+	// identityKeyFile is the file in the data directory holding the identity key.
+	identityKeyFile = "identity.key"
 )
 
 // Node represents a peer in the P2P network.
 type Node struct {
 	config              *config.Config
+	ID                  string
 	ServerAddr          string
 	PeerManager         *peer.Manager
 	MessageRouter       *message.Router
@@ -24,34 +55,104 @@ type Node struct {
 	shutdownCh          chan struct{}
 	wg                  sync.WaitGroup
 	EventManager        *events.EventManager // 添加事件管理器
+	RelayService        *relay.Service       // 为其他节点转发流量
+	RelayClient         *relay.Client        // 通过中继连接其他节点
+	NATTransport        *nat.Transport       // UDP 传输，用于打洞
+	ListenPacket        nat.ListenFunc       // 打开 UDP 套接字，Start 之前可替换为模拟网络
+	NATService          *nat.Service
+	RoutingService      *routing.Service   // 按节点 ID 路由消息
+	Catalog             *catalog.Catalog   // 共享文件索引
+	Chat                *chat.Service      // 聊天室和私信
+	Mailbox             *mailbox.Mailbox   // 发给离线节点的消息
+	Identity            *identity.Identity // 节点身份密钥，用于端到端加密
+	resumeMu            sync.Mutex
+	pendingResumes      []*pendingResume // 等待来源节点连接后续传的传输
 }
 
 // NewNode creates a new Node instance.
 func NewNode(cfg *config.Config, networkServer network.NetworkServer) (*Node, error) { // 传入接口
+	id, err := identity.Load(filepath.Join(cfg.DataDir, identityKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity key: %w", err)
+	}
+	// 节点 ID 由身份密钥派生，对方可以验证
+	nodeID := id.NodeID()
+
+	serverAddr := ":" + strconv.Itoa(cfg.Port)
+	eventManager := events.NewEventManager() // 初始化事件管理器
+	shares := filetransfer.NewShares(cfg.SharedDirs, cfg.SharedFiles)
+	limits := filetransfer.Limits{
+		Upload:       cfg.UploadLimit,
+		Download:     cfg.DownloadLimit,
+		PeerUpload:   cfg.PeerUploadLimit,
+		PeerDownload: cfg.PeerDownloadLimit,
+	}
+
 	node := &Node{
 		config:              cfg,
-		ServerAddr:          ":" + strconv.Itoa(cfg.Port),
+		ID:                  nodeID,
+		ServerAddr:          serverAddr,
 		PeerManager:         peer.NewManager(cfg.MaxPeers),
 		networkServer:       networkServer, // 使用传入的接口
 		shutdownCh:          make(chan struct{}),
-		FileTransferManager: filetransfer.NewManager(cfg.DataDir),
-		EventManager:        events.NewEventManager(), // 初始化事件管理器
+		FileTransferManager: filetransfer.NewManager(cfg.DataDir, shares, limits, serverAddr, eventManager),
+		EventManager:        eventManager,
+		Identity:            id,
+		ListenPacket:        nat.ListenUDP,
 	}
 
 	node.MessageRouter = message.NewRouter(node.EventManager)
+	node.RelayService = relay.NewService(cfg.RelayEnabled, cfg.RelayMaxCircuits, cfg.RelayBandwidth, node.ServerAddr, node.EventManager)
+	node.RelayClient = relay.NewClient(node.ID, node.ServerAddr, node.EventManager)
+	node.NATTransport = nat.NewTransport()
+	node.NATService = nat.NewService(node.NATTransport, node.ServerAddr, node.EventManager)
+	node.RoutingService = routing.NewService(id, node.ServerAddr, node.EventManager, node.PeerManager, node.RelayClient)
+	node.Catalog = catalog.NewCatalog(node.FileTransferManager, node.PeerManager, cfg.CatalogAnnounce, node.ServerAddr, node.EventManager)
+	node.Mailbox = mailbox.NewMailbox(cfg.DataDir, id, node.ServerAddr, cfg.MailboxForward, node.EventManager, node.PeerManager, node.RoutingService)
+	node.Mailbox.SetMessageHandler(node.handleIncomingMessage)
+	node.Chat = chat.NewService(cfg.DataDir, id, node.ServerAddr, node.EventManager, node.PeerManager, node.RoutingService)
+	node.Chat.SetMailbox(node.Mailbox, time.Duration(cfg.MailboxTTL)*time.Second)
+	for _, room := range cfg.ChatRooms {
+		if err := node.Chat.Join(room); err != nil {
+			log.Printf("Error joining chat room %s: %v", room, err)
+		}
+	}
 
 	networkServer.SetMessageHandler(node.handleIncomingMessage) // 设置消息处理函数
 	networkServer.SetConnectHandler(node.peerConnected)         // 设置连接处理函数
 	networkServer.SetDisconnectHandler(node.peerDisconnected)   // 设置断开连接处理函数
+	node.NATTransport.SetMessageHandler(node.handleIncomingMessage)
+	node.FileTransferManager.SetCodecLookup(node.peerCodec)
+	node.FileTransferManager.SetBinaryChunkLookup(node.peerChunkFrames)
+	node.FileTransferManager.SetPeerLookup(node.peerNodeID)
+	node.FileTransferManager.SetIdentity(id)
+	node.FileTransferManager.SetQuota(cfg.StorageQuota)
+	for _, fileID := range cfg.PinnedFiles {
+		if err := node.FileTransferManager.Pin(fileID); err != nil {
+			log.Printf("Error pinning file %s: %v", fileID, err)
+		}
+	}
 
 	//  不再在这里注册 handlers，而是在 main.go 中注册
 
 	// 订阅 SendMessageEvent
 	node.EventManager.Subscribe("send_message", node.handleSendMessageEvent)
 
+	// 订阅 SendFrameEvent
+	node.EventManager.Subscribe("send_frame", node.handleSendFrameEvent)
+
 	// 订阅 FileRequestEvent
 	node.EventManager.Subscribe("file_request", node.handleFileRequestEvent)
 
+	// 订阅 PeerIdentifiedEvent
+	node.EventManager.Subscribe("peer_identified", node.handlePeerIdentifiedEvent)
+
+	// 订阅 RelayedMessageEvent
+	node.EventManager.Subscribe("relayed_message", node.handleRelayedMessageEvent)
+
+	// 订阅 RoutedMessageEvent
+	node.EventManager.Subscribe("routed_message", node.handleRoutedMessageEvent)
+
 	return node, nil
 }
 
@@ -75,6 +176,21 @@ func (n *Node) handleSendMessageEvent(event events.Event) { // 修改参数类
 	}
 }
 
+// handleSendFrameEvent handles SendFrameEvent.
+func (n *Node) handleSendFrameEvent(event events.Event) {
+	sendFrameEvent, ok := event.(events.SendFrameEvent)
+	if !ok {
+		log.Printf("Invalid event type: %T", event)
+		return
+	}
+
+	data := sendFrameEvent.Data().(events.SendFrameEventData)
+	err := n.SendFrame(data.DestinationAddr, data.Frame, data.Release)
+	if err != nil {
+		log.Printf("Error sending frame to %s: %v", data.DestinationAddr, err)
+	}
+}
+
 // handleFileRequestEvent handles FileRequestEvent.
 func (n *Node) handleFileRequestEvent(event events.Event) {
 	fileRequestEvent, ok := event.(events.FileRequestEvent)
@@ -84,16 +200,68 @@ func (n *Node) handleFileRequestEvent(event events.Event) {
 	}
 
 	data := fileRequestEvent.Data().(events.FileRequestEventData)
-	err := n.sendFile(data.DestinationAddr, data.Filename)
-	if err != nil {
-		log.Printf("Error sending file %s to %s: %v", data.Filename, data.DestinationAddr, err)
+	// 发送文件耗时较长，不阻塞网络事件循环
+	go func() {
+		err := n.sendFile(data.DestinationAddr, data.Filename)
+		if err != nil {
+			log.Printf("Error sending file %s to %s: %v", data.Filename, data.DestinationAddr, err)
+		}
+	}()
+}
+
+// handlePeerIdentifiedEvent handles PeerIdentifiedEvent.
+func (n *Node) handlePeerIdentifiedEvent(event events.Event) {
+	peerIdentifiedEvent, ok := event.(events.PeerIdentifiedEvent)
+	if !ok {
+		log.Printf("Invalid event type: %T", event)
+		return
+	}
+
+	data := peerIdentifiedEvent.Data().(events.PeerIdentifiedEventData)
+	n.RelayClient.PeerIdentified(data.Addr)
+	n.resumeFrom(data.Addr, data.NodeID)
+}
+
+// handleRelayedMessageEvent handles RelayedMessageEvent.
+func (n *Node) handleRelayedMessageEvent(event events.Event) {
+	relayedMessageEvent, ok := event.(events.RelayedMessageEvent)
+	if !ok {
+		log.Printf("Invalid event type: %T", event)
+		return
+	}
+
+	data := relayedMessageEvent.Data().(events.RelayedMessageEventData)
+	n.handleIncomingMessage(data.SourceAddr, data.Payload)
+}
+
+// handleRoutedMessageEvent handles RoutedMessageEvent.
+func (n *Node) handleRoutedMessageEvent(event events.Event) {
+	routedMessageEvent, ok := event.(events.RoutedMessageEvent)
+	if !ok {
+		log.Printf("Invalid event type: %T", event)
+		return
 	}
+
+	data := routedMessageEvent.Data().(events.RoutedMessageEventData)
+	n.handleIncomingMessage(routing.NodeAddr(data.SourceID), data.Payload)
 }
 
 // handleIncomingMessage handles incoming messages from the network.
 func (n *Node) handleIncomingMessage(addr string, data []byte) {
-	msg, err := message.Deserialize(data)
+	data, err := compress.DecodeFrame(data)
 	if err != nil {
+		log.Printf("Error decompressing message from %s: %v", addr, err)
+		return
+	}
+	var msg message.Message
+	if filetransfer.IsChunkFrame(data) {
+		chunk, err := filetransfer.DecodeChunkFrame(data)
+		if err != nil {
+			log.Printf("Error decoding chunk frame from %s: %v", addr, err)
+			return
+		}
+		msg = message.Message{Type: "file_chunk", Data: chunk}
+	} else if msg, err = message.Deserialize(data); err != nil {
 		log.Printf("Error deserializing message: %v", err)
 		return
 	}
@@ -111,12 +279,35 @@ func (n *Node) handleIncomingMessage(addr string, data []byte) {
 func (n *Node) peerConnected(addr string) {
 	log.Printf("New peer connected: %s", addr)
 	n.PeerManager.AddPeer(addr)
+	n.sendHello(addr)
+	n.Catalog.AnnounceTo(addr)
+	n.Chat.AnnounceTo(addr)
+}
+
+// sendHello sends the hello of this node to the peer at addr, with a new
+// challenge the peer answers to prove its identity.
+func (n *Node) sendHello(addr string) {
+	challenge, _ := n.PeerManager.NewChallenge(addr)
+	hello := message.Message{
+		Type:   "hello",
+		Data:   peer.NewHello(n.Identity, n.config.Port, challenge),
+		Sender: n.ServerAddr,
+	}
+	if err := n.SendMessage(addr, hello); err != nil {
+		log.Printf("Error sending hello to %s: %v", addr, err)
+	}
 }
 
 // peerDisconnected is called when a peer disconnects from the node.
 func (n *Node) peerDisconnected(addr string) {
 	log.Printf("Peer disconnected: %s", addr)
 	n.PeerManager.RemovePeer(addr)
+	n.RelayService.PeerDisconnected(addr)
+	n.RelayClient.RelayDisconnected(addr)
+	n.RoutingService.PeerDisconnected(addr)
+	n.Catalog.PeerDisconnected(addr)
+	n.Chat.PeerDisconnected(addr)
+	n.FileTransferManager.PeerDisconnected(addr)
 }
 
 // Start starts the node.
@@ -130,30 +321,418 @@ func (n *Node) Start() error {
 		}
 	}()
 
-	log.Printf("Node started on %s", n.ServerAddr)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.RelayService.Run(n.shutdownCh)
+	}()
+
+	packetConn, err := n.ListenPacket(n.ServerAddr)
+	if err != nil {
+		log.Printf("UDP transport disabled: %v", err)
+	} else {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := n.NATTransport.Serve(packetConn); err != nil {
+				log.Printf("UDP transport failed: %v", err)
+			}
+		}()
+	}
+
+	for _, seedAddr := range n.config.SeedNodes {
+		if _, err := n.networkServer.Connect(seedAddr); err != nil {
+			log.Printf("Error connecting to seed node %s: %v", seedAddr, err)
+		}
+	}
+	for _, relayAddr := range n.config.RelayNodes {
+		n.reserveRelay(relayAddr)
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.resumeTransfers()
+	}()
+
+	gcInterval := time.Duration(n.config.GCInterval) * time.Second
+	if gcInterval <= 0 {
+		gcInterval = defaultGCInterval
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.FileTransferManager.RunGC(gcInterval, n.shutdownCh)
+	}()
+
+	rescan := time.Duration(n.config.CatalogRescan) * time.Second
+	if rescan <= 0 {
+		rescan = defaultCatalogRescan
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.Catalog.Run(rescan, n.shutdownCh)
+	}()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.Mailbox.Run(n.shutdownCh)
+	}()
+
+	log.Printf("Node %s started on %s", n.ID, n.ServerAddr)
 	return nil
 }
 
+// reserveRelay connects to a relay and asks it to accept circuits for this node.
+func (n *Node) reserveRelay(relayAddr string) {
+	addr, err := n.networkServer.Connect(relayAddr)
+	if err != nil {
+		log.Printf("Error connecting to relay %s: %v", relayAddr, err)
+		return
+	}
+	n.RelayClient.Reserve(addr)
+	if p, ok := n.PeerManager.GetPeer(addr); ok && p.NodeID != "" {
+		n.RelayClient.PeerIdentified(addr)
+	}
+}
+
+// pendingResume is a transfer interrupted by a restart that waits for one of
+// its sources to prove its identity.
+type pendingResume struct {
+	transfer filetransfer.Resumable
+	dialed   map[string]bool // 连接到只知道地址的来源
+}
+
+// from reports whether the peer at addr, proven to be nodeID, is a source
+// of the transfer.
+func (p *pendingResume) from(addr string, nodeID string) bool {
+	if p.dialed[addr] {
+		return true
+	}
+	for _, source := range p.transfer.Sources {
+		if source.NodeID != "" && source.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeTransfers continues the transfers interrupted by a restart. Sources
+// with a listen address are dialed, and each transfer resumes from the first
+// source that proves its identity, see resumeFrom. Transfers none of whose
+// sources could be dialed are resumed through routing; if that fails as
+// well they wait for a source to connect.
+func (n *Node) resumeTransfers() {
+	for _, transfer := range n.FileTransferManager.ResumeTransfers() {
+		if !transfer.Directory && len(transfer.Missing) == 0 {
+			continue
+		}
+		pending := &pendingResume{transfer: transfer, dialed: make(map[string]bool)}
+		n.resumeMu.Lock()
+		n.pendingResumes = append(n.pendingResumes, pending)
+		n.resumeMu.Unlock()
+
+		dialed := false
+		for _, source := range transfer.Sources {
+			if source.ListenAddr == "" {
+				continue
+			}
+			addr, err := n.networkServer.Connect(source.ListenAddr)
+			if err != nil {
+				log.Printf("Error connecting to %s to resume %s: %v", source.ListenAddr, transfer.FileID, err)
+				continue
+			}
+			dialed = true
+			if source.NodeID == "" {
+				n.resumeMu.Lock()
+				pending.dialed[addr] = true
+				n.resumeMu.Unlock()
+			}
+			// 已经证明过身份的连接不会再触发 peer_identified
+			if p, ok := n.PeerManager.GetPeer(addr); ok && p.NodeID != "" {
+				n.resumeFrom(addr, p.NodeID)
+			}
+		}
+		if !dialed {
+			n.resumeRouted(pending)
+		}
+	}
+}
+
+// resumeFrom continues the interrupted transfers the peer at addr, proven
+// to be nodeID, is a source of.
+func (n *Node) resumeFrom(addr string, nodeID string) {
+	n.resumeMu.Lock()
+	matched := []filetransfer.Resumable{}
+	remaining := []*pendingResume{}
+	for _, pending := range n.pendingResumes {
+		if pending.from(addr, nodeID) {
+			matched = append(matched, pending.transfer)
+		} else {
+			remaining = append(remaining, pending)
+		}
+	}
+	n.pendingResumes = remaining
+	n.resumeMu.Unlock()
+
+	for _, transfer := range matched {
+		if err := n.resume(transfer, addr); err != nil {
+			log.Printf("Error resuming %s from %s: %v", transfer.FileID, addr, err)
+		}
+	}
+}
+
+// resumeRouted resumes a transfer through routing to its sources by node
+// ID. The transfer stays pending if no source can be reached.
+func (n *Node) resumeRouted(pending *pendingResume) {
+	for _, source := range pending.transfer.Sources {
+		if source.NodeID == "" {
+			continue
+		}
+		if !n.claimResume(pending) {
+			return // 来源已经连上
+		}
+		err := n.resume(pending.transfer, routing.NodeAddr(source.NodeID))
+		if err == nil {
+			return
+		}
+		log.Printf("Error resuming %s from %s: %v", pending.transfer.FileID, source.NodeID, err)
+		n.resumeMu.Lock()
+		n.pendingResumes = append(n.pendingResumes, pending)
+		n.resumeMu.Unlock()
+	}
+	log.Printf("No source available to resume %s, waiting for one to connect", pending.transfer.FileID)
+}
+
+// claimResume removes a transfer from the pending ones and reports whether
+// it was still pending.
+func (n *Node) claimResume(pending *pendingResume) bool {
+	n.resumeMu.Lock()
+	defer n.resumeMu.Unlock()
+	for i, p := range n.pendingResumes {
+		if p == pending {
+			n.pendingResumes = append(n.pendingResumes[:i], n.pendingResumes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// resume continues an interrupted transfer from the peer at addr: a file by
+// requesting its missing chunks, a directory by fetching its next file.
+func (n *Node) resume(transfer filetransfer.Resumable, addr string) error {
+	if transfer.Directory {
+		log.Printf("Resuming directory %s from %s", transfer.FileID, addr)
+		return n.FileTransferManager.ResumeDirectory(transfer.FileID, addr)
+	}
+
+	log.Printf("Resuming transfer %s from %s, %d chunks missing", transfer.FileID, addr, len(transfer.Missing))
+	request := message.Message{
+		Type:   "file_chunk_request",
+		Data:   filetransfer.ChunkRequest{FileID: transfer.FileID, ChunkIndices: transfer.Missing},
+		Sender: n.ServerAddr,
+	}
+	if nodeID, ok := routing.ParseNodeAddr(addr); ok {
+		// 等待对方确认，失败时换下一个来源
+		return n.SendTo(nodeID, request)
+	}
+	return n.SendMessage(addr, request)
+}
+
+// DialRelay opens a circuit to the node targetID through a connected relay.
+// The returned address can be passed to SendMessage like any peer address.
+func (n *Node) DialRelay(relayAddr string, targetID string) (string, error) {
+	addr, err := n.RelayClient.Dial(relayAddr, targetID, relayDialTimeout)
+	if err != nil {
+		return "", err
+	}
+	n.PeerManager.AddPeer(addr)
+	// 通过 circuit 握手，中继无法冒充对方
+	n.sendHello(addr)
+	return addr, nil
+}
+
+// HolePunch establishes a direct UDP path to targetID, coordinated by a
+// peer at rendezvousAddr that both nodes are connected to.
+// The returned address can be passed to SendMessage like any peer address.
+func (n *Node) HolePunch(rendezvousAddr string, targetID string) (string, error) {
+	addr, err := n.NATService.HolePunch(rendezvousAddr, targetID, util.GenerateUUID(), holePunchTimeout)
+	if err != nil {
+		return "", err
+	}
+	n.PeerManager.AddPeer(addr)
+	n.sendHello(addr)
+	return addr, nil
+}
+
 // Shutdown shuts down the node.
 func (n *Node) Shutdown() {
 	log.Println("Shutting down node...")
 	close(n.shutdownCh)
 	n.networkServer.Stop()
+	n.NATTransport.Close()
 	n.wg.Wait()
+	n.FileTransferManager.Close()
 	log.Println("Node shutdown complete.")
 }
 
-// sendMessage sends a message to a specific peer.
+// SendTo routes a message to the node nodeID anywhere in the overlay and
+// waits until the target acknowledges delivery.
+func (n *Node) SendTo(nodeID string, msg message.Message) error {
+	msgBytes, err := message.Serialize(msg)
+	if err != nil {
+		return err
+	}
+	return n.RoutingService.Send(nodeID, msgBytes, deliveryTimeout)
+}
+
+// SendMail delivers a message to the node nodeID, queueing it while the
+// node cannot be reached. It returns the ID of the mail, whose delivery is
+// reported by a MailStatusEvent.
+func (n *Node) SendMail(nodeID string, msg message.Message) (string, error) {
+	return n.Mailbox.Send(nodeID, msg, time.Duration(n.config.MailboxTTL)*time.Second)
+}
+
+// SendMessage sends a message to a specific peer.
+// Besides network addresses it accepts relay://, udp:// and node:// addresses.
 func (n *Node) SendMessage(addr string, msg message.Message) error {
 	msgBytes, err := message.Serialize(msg)
 	if err != nil {
 		return err
 	}
+	return n.send(addr, msgBytes, true)
+}
+
+// SendFrame sends an encoded frame to a specific peer and calls release
+// once the frame is no longer needed.
+func (n *Node) SendFrame(addr string, frame []byte, release func()) error {
+	_, isNodeAddr := routing.ParseNodeAddr(addr)
+	if relay.IsCircuitAddr(addr) || nat.IsUDPAddr(addr) || isNodeAddr {
+		// 这些传输在发送时已复制数据
+		defer release()
+		return n.send(addr, frame, false)
+	}
+	return n.networkServer.SendFrame(addr, frame, release)
+}
+
+// send sends a serialized message or frame to a peer. Frames to direct
+// connections are compressed when compressible is set and the peer
+// supports it.
+func (n *Node) send(addr string, msgBytes []byte, compressible bool) error {
+	// 通过中继 circuit 发送时，把消息包装成 relay_data
+	if relay.IsCircuitAddr(addr) {
+		relayAddr, relayMsg, err := n.RelayClient.Wrap(addr, msgBytes)
+		if err != nil {
+			return err
+		}
+		return n.SendMessage(relayAddr, relayMsg)
+	}
+	if nat.IsUDPAddr(addr) {
+		return n.NATTransport.Send(addr, msgBytes)
+	}
+	// node:// 地址通常来自路由消息的回复，路由已知，不等待确认
+	if nodeID, ok := routing.ParseNodeAddr(addr); ok {
+		return n.RoutingService.Forward(nodeID, msgBytes)
+	}
 
+	if compressible && n.peerCodec(addr) == compress.Deflate {
+		msgBytes = compress.EncodeFrame(msgBytes)
+	}
 	return n.networkServer.SendMessage(addr, msgBytes)
 }
 
+// peerCodec returns the compression codec negotiated with the peer at addr.
+func (n *Node) peerCodec(addr string) string {
+	if p, ok := n.PeerManager.GetPeer(addr); ok {
+		return p.Compression
+	}
+	return ""
+}
+
+// peerChunkFrames reports whether the peer at addr accepts binary chunk frames.
+func (n *Node) peerChunkFrames(addr string) bool {
+	p, ok := n.PeerManager.GetPeer(addr)
+	return ok && p.ChunkFrames
+}
+
+// peerNodeID returns the proven node ID of the peer at addr, if known.
+func (n *Node) peerNodeID(addr string) string {
+	if p, ok := n.PeerManager.GetPeer(addr); ok {
+		return p.NodeID
+	}
+	nodeID, _ := routing.ParseNodeAddr(addr)
+	return nodeID
+}
+
+// DownloadFile fetches a file from several peers in parallel. Network
+// addresses are connected first; relay://, udp:// and node:// addresses
+// are used as they are.
+func (n *Node) DownloadFile(fileID string, peerAddrs []string, strategy filetransfer.Strategy) error {
+	addrs := make([]string, 0, len(peerAddrs))
+	for _, addr := range peerAddrs {
+		_, isNodeAddr := routing.ParseNodeAddr(addr)
+		if !relay.IsCircuitAddr(addr) && !nat.IsUDPAddr(addr) && !isNodeAddr {
+			connected, err := n.networkServer.Connect(addr)
+			if err != nil {
+				log.Printf("Error connecting to %s: %v", addr, err)
+				continue
+			}
+			addr = connected
+		}
+		addrs = append(addrs, addr)
+	}
+	return n.FileTransferManager.Download(fileID, addrs, strategy)
+}
+
+// SearchFiles asks all peers for files whose name contains every word of
+// text and that carry all of tags.
+func (n *Node) SearchFiles(text string, tags []string) []catalog.Result {
+	return n.Catalog.Search(catalog.Query{Text: text, Tags: tags}, searchTimeout)
+}
+
+// SendEncryptedFile encrypts a file under a new key, gives the key to the
+// peer at addr and sends it the encrypted file. It returns the ID of the
+// encrypted file, whose key can be shared with more peers with ShareFileKey.
+func (n *Node) SendEncryptedFile(addr string, filename string) (string, error) {
+	fileID, err := n.FileTransferManager.EncryptFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := n.ShareFileKey(addr, fileID); err != nil {
+		return fileID, err
+	}
+	return fileID, n.FileTransferManager.SendStoredFile(addr, fileID)
+}
+
+// ShareFileKey gives the key of an encrypted file to the peer at addr,
+// sealed to the identity key it proved to hold in the hello exchange.
+// Over a relay circuit the peer must be the node the circuit was opened to.
+func (n *Node) ShareFileKey(addr string, fileID string) error {
+	p, ok := n.PeerManager.GetPeer(addr)
+	if !ok || p.NodeID == "" || len(p.PublicKey) == 0 {
+		return fmt.Errorf("no proven identity key for peer %s", addr)
+	}
+	if remote, ok := n.RelayClient.Remote(addr); ok && remote != p.NodeID {
+		return fmt.Errorf("circuit %s was opened to %s but reached %s", addr, remote, p.NodeID)
+	}
+	envelope, err := n.FileTransferManager.SealKey(fileID, p.PublicKey)
+	if err != nil {
+		return err
+	}
+	return n.SendMessage(addr, message.Message{Type: "file_key", Data: envelope, Sender: n.ServerAddr})
+}
+
 // sendFile sends a file to a specific peer.
 func (n *Node) sendFile(destinationAddr string, filename string) error {
+	// 请求解析为文件 ID 时从 blob 存储发送
+	if filetransfer.ValidFileID(filename) {
+		return n.FileTransferManager.SendStoredFile(destinationAddr, filename)
+	}
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		_, err := n.FileTransferManager.SendDirectory(destinationAddr, filename)
+		return err
+	}
 	return n.FileTransferManager.SendFile(destinationAddr, filename)
 }
@@ -1,13 +1,87 @@
 ﻿package peer
 
 import (
+	"bytes"
+	"crypto/rand"
 	"sync"
+
+	"pp/internal/compress"
+	"pp/internal/identity"
 )
 
+// ChallengeSize is the size of the challenge in a hello.
+const ChallengeSize = 32
+
+// Peer describes a connected peer.
+type Peer struct {
+	Addr        string // address of the connection
+	NodeID      string // set once the peer has proven its identity
+	ListenAddr  string // address the peer accepts connections on, if known
+	Compression string // codec negotiated for frames sent to the peer, "" for none
+	PublicKey   []byte // identity key of the peer, used to seal file keys
+	SigningKey  []byte // key the signatures of the peer are checked with
+	ChunkFrames bool   // peer accepts file chunks in binary frames
+
+	challenge []byte // challenge sent to the peer in this node's hello
+	claim     *claim // identity announced by the peer, not proven yet
+}
+
+// claim is the identity a peer announced in its hello.
+type claim struct {
+	nodeID     string
+	listenAddr string
+	publicKey  []byte
+	signingKey []byte
+}
+
+// HelloData is the payload of the hello message exchanged when a connection
+// opens. A node proves it holds the keys of its node ID by signing the
+// challenge of the other side's hello in a hello_proof message.
+type HelloData struct {
+	NodeID      string   `json:"node_id"`
+	ListenPort  int      `json:"listen_port"`
+	Compression []string `json:"compression,omitempty"`  // codecs the node can decode
+	PublicKey   []byte   `json:"public_key,omitempty"`   // identity key of the node
+	SigningKey  []byte   `json:"signing_key,omitempty"`  // key the node ID is derived from
+	Challenge   []byte   `json:"challenge,omitempty"`    // random bytes the peer must sign
+	ChunkFrames bool     `json:"chunk_frames,omitempty"` // node accepts file chunks in binary frames
+}
+
+// HelloProof is the payload of a hello_proof message.
+type HelloProof struct {
+	Signature []byte `json:"signature"` // signature of the challenge and public key
+}
+
+// NewHello returns the hello of the node with identity id, carrying
+// challenge.
+func NewHello(id *identity.Identity, listenPort int, challenge []byte) HelloData {
+	return HelloData{
+		NodeID:      id.NodeID(),
+		ListenPort:  listenPort,
+		Compression: compress.Supported,
+		PublicKey:   id.PublicKey(),
+		SigningKey:  id.SigningKey(),
+		Challenge:   challenge,
+		ChunkFrames: true,
+	}
+}
+
+// Prove answers the challenge of a hello received from a peer.
+func Prove(id *identity.Identity, challenge []byte) HelloProof {
+	return HelloProof{Signature: id.Sign(proofMessage(challenge, id.PublicKey()))}
+}
+
+// proofMessage returns what a node signs to answer a challenge. The public
+// key is signed along, which binds it to the node ID.
+func proofMessage(challenge []byte, publicKey []byte) []byte {
+	message := append([]byte("pp hello proof\x00"), challenge...)
+	return append(message, publicKey...)
+}
+
 // Manager manages the list of peers.
 type Manager struct {
 	maxPeers int
-	peers    sync.Map // map[string]bool
+	peers    sync.Map // map[string]*Peer
 	mu       sync.Mutex
 }
 
@@ -39,7 +113,136 @@ func (m *Manager) AddPeer(addr string) {
 		return
 	}
 
-	m.peers.Store(addr, true)
+	m.peers.Store(addr, &Peer{Addr: addr})
+}
+
+// NewChallenge records a new challenge for the hello sent to the peer at
+// addr and returns it.
+func (m *Manager) NewChallenge(addr string) ([]byte, bool) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return nil, false
+	}
+	p := *value.(*Peer)
+	p.challenge = challenge
+	m.peers.Store(addr, &p)
+	return challenge, true
+}
+
+// SetClaim records the identity the peer at addr announced in its hello
+// and the address it accepts connections on. The identity is taken on once
+// the peer proves it with Prove.
+func (m *Manager) SetClaim(addr string, hello HelloData, listenAddr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return false
+	}
+	p := *value.(*Peer)
+	p.claim = &claim{
+		nodeID:     hello.NodeID,
+		listenAddr: listenAddr,
+		publicKey:  hello.PublicKey,
+		signingKey: hello.SigningKey,
+	}
+	m.peers.Store(addr, &p)
+	return true
+}
+
+// Prove checks the answer of the peer at addr to the challenge this node
+// sent it and, if it is signed with the key of the node ID the peer
+// claimed, records that identity. It returns the peer.
+func (m *Manager) Prove(addr string, proof HelloProof) (Peer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return Peer{}, false
+	}
+	p := *value.(*Peer)
+	c := p.claim
+	if c == nil || len(p.challenge) != ChallengeSize || identity.NodeIDOf(c.signingKey) != c.nodeID ||
+		!identity.Verify(c.signingKey, proofMessage(p.challenge, c.publicKey), proof.Signature) {
+		return Peer{}, false
+	}
+	// 同一连接上身份不能更换
+	if p.NodeID != "" && (p.NodeID != c.nodeID || !bytes.Equal(p.PublicKey, c.publicKey)) {
+		return Peer{}, false
+	}
+	p.NodeID = c.nodeID
+	p.ListenAddr = c.listenAddr
+	p.PublicKey = c.publicKey
+	p.SigningKey = c.signingKey
+	p.challenge = nil
+	p.claim = nil
+	m.peers.Store(addr, &p)
+	return p, true
+}
+
+// SetCompression records the codec negotiated with the peer at addr.
+func (m *Manager) SetCompression(addr string, codec string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return false
+	}
+	p := *value.(*Peer)
+	p.Compression = codec
+	m.peers.Store(addr, &p)
+	return true
+}
+
+// SetChunkFrames records whether the peer at addr accepts binary chunk frames.
+func (m *Manager) SetChunkFrames(addr string, accepted bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return false
+	}
+	p := *value.(*Peer)
+	p.ChunkFrames = accepted
+	m.peers.Store(addr, &p)
+	return true
+}
+
+// GetPeer returns the peer connected at addr.
+func (m *Manager) GetPeer(addr string) (Peer, bool) {
+	value, ok := m.peers.Load(addr)
+	if !ok {
+		return Peer{}, false
+	}
+	return *value.(*Peer), true
+}
+
+// FindByID returns a connected peer with the given node ID.
+func (m *Manager) FindByID(nodeID string) (Peer, bool) {
+	var found *Peer
+	m.peers.Range(func(key, value interface{}) bool {
+		if p := value.(*Peer); p.NodeID == nodeID {
+			found = p
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return Peer{}, false
+	}
+	return *found, true
 }
 
 // RemovePeer removes a peer from the list.
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket measured in bytes.
+// A rate of zero or less means the bucket is unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a new Bucket that refills at rate bytes per second and holds at most burst bytes.
+func NewBucket(rate int64, burst int64) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the refill rate and burst size at runtime.
+func (b *Bucket) SetRate(rate int64, burst int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if burst < rate {
+		burst = rate
+	}
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate returns the current refill rate in bytes per second.
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// Allow takes n tokens if they are available right now.
+func (b *Bucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Take takes n tokens unless the bucket is in debt. Like Wait, it lets
+// requests larger than the burst size drive the bucket into debt, so it
+// never refuses forever.
+func (b *Bucket) Take(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait blocks until n tokens have been taken.
+// Requests larger than the burst size are allowed to drive the bucket into debt.
+func (b *Bucket) Wait(n int) {
+	if delay := b.Reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Reserve takes n tokens, driving the bucket into debt if needed, and
+// returns how long it takes to pay the debt back. Reserve(0) returns the
+// current debt.
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Ready reports whether the bucket has tokens left, without taking any.
+func (b *Bucket) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	return b.tokens > 0
+}
+
+// refill adds the tokens accumulated since the last call. Callers must hold b.mu.
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
@@ -0,0 +1,229 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/message"
+	"pp/internal/util"
+)
+
+// Client is the endpoint side of the protocol. It opens circuits through
+// relays and turns relayed frames back into incoming messages.
+type Client struct {
+	nodeID       string
+	serverAddr   string
+	eventManager *events.EventManager
+
+	mu        sync.Mutex
+	relays    map[string]bool            // relays holding a reservation for this node
+	reserving map[string]bool            // relays to reserve on once they know this node
+	circuits  map[string]string          // circuit address -> remote node ID
+	pending   map[string]chan StatusData // circuit ID -> waiting Dial
+}
+
+// NewClient creates a new Client instance.
+func NewClient(nodeID string, serverAddr string, eventManager *events.EventManager) *Client {
+	return &Client{
+		nodeID:       nodeID,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+		relays:       make(map[string]bool),
+		reserving:    make(map[string]bool),
+		circuits:     make(map[string]string),
+		pending:      make(map[string]chan StatusData),
+	}
+}
+
+// Reserve asks the relay at relayAddr to accept circuits for this node.
+// The relay only reserves for a node that proved its ID on the connection,
+// so the request is sent from PeerIdentified once the hello exchange with
+// the relay is done; callers that know it is done already call
+// PeerIdentified right away.
+func (c *Client) Reserve(relayAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reserving[relayAddr] = true
+}
+
+// PeerIdentified sends the reservation waiting for the peer at addr. This
+// node has answered the challenge of a peer before it gets the peer's own
+// proof, so the relay knows this node by then.
+func (c *Client) PeerIdentified(addr string) {
+	c.mu.Lock()
+	waiting := c.reserving[addr]
+	delete(c.reserving, addr)
+	if waiting {
+		c.relays[addr] = true
+	}
+	c.mu.Unlock()
+
+	if waiting {
+		c.send(addr, message.Message{Type: "relay_reserve", Data: ReserveData{NodeID: c.nodeID}, Sender: c.serverAddr})
+	}
+}
+
+// Relays returns the relays this node holds a reservation on.
+func (c *Client) Relays() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	relays := make([]string, 0, len(c.relays))
+	for addr := range c.relays {
+		relays = append(relays, addr)
+	}
+	return relays
+}
+
+// Dial opens a circuit to target through the relay at relayAddr and returns
+// the circuit address, which can be used like any peer address.
+func (c *Client) Dial(relayAddr string, target string, timeout time.Duration) (string, error) {
+	circuitID := util.GenerateUUID()
+	statusCh := make(chan StatusData, 1)
+
+	c.mu.Lock()
+	c.pending[circuitID] = statusCh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, circuitID)
+		c.mu.Unlock()
+	}()
+
+	data := ConnectData{CircuitID: circuitID, From: c.nodeID, Target: target}
+	c.send(relayAddr, message.Message{Type: "relay_connect", Data: data, Sender: c.serverAddr})
+
+	select {
+	case status := <-statusCh:
+		if !status.OK {
+			return "", errors.New(status.Error)
+		}
+	case <-time.After(timeout):
+		return "", ErrCircuitTimeout
+	}
+
+	addr := CircuitAddr(relayAddr, circuitID)
+	c.mu.Lock()
+	c.circuits[addr] = target
+	c.mu.Unlock()
+	return addr, nil
+}
+
+// CircuitTo returns the address of an open circuit to nodeID.
+func (c *Client) CircuitTo(nodeID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, remote := range c.circuits {
+		if remote == nodeID {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// Remote returns the node ID at the other end of the circuit at addr.
+func (c *Client) Remote(addr string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nodeID, ok := c.circuits[addr]
+	return nodeID, ok
+}
+
+// HandleStatus resolves a pending Dial.
+func (c *Client) HandleStatus(status StatusData) {
+	c.mu.Lock()
+	statusCh, ok := c.pending[status.CircuitID]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case statusCh <- status:
+	default:
+	}
+}
+
+// Accept records a circuit opened towards this node and returns its address.
+func (c *Client) Accept(relayAddr string, data ConnectData) string {
+	addr := CircuitAddr(relayAddr, data.CircuitID)
+	c.mu.Lock()
+	c.circuits[addr] = data.From
+	c.mu.Unlock()
+	return addr
+}
+
+// Deliver hands a relayed frame to the node as an incoming message.
+func (c *Client) Deliver(relayAddr string, data Data) error {
+	addr := CircuitAddr(relayAddr, data.CircuitID)
+	c.mu.Lock()
+	_, ok := c.circuits[addr]
+	c.mu.Unlock()
+	if !ok {
+		return ErrUnknownCircuit
+	}
+
+	eventData := events.RelayedMessageEventData{
+		SourceAddr: addr,
+		Payload:    data.Payload,
+	}
+	c.eventManager.Publish(events.RelayedMessageEvent{EventData: eventData})
+	return nil
+}
+
+// Wrap builds the relay_data message that carries payload over the circuit at addr.
+func (c *Client) Wrap(addr string, payload []byte) (relayAddr string, msg message.Message, err error) {
+	relayAddr, circuitID, ok := ParseCircuitAddr(addr)
+	if !ok {
+		return "", message.Message{}, ErrUnknownCircuit
+	}
+	c.mu.Lock()
+	_, ok = c.circuits[addr]
+	c.mu.Unlock()
+	if !ok {
+		return "", message.Message{}, ErrUnknownCircuit
+	}
+
+	data := Data{CircuitID: circuitID, Payload: payload}
+	return relayAddr, message.Message{Type: "relay_data", Data: data, Sender: c.serverAddr}, nil
+}
+
+// Close tears down a circuit, notifying the relay unless it closed the circuit itself.
+func (c *Client) Close(addr string, notify bool) {
+	c.mu.Lock()
+	_, ok := c.circuits[addr]
+	delete(c.circuits, addr)
+	c.mu.Unlock()
+	if !ok || !notify {
+		return
+	}
+
+	relayAddr, circuitID, _ := ParseCircuitAddr(addr)
+	c.send(relayAddr, message.Message{Type: "relay_close", Data: CloseData{CircuitID: circuitID}, Sender: c.serverAddr})
+}
+
+// RelayDisconnected drops the reservation and all circuits through relayAddr.
+func (c *Client) RelayDisconnected(relayAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.relays, relayAddr)
+	delete(c.reserving, relayAddr)
+	for addr := range c.circuits {
+		if r, _, _ := ParseCircuitAddr(addr); r == relayAddr {
+			delete(c.circuits, addr)
+		}
+	}
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (c *Client) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	c.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
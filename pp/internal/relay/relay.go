@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"errors"
+	"strings"
+)
+
+// circuitAddrPrefix marks addresses that are reached through a relay circuit.
+const circuitAddrPrefix = "relay://"
+
+var (
+	ErrRelayDisabled    = errors.New("relay disabled")
+	ErrNoReservation    = errors.New("target has no reservation on this relay")
+	ErrCircuitLimit     = errors.New("relay circuit limit reached")
+	ErrUnknownCircuit   = errors.New("unknown circuit")
+	ErrCircuitTimeout   = errors.New("timed out waiting for relay")
+	ErrDuplicateCircuit = errors.New("circuit already exists")
+	ErrUnprovenNode     = errors.New("reservation is not for the node proven on this connection")
+	ErrReserved         = errors.New("node already holds a reservation on this relay")
+)
+
+// ReserveData is the payload of a relay_reserve message.
+type ReserveData struct {
+	NodeID string `json:"node_id"`
+}
+
+// ConnectData is the payload of a relay_connect message.
+// The initiator sends it to the relay, which forwards it to the target.
+type ConnectData struct {
+	CircuitID string `json:"circuit_id"`
+	From      string `json:"from"`
+	Target    string `json:"target"`
+}
+
+// Data is the payload of a relay_data message and carries one serialized message.
+type Data struct {
+	CircuitID string `json:"circuit_id"`
+	Payload   []byte `json:"payload"`
+}
+
+// CloseData is the payload of a relay_close message.
+type CloseData struct {
+	CircuitID string `json:"circuit_id"`
+}
+
+// StatusData is the payload of a relay_status message.
+type StatusData struct {
+	CircuitID string `json:"circuit_id,omitempty"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CircuitAddr returns the address under which a circuit through relayAddr is known locally.
+func CircuitAddr(relayAddr, circuitID string) string {
+	return circuitAddrPrefix + relayAddr + "/" + circuitID
+}
+
+// ParseCircuitAddr splits a circuit address into the relay address and circuit ID.
+func ParseCircuitAddr(addr string) (relayAddr string, circuitID string, ok bool) {
+	if !strings.HasPrefix(addr, circuitAddrPrefix) {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(addr, circuitAddrPrefix)
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// IsCircuitAddr reports whether addr refers to a relay circuit.
+func IsCircuitAddr(addr string) bool {
+	_, _, ok := ParseCircuitAddr(addr)
+	return ok
+}
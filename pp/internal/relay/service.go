@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"log"
+	"sync"
+
+	"pp/internal/events"
+	"pp/internal/message"
+	"pp/internal/ratelimit"
+)
+
+// forwardQueueSize bounds the number of relayed frames waiting for bandwidth.
+const forwardQueueSize = 1024
+
+// circuit is a relayed connection between two peers connected to this node.
+type circuit struct {
+	id        string
+	initiator string // address of the peer that opened the circuit
+	target    string // address of the reserved peer
+}
+
+// other returns the address at the far end of the circuit from addr.
+func (c *circuit) other(addr string) (string, bool) {
+	switch addr {
+	case c.initiator:
+		return c.target, true
+	case c.target:
+		return c.initiator, true
+	}
+	return "", false
+}
+
+// forward is a relayed frame waiting to be sent.
+type forward struct {
+	addr string
+	msg  message.Message
+	size int
+}
+
+// Service is the relay side of the protocol. It accepts reservations from
+// peers that cannot be dialed and forwards circuit traffic to them.
+type Service struct {
+	enabled      bool
+	maxCircuits  int
+	serverAddr   string
+	eventManager *events.EventManager
+	bandwidth    *ratelimit.Bucket
+
+	mu           sync.Mutex
+	reservations map[string]string // node ID -> address
+	circuits     map[string]*circuit
+	queue        chan forward
+}
+
+// NewService creates a new Service instance.
+func NewService(enabled bool, maxCircuits int, bandwidth int64, serverAddr string, eventManager *events.EventManager) *Service {
+	return &Service{
+		enabled:      enabled,
+		maxCircuits:  maxCircuits,
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+		bandwidth:    ratelimit.NewBucket(bandwidth, bandwidth),
+		reservations: make(map[string]string),
+		circuits:     make(map[string]*circuit),
+		queue:        make(chan forward, forwardQueueSize),
+	}
+}
+
+// Run forwards queued frames until shutdownCh is closed.
+func (s *Service) Run(shutdownCh <-chan struct{}) {
+	for {
+		select {
+		case f := <-s.queue:
+			s.bandwidth.Wait(f.size)
+			s.send(f.addr, f.msg)
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// Reserve records that the peer at addr can be reached as nodeID through
+// this relay. The caller must have checked that the peer proved nodeID. A
+// reservation held by another connection is kept until that connection
+// closes.
+func (s *Service) Reserve(addr string, nodeID string) error {
+	if !s.enabled {
+		return ErrRelayDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reserved, ok := s.reservations[nodeID]; ok && reserved != addr {
+		return ErrReserved
+	}
+	s.reservations[nodeID] = addr
+	log.Printf("Relay reservation for %s at %s", nodeID, addr)
+	return nil
+}
+
+// Connect opens a circuit from the peer at addr to a reserved target and
+// notifies the target about it.
+func (s *Service) Connect(addr string, data ConnectData) error {
+	if !s.enabled {
+		return ErrRelayDisabled
+	}
+	s.mu.Lock()
+	targetAddr, ok := s.reservations[data.Target]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNoReservation
+	}
+	if _, exists := s.circuits[data.CircuitID]; exists {
+		s.mu.Unlock()
+		return ErrDuplicateCircuit
+	}
+	if s.maxCircuits > 0 && len(s.circuits) >= s.maxCircuits {
+		s.mu.Unlock()
+		return ErrCircuitLimit
+	}
+	s.circuits[data.CircuitID] = &circuit{id: data.CircuitID, initiator: addr, target: targetAddr}
+	s.mu.Unlock()
+
+	log.Printf("Relay circuit %s opened: %s -> %s", data.CircuitID, addr, targetAddr)
+	s.send(targetAddr, message.Message{Type: "relay_connect", Data: data, Sender: s.serverAddr})
+	return nil
+}
+
+// Forward queues circuit traffic from addr for the other end of the circuit.
+// It returns false if the circuit is not relayed by this node.
+func (s *Service) Forward(addr string, data Data) bool {
+	s.mu.Lock()
+	c, ok := s.circuits[data.CircuitID]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	dest, ok := c.other(addr)
+	if !ok {
+		return false
+	}
+
+	f := forward{
+		addr: dest,
+		msg:  message.Message{Type: "relay_data", Data: data, Sender: s.serverAddr},
+		size: len(data.Payload),
+	}
+	select {
+	case s.queue <- f:
+	default:
+		log.Printf("Relay queue full, dropping frame on circuit %s", data.CircuitID)
+	}
+	return true
+}
+
+// Close tears down a circuit at the request of one of its ends.
+// It returns false if the circuit is not relayed by this node.
+func (s *Service) Close(addr string, circuitID string) bool {
+	s.mu.Lock()
+	c, ok := s.circuits[circuitID]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	dest, ok := c.other(addr)
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.circuits, circuitID)
+	s.mu.Unlock()
+
+	s.send(dest, message.Message{Type: "relay_close", Data: CloseData{CircuitID: circuitID}, Sender: s.serverAddr})
+	return true
+}
+
+// PeerDisconnected drops the reservation and circuits of a disconnected peer.
+func (s *Service) PeerDisconnected(addr string) {
+	s.mu.Lock()
+	for nodeID, reserved := range s.reservations {
+		if reserved == addr {
+			delete(s.reservations, nodeID)
+		}
+	}
+	var closed []*circuit
+	for id, c := range s.circuits {
+		if c.initiator == addr || c.target == addr {
+			delete(s.circuits, id)
+			closed = append(closed, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range closed {
+		dest, _ := c.other(addr)
+		s.send(dest, message.Message{Type: "relay_close", Data: CloseData{CircuitID: c.id}, Sender: s.serverAddr})
+	}
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (s *Service) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	s.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}
@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeAddrPrefix = "node://"
+
+	// DefaultTTL is the number of hops a routed message or lookup may take.
+	DefaultTTL = 8
+)
+
+var (
+	ErrNoRoute     = errors.New("no route to node")
+	ErrAckTimeout  = errors.New("timed out waiting for delivery acknowledgement")
+	ErrTTLExceeded = errors.New("hop limit exceeded")
+	ErrSignature   = errors.New("routed message not signed by its sender")
+	ErrNotTarget   = errors.New("route answer not signed by its target")
+)
+
+// Envelope is the payload of a routed message. Acknowledgements travel back
+// to the sender in an Envelope of their own with AckID set. The sender signs
+// everything but TTL, which every hop decrements.
+type Envelope struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	TTL       int    `json:"ttl"`
+	NeedAck   bool   `json:"need_ack,omitempty"`
+	Payload   []byte `json:"payload,omitempty"` // serialized message
+	AckID     string `json:"ack_id,omitempty"`  // ID of the envelope being acknowledged
+	Error     string `json:"error,omitempty"`   // delivery failure reported on the way
+	Sent      int64  `json:"sent"`              // Unix time the sender created the envelope
+	Key       []byte `json:"key"`               // sender's signing key
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns what the sender of an envelope signs.
+func (e Envelope) signedData() []byte {
+	data := []byte("pp routed\x00")
+	for _, field := range []string{e.ID, e.From, e.To, strconv.FormatBool(e.NeedAck), e.AckID, e.Error, strconv.FormatInt(e.Sent, 10)} {
+		data = append(append(data, field...), 0)
+	}
+	return append(data, e.Payload...)
+}
+
+// LookupData is the payload of a route_lookup message, flooded through the
+// overlay to find a path to Target.
+type LookupData struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+	TTL    int    `json:"ttl"`
+}
+
+// FoundData is the payload of a route_found message, which travels back
+// along the lookup's path. The target signs it, so nodes on the way cannot
+// answer for it and pull its traffic towards themselves.
+type FoundData struct {
+	ID        string `json:"id"`
+	Target    string `json:"target"`
+	Key       []byte `json:"key"` // target's signing key
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns what the target of a lookup signs in its answer.
+func (f FoundData) signedData() []byte {
+	return []byte("pp route found\x00" + f.ID + "\x00" + f.Target)
+}
+
+// NodeAddr returns the address under which a node reached by routing is known locally.
+func NodeAddr(nodeID string) string {
+	return nodeAddrPrefix + nodeID
+}
+
+// ParseNodeAddr returns the node ID in a node:// address.
+func ParseNodeAddr(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, nodeAddrPrefix) {
+		return "", false
+	}
+	nodeID := strings.TrimPrefix(addr, nodeAddrPrefix)
+	return nodeID, nodeID != ""
+}
@@ -0,0 +1,83 @@
+package routing
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pp/internal/identity"
+)
+
+// testIdentity creates an identity in a temporary directory.
+func testIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+	id, err := identity.Load(filepath.Join(t.TempDir(), "identity.key"))
+	if err != nil {
+		t.Fatalf("identity.Load: %v", err)
+	}
+	return id
+}
+
+func TestVerifyEnvelope(t *testing.T) {
+	sender, other := testIdentity(t), testIdentity(t)
+	s := &Service{identity: sender, nodeID: sender.NodeID()}
+	now := time.Now()
+
+	signed := func() Envelope {
+		env := Envelope{ID: "e1", From: sender.NodeID(), To: other.NodeID(), TTL: DefaultTTL, Payload: []byte(`{"type":"ping"}`)}
+		s.sign(&env)
+		return env
+	}
+	tests := []struct {
+		name   string
+		tamper func(*Envelope)
+		ok     bool
+	}{
+		{"signed", func(*Envelope) {}, true},
+		{"hop count changed", func(e *Envelope) { e.TTL-- }, true},
+		{"payload changed", func(e *Envelope) { e.Payload = []byte(`{"type":"chat"}`) }, false},
+		{"recipient changed", func(e *Envelope) { e.To = sender.NodeID() }, false},
+		{"sender forged", func(e *Envelope) { e.From = other.NodeID() }, false},
+		{"key swapped", func(e *Envelope) { e.Key = other.SigningKey() }, false},
+		{"unsigned", func(e *Envelope) { e.Key, e.Signature = nil, nil }, false},
+		{"stale", func(e *Envelope) {
+			e.Sent = now.Add(-2 * maxEnvelopeAge).Unix()
+			e.Signature = sender.Sign(e.signedData())
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := signed()
+			tt.tamper(&env)
+			if err := verify(env, now); (err == nil) != tt.ok {
+				t.Fatalf("verify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyFound(t *testing.T) {
+	target, neighbour := testIdentity(t), testIdentity(t)
+	signed := func(id *identity.Identity, lookupID string) FoundData {
+		found := FoundData{ID: lookupID, Target: target.NodeID(), Key: id.SigningKey()}
+		found.Signature = id.Sign(found.signedData())
+		return found
+	}
+
+	if err := verifyFound(signed(target, "l1")); err != nil {
+		t.Fatalf("verifyFound of the target's answer: %v", err)
+	}
+	replayed := signed(target, "l1")
+	replayed.ID = "l2"
+	tests := map[string]FoundData{
+		"unsigned":                    {ID: "l1", Target: target.NodeID()},
+		"signed by a neighbour":       signed(neighbour, "l1"),
+		"replayed for another lookup": replayed,
+	}
+	for name, found := range tests {
+		if err := verifyFound(found); !errors.Is(err, ErrNotTarget) {
+			t.Errorf("%s: verifyFound = %v, want %v", name, err, ErrNotTarget)
+		}
+	}
+}
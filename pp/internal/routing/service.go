@@ -0,0 +1,418 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"pp/internal/events"
+	"pp/internal/identity"
+	"pp/internal/message"
+	"pp/internal/peer"
+	"pp/internal/relay"
+	"pp/internal/util"
+)
+
+const (
+	// lookupTimeout bounds how long Send waits for a route_found answer.
+	lookupTimeout = 3 * time.Second
+	// relayDialTimeout bounds each attempt to reach a node through a relay.
+	relayDialTimeout = 3 * time.Second
+	// seenTTL is how long envelope and lookup IDs are remembered.
+	seenTTL = 2 * time.Minute
+	// maxEnvelopeAge bounds the clock difference to an envelope's sender.
+	// Older envelopes could be replays whose ID was already forgotten.
+	maxEnvelopeAge = seenTTL / 2
+)
+
+// seenEntry remembers where a lookup came from so answers can follow it back.
+type seenEntry struct {
+	addr   string
+	target string // node the lookup is for, empty for envelopes
+	at     time.Time
+}
+
+// Service routes messages to nodes by ID. It sends directly when the target
+// is a connected peer or reachable over an open relay circuit, otherwise it
+// uses routes learned from signed traffic and lookups, and finally tries to
+// open a circuit through the relays this node is reserved on.
+type Service struct {
+	identity     *identity.Identity
+	nodeID       string
+	serverAddr   string
+	eventManager *events.EventManager
+	peerManager  *peer.Manager
+	relayClient  *relay.Client
+
+	mu      sync.Mutex
+	routes  map[string]string    // node ID -> next hop address
+	seen    map[string]seenEntry // envelope or lookup ID -> previous hop
+	acks    map[string]chan Envelope
+	lookups map[string]chan string
+}
+
+// NewService creates a new Service instance.
+func NewService(id *identity.Identity, serverAddr string, eventManager *events.EventManager, peerManager *peer.Manager, relayClient *relay.Client) *Service {
+	return &Service{
+		identity:     id,
+		nodeID:       id.NodeID(),
+		serverAddr:   serverAddr,
+		eventManager: eventManager,
+		peerManager:  peerManager,
+		relayClient:  relayClient,
+		routes:       make(map[string]string),
+		seen:         make(map[string]seenEntry),
+		acks:         make(map[string]chan Envelope),
+		lookups:      make(map[string]chan string),
+	}
+}
+
+// Send routes payload to nodeID and waits until the target acknowledges it.
+func (s *Service) Send(nodeID string, payload []byte, timeout time.Duration) error {
+	nextHop, err := s.resolve(nodeID)
+	if err != nil {
+		return err
+	}
+
+	env := Envelope{
+		ID:      util.GenerateUUID(),
+		From:    s.nodeID,
+		To:      nodeID,
+		TTL:     DefaultTTL,
+		NeedAck: true,
+		Payload: payload,
+	}
+	s.sign(&env)
+	ackCh := make(chan Envelope, 1)
+	s.mu.Lock()
+	s.acks[env.ID] = ackCh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.acks, env.ID)
+		s.mu.Unlock()
+	}()
+
+	s.send(nextHop, message.Message{Type: "routed", Data: env, Sender: s.serverAddr})
+
+	select {
+	case ack := <-ackCh:
+		if ack.Error != "" {
+			return errors.New(ack.Error)
+		}
+		return nil
+	case <-time.After(timeout):
+		return ErrAckTimeout
+	}
+}
+
+// Forward routes payload to nodeID without looking up new routes or waiting
+// for an acknowledgement. It is used for replies, whose route was learned
+// from the request.
+func (s *Service) Forward(nodeID string, payload []byte) error {
+	nextHop, ok := s.nextHop(nodeID)
+	if !ok {
+		return ErrNoRoute
+	}
+	env := Envelope{
+		ID:      util.GenerateUUID(),
+		From:    s.nodeID,
+		To:      nodeID,
+		TTL:     DefaultTTL,
+		Payload: payload,
+	}
+	s.sign(&env)
+	s.send(nextHop, message.Message{Type: "routed", Data: env, Sender: s.serverAddr})
+	return nil
+}
+
+// HandleEnvelope delivers, acknowledges or forwards a routed message
+// received from addr. Only envelopes signed by their sender are accepted,
+// each at most once, so a route learned from one leads towards its sender.
+func (s *Service) HandleEnvelope(addr string, env Envelope) {
+	if err := verify(env, time.Now()); err != nil {
+		log.Printf("Dropping routed message %s from %s: %v", env.ID, addr, err)
+		return
+	}
+	if !s.markSeen(env.ID, addr, "") {
+		return
+	}
+	s.learn(env.From, addr)
+
+	if env.To != s.nodeID {
+		s.relayEnvelope(env)
+		return
+	}
+
+	if env.AckID != "" {
+		s.mu.Lock()
+		ackCh, ok := s.acks[env.AckID]
+		s.mu.Unlock()
+		if ok {
+			select {
+			case ackCh <- env:
+			default:
+			}
+		}
+		return
+	}
+
+	eventData := events.RoutedMessageEventData{
+		SourceID: env.From,
+		Payload:  env.Payload,
+	}
+	s.eventManager.Publish(events.RoutedMessageEvent{EventData: eventData})
+
+	if env.NeedAck {
+		s.acknowledge(env, "")
+	}
+}
+
+// HandleLookup answers or floods a route_lookup received from addr. Only
+// the target answers; a peer connected to it passes the lookup on to the
+// target alone.
+func (s *Service) HandleLookup(addr string, data LookupData) {
+	if !s.markSeen(data.ID, addr, data.Target) {
+		return
+	}
+
+	if data.Target == s.nodeID {
+		found := FoundData{ID: data.ID, Target: data.Target, Key: s.identity.SigningKey()}
+		found.Signature = s.identity.Sign(found.signedData())
+		s.send(addr, message.Message{Type: "route_found", Data: found, Sender: s.serverAddr})
+		return
+	}
+	if targetAddr, direct := s.direct(data.Target); direct {
+		s.send(targetAddr, message.Message{Type: "route_lookup", Data: data, Sender: s.serverAddr})
+		return
+	}
+
+	if data.TTL <= 1 {
+		return
+	}
+	data.TTL--
+	for _, p := range s.peerManager.GetPeers() {
+		if p != addr {
+			s.send(p, message.Message{Type: "route_lookup", Data: data, Sender: s.serverAddr})
+		}
+	}
+}
+
+// HandleFound records the route in a route_found received from addr and
+// passes it back towards whoever started the lookup. Answers not signed by
+// the target, and answers to lookups that never passed through this node,
+// are ignored.
+func (s *Service) HandleFound(addr string, data FoundData) {
+	if err := verifyFound(data); err != nil {
+		log.Printf("Ignoring route answer for %s from %s: %v", data.Target, addr, err)
+		return
+	}
+	s.mu.Lock()
+	resultCh, waiting := s.lookups[data.ID]
+	prev, seen := s.seen[data.ID]
+	s.mu.Unlock()
+	if !seen || prev.target == "" || prev.target != data.Target {
+		log.Printf("Ignoring unsolicited route answer for %s from %s", data.Target, addr)
+		return
+	}
+	s.learn(data.Target, addr)
+
+	if waiting {
+		select {
+		case resultCh <- addr:
+		default:
+		}
+		return
+	}
+	if seen && prev.addr != "" {
+		s.send(prev.addr, message.Message{Type: "route_found", Data: data, Sender: s.serverAddr})
+	}
+}
+
+// PeerDisconnected forgets routes whose next hop was addr.
+func (s *Service) PeerDisconnected(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nodeID, nextHop := range s.routes {
+		if nextHop == addr {
+			delete(s.routes, nodeID)
+		}
+	}
+}
+
+// resolve finds the next hop for nodeID, running a lookup and then trying
+// relays if no route is known yet.
+func (s *Service) resolve(nodeID string) (string, error) {
+	if nextHop, ok := s.nextHop(nodeID); ok {
+		return nextHop, nil
+	}
+	if nextHop, err := s.lookup(nodeID); err == nil {
+		return nextHop, nil
+	}
+	for _, relayAddr := range s.relayClient.Relays() {
+		addr, err := s.relayClient.Dial(relayAddr, nodeID, relayDialTimeout)
+		if err == nil {
+			return addr, nil
+		}
+		log.Printf("Relay %s cannot reach %s: %v", relayAddr, nodeID, err)
+	}
+	return "", ErrNoRoute
+}
+
+// nextHop returns the known next hop for nodeID without any network round trips.
+func (s *Service) nextHop(nodeID string) (string, bool) {
+	if addr, ok := s.direct(nodeID); ok {
+		return addr, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr, ok := s.routes[nodeID]
+	return addr, ok
+}
+
+// direct returns the address of a connection straight to nodeID.
+func (s *Service) direct(nodeID string) (string, bool) {
+	if p, ok := s.peerManager.FindByID(nodeID); ok {
+		return p.Addr, true
+	}
+	return s.relayClient.CircuitTo(nodeID)
+}
+
+// lookup floods a route_lookup to all peers and waits for the first answer.
+func (s *Service) lookup(nodeID string) (string, error) {
+	peers := s.peerManager.GetPeers()
+	if len(peers) == 0 {
+		return "", ErrNoRoute
+	}
+
+	data := LookupData{ID: util.GenerateUUID(), Target: nodeID, TTL: DefaultTTL}
+	resultCh := make(chan string, 1)
+	s.mu.Lock()
+	s.lookups[data.ID] = resultCh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lookups, data.ID)
+		s.mu.Unlock()
+	}()
+	s.markSeen(data.ID, "", nodeID)
+
+	for _, p := range peers {
+		s.send(p, message.Message{Type: "route_lookup", Data: data, Sender: s.serverAddr})
+	}
+
+	select {
+	case addr := <-resultCh:
+		return addr, nil
+	case <-time.After(lookupTimeout):
+		return "", ErrNoRoute
+	}
+}
+
+// relayEnvelope passes an envelope for another node one hop further.
+func (s *Service) relayEnvelope(env Envelope) {
+	nextHop, ok := s.nextHop(env.To)
+	if !ok {
+		s.acknowledge(env, ErrNoRoute.Error())
+		return
+	}
+	if env.TTL <= 1 {
+		s.acknowledge(env, ErrTTLExceeded.Error())
+		return
+	}
+	env.TTL--
+	s.send(nextHop, message.Message{Type: "routed", Data: env, Sender: s.serverAddr})
+}
+
+// acknowledge reports the fate of env back to its sender. Failures are
+// reported for every envelope, successful deliveries only when requested,
+// and acknowledgements themselves are never acknowledged.
+func (s *Service) acknowledge(env Envelope, errMsg string) {
+	if env.AckID != "" || (!env.NeedAck && errMsg == "") {
+		return
+	}
+	nextHop, ok := s.nextHop(env.From)
+	if !ok {
+		return
+	}
+	ack := Envelope{
+		ID:    util.GenerateUUID(),
+		From:  s.nodeID,
+		To:    env.From,
+		TTL:   DefaultTTL,
+		AckID: env.ID,
+		Error: errMsg,
+	}
+	s.sign(&ack)
+	s.send(nextHop, message.Message{Type: "routed", Data: ack, Sender: s.serverAddr})
+}
+
+// learn records addr as the next hop towards nodeID unless nodeID is directly connected.
+func (s *Service) learn(nodeID string, addr string) {
+	if nodeID == "" || nodeID == s.nodeID {
+		return
+	}
+	if _, ok := s.direct(nodeID); ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[nodeID] = addr
+}
+
+// sign stamps env with the time and this node's signature.
+func (s *Service) sign(env *Envelope) {
+	env.Sent = time.Now().Unix()
+	env.Key = s.identity.SigningKey()
+	env.Signature = s.identity.Sign(env.signedData())
+}
+
+// verify checks that env was signed by the node in its From field recently.
+func verify(env Envelope, now time.Time) error {
+	if identity.NodeIDOf(env.Key) != env.From || !identity.Verify(env.Key, env.signedData(), env.Signature) {
+		return ErrSignature
+	}
+	age := now.Sub(time.Unix(env.Sent, 0))
+	if age > maxEnvelopeAge || age < -maxEnvelopeAge {
+		return fmt.Errorf("sent %v ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// verifyFound checks that a route answer was signed by the target.
+func verifyFound(data FoundData) error {
+	if identity.NodeIDOf(data.Key) != data.Target || !identity.Verify(data.Key, data.signedData(), data.Signature) {
+		return ErrNotTarget
+	}
+	return nil
+}
+
+// markSeen records id and reports whether it was new, pruning old entries.
+func (s *Service) markSeen(id string, addr string, target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.seen {
+		if now.Sub(e.at) > seenTTL {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[id]; ok {
+		return false
+	}
+	s.seen[id] = seenEntry{addr: addr, target: target, at: now}
+	return true
+}
+
+// send publishes a SendMessageEvent so the node delivers msg to addr.
+func (s *Service) send(addr string, msg message.Message) {
+	eventData := events.SendMessageEventData{
+		DestinationAddr: addr,
+		Message:         msg,
+	}
+	s.eventManager.Publish(events.SendMessageEvent{EventData: eventData})
+}